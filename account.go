@@ -1,6 +1,8 @@
 package photoshare
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -8,27 +10,93 @@ import (
 
 func getAuthRedirectURL(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	url, err := ctx.auth.getRedirectURL(r, ctx.params.get("provider"))
+	url, err := ctx.auth.getRedirectURL(w, r, ctx.params.get("provider"))
 	if err != nil {
 		return err
 	}
 	return renderString(w, http.StatusOK, url)
 }
 
+// links a new identity to the account with the same email address, returning
+// that account, if both the provider and we have verified the address.
+// Returns nil otherwise: an unverified address may have been registered by
+// someone else, who would then get the login.
+func (ctx *context) linkIdentityByEmail(info *authInfo) (*user, error) {
+	if !info.emailVerified || info.email == "" {
+		return nil, nil
+	}
+	user, err := ctx.datamapper.getUserByEmail(info.email)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !user.EmailVerified {
+		return nil, nil
+	}
+	if err := ctx.datamapper.addIdentity(newUserIdentity(user.ID, info)); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 func authCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	info, err := ctx.auth.getUserInfo(r, ctx.params.get("provider"))
+	info, err := ctx.auth.getUserInfo(w, r, ctx.params.get("provider"))
 	if err != nil {
 		return err
 	}
 
-	// tbd: handle new users
-	user, err := ctx.datamapper.getUserByEmail(info.email)
+	user, err := ctx.datamapper.getUserByIdentity(info.provider, info.id)
+	if err != nil {
+		if !isErrSqlNoRows(err) {
+			return err
+		}
+		// first login with this identity
+		if user, err = ctx.linkIdentityByEmail(info); err != nil {
+			return err
+		}
+	}
+
+	// not linked: the user picks a name to sign up with, or links the identity
+	// to the account they're logged in to, using the identity token
+	if user == nil {
+		identityToken, err := ctx.session.createIdentityToken(info)
+		if err != nil {
+			return err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:    "identityToken",
+			Value:   identityToken,
+			Path:    "/",
+			Expires: time.Now().Add(time.Minute * identityExpiry),
+		})
+		http.Redirect(w, r, "/signup/", http.StatusSeeOther)
+		return nil
+	}
+
+	if user.TOTPEnabled {
+		token, err := ctx.session.createTwoFactorToken(user.ID)
+		if err != nil {
+			return err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:    "twoFactorToken",
+			Value:   token,
+			Path:    "/",
+			Expires: time.Now().Add(time.Minute * twoFactorExpiry),
+		})
+		http.Redirect(w, r, "/login/", http.StatusSeeOther)
+		return nil
+	}
+
+	session, refreshToken, err := ctx.createSession(r, user.ID)
 	if err != nil {
 		return err
 	}
 
-	authToken, err := ctx.session.createToken(user.ID)
+	authToken, err := ctx.session.createToken(user.ID, session.ID)
 
 	if err != nil {
 		return err
@@ -41,13 +109,23 @@ func authCallback(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		Expires: time.Now().AddDate(0, 0, 1),
 	}
 	http.SetCookie(w, cookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:    "refreshToken",
+		Value:   refreshToken,
+		Path:    "/",
+		Expires: session.ExpiresAt,
+	})
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 	return nil
 }
 
 func logout(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	if err := ctx.session.writeToken(w, 0); err != nil {
+	if _, err := ctx.datamapper.revokeSession(ctx.user.ID, ctx.user.SessionID); err != nil {
+		return err
+	}
+
+	if err := ctx.session.writeToken(w, 0, 0); err != nil {
 		return err
 	}
 
@@ -77,18 +155,45 @@ func login(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		return invalidLogin
 	}
 
+	// unknown identifiers are throttled like accounts, so responses don't reveal which exist
+	accountKey := identifierThrottleKey(s.Identifier)
+
 	user, err := ctx.datamapper.getUserByNameOrEmail(s.Identifier)
-	if err != nil {
-		if isErrSqlNoRows(err) {
-			return invalidLogin
-		}
+	if err == nil {
+		accountKey = accountThrottleKey(user.ID)
+	} else if isErrSqlNoRows(err) {
+		user = nil
+	} else {
 		return err
 	}
-	if !user.checkPassword(s.Password) {
+
+	if err := ctx.checkThrottles(ipThrottleKey("login", r), accountKey); err != nil {
+		return err
+	}
+
+	if user == nil || user.Password == "" {
+		checkDummyPassword(s.Password)
+	}
+	if user == nil || !user.checkPassword(s.Password) {
+		if err := ctx.loginFailed(r, user, accountKey); err != nil {
+			return err
+		}
 		return invalidLogin
 	}
 
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	// the session is only started once the code is verified, see verifyTwoFactor
+	if user.TOTPEnabled {
+		token, err := ctx.session.createTwoFactorToken(user.ID)
+		if err != nil {
+			return err
+		}
+		return renderJSON(w, newTwoFactorChallenge(token), http.StatusOK)
+	}
+
+	if err := ctx.datamapper.clearThrottle(accountKey); err != nil {
+		return err
+	}
+	if err := ctx.startSession(w, r, user.ID); err != nil {
 		return err
 	}
 
@@ -120,10 +225,15 @@ func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	token, err := user.generateVerifyToken()
+	if err != nil {
+		return err
+	}
+
 	if err := ctx.datamapper.createUser(user); err != nil {
 		return err
 	}
-	if err := ctx.session.writeToken(w, user.ID); err != nil {
+	if err := ctx.startSession(w, r, user.ID); err != nil {
 		return err
 	}
 
@@ -134,11 +244,14 @@ func signup(ctx *context, w http.ResponseWriter, r *http.Request) error {
 			logError(err)
 		}
 	}()
+	ctx.sendVerificationMail(user, token, r)
 
 	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
 
 }
 
+// changes the password of the current user, or of the user with the recovery
+// code; all other sessions are logged out and the user is emailed
 func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	var (
@@ -147,44 +260,178 @@ func changePassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	)
 
 	s := &struct {
-		Password     string `json:"password"`
-		RecoveryCode string `json:"code"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"currentPassword"`
+		RecoveryCode    string `json:"code"`
 	}{}
 
 	if err = decodeJSON(r, s); err != nil {
 		return err
 	}
+	if s.Password == "" {
+		return validationFailure{map[string]string{"password": "Password is missing"}}
+	}
+
+	invalidCode := httpError{http.StatusBadRequest, "Invalid or expired recovery code, please request a new one"}
 
 	if s.RecoveryCode == "" {
-		if user, err = ctx.authenticate(r, authLevelLogin); err != nil {
+		if user, err = ctx.authenticate(r, authLevelSession); err != nil {
 			return err
 		}
+		// users who only log in with an external provider have no password to confirm
+		if user.Password != "" && !user.checkPassword(s.CurrentPassword) {
+			return validationFailure{map[string]string{"password": "Current password is incorrect"}}
+		}
 	} else {
-		if user, err = ctx.datamapper.getUserByRecoveryCode(s.RecoveryCode); err != nil {
+		if user, err = ctx.datamapper.getUserByRecoveryCode(hashToken(s.RecoveryCode)); err != nil {
+			if isErrSqlNoRows(err) {
+				return invalidCode
+			}
 			return err
 		}
+		if user.recoveryCodeExpired(time.Now(), ctx.cfg.RecoveryCodeExpiry) {
+			return invalidCode
+		}
 		user.resetRecoveryCode()
 	}
 
 	if err = user.changePassword(s.Password); err != nil {
 		return err
 	}
-	if err := ctx.validate(user, r); err != nil {
+	if err := ctx.datamapper.updateUser(user); err != nil {
 		return err
 	}
-	if err := ctx.datamapper.updateUser(user); err != nil {
+
+	if err := ctx.datamapper.revokeSessions(user.ID); err != nil {
 		return err
 	}
+	// whoever reset the password may not be the one who created the tokens
+	var tokensRevoked int64
+	if s.RecoveryCode != "" {
+		if tokensRevoked, err = ctx.datamapper.removeAPITokens(user.ID); err != nil {
+			return err
+		}
+	}
+	// a user who was locked out can log in again with the new password
+	if err := ctx.datamapper.clearThrottle(accountThrottleKey(user.ID)); err != nil {
+		return err
+	}
+	// keep the user logged in if they changed their own password
+	if s.RecoveryCode == "" {
+		if err := ctx.startSession(w, r, user.ID); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		if err := ctx.mailer.sendPasswordChangedMail(user, tokensRevoked, r); err != nil {
+			logError(err)
+		}
+	}()
 
 	return renderString(w, http.StatusOK, "Password changed")
 }
 
+// starts changing the current user's email address: a verified current
+// address gets links to confirm or cancel the change, after which the new
+// address gets a verification link, and only becomes theirs once it is
+// followed. An unverified address is replaced once the new one is verified.
+func changeEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	// users who only log in with an external provider have no password to confirm
+	if ctx.user.Password != "" && !ctx.user.checkPassword(s.Password) {
+		return validationFailure{map[string]string{"password": "Password is incorrect"}}
+	}
+
+	email := strings.ToLower(strings.TrimSpace(s.Email))
+	if email == ctx.user.Email {
+		// cancels a pending change
+		if ctx.user.PendingEmail.Valid {
+			ctx.user.cancelEmailChange()
+			if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+				return err
+			}
+		}
+		return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+	}
+
+	if !validateEmail(email) {
+		return validationFailure{map[string]string{"email": "Invalid email address"}}
+	}
+	ok, err := ctx.datamapper.isUserEmailAvailable(&user{ID: ctx.user.ID, Email: email})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return validationFailure{map[string]string{"email": "Email already taken"}}
+	}
+
+	// shares the limit on verification emails
+	key := fmt.Sprintf("verify:%d", ctx.user.ID)
+	if err := ctx.checkThrottles(key); err != nil {
+		return err
+	}
+	if _, err := ctx.recordFailure(key, verifyFreeAttempts); err != nil {
+		return err
+	}
+
+	ctx.user.PendingEmail = sql.NullString{String: email, Valid: true}
+
+	if !ctx.user.EmailVerified {
+		ctx.user.ChangeToken = sql.NullString{}
+		token, err := ctx.user.generateVerifyToken()
+		if err != nil {
+			return err
+		}
+		if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+			return err
+		}
+		ctx.sendVerificationMail(ctx.user, token, r)
+		return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+	}
+
+	token, err := ctx.user.generateChangeToken()
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	go func(user *user) {
+		if err := ctx.mailer.sendEmailChangeMail(user, token, r); err != nil {
+			logError(err)
+		}
+	}(ctx.user)
+
+	return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+}
+
 func emailExists(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	email := r.FormValue("email")
 	if email == "" {
 		return httpError{http.StatusBadRequest, "Missing email address"}
 	}
+
+	// every check counts, so addresses can't be tried one after another
+	key := ipThrottleKey("email-check", r)
+	if err := ctx.checkThrottles(key); err != nil {
+		return err
+	}
+	if _, err := ctx.recordFailure(key, emailCheckAttempts); err != nil {
+		return err
+	}
+
 	u := &user{Email: email}
 	used, err := ctx.datamapper.isUserEmailAvailable(u)
 	if err != nil {
@@ -199,6 +446,8 @@ func emailExists(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 }
 
+// sends a reset link if the address belongs to an account; the response is the
+// same either way so it can't be used to find out which addresses are registered
 func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	s := &struct {
@@ -211,14 +460,36 @@ func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 	if s.Email == "" {
 		return httpError{http.StatusBadRequest, "Missing email address"}
 	}
+
+	// every request counts, so nobody can be flooded with reset emails
+	emailKey := "recover:" + strings.ToLower(strings.TrimSpace(s.Email))
+	ipKey := ipThrottleKey("recover", r)
+
+	if err := ctx.checkThrottles(ipKey, emailKey); err != nil {
+		return err
+	}
+	if _, err := ctx.recordFailure(ipKey, recoverIPAttempts); err != nil {
+		return err
+	}
+	if _, err := ctx.recordFailure(emailKey, recoverFreeAttempts); err != nil {
+		return err
+	}
+
+	var sent = func() error {
+		return renderString(w, http.StatusOK, "If this email address is registered, a link to reset your password has been sent")
+	}
+
 	user, err := ctx.datamapper.getUserByEmail(s.Email)
 	if err != nil {
 		if isErrSqlNoRows(err) {
-			return httpError{http.StatusBadRequest, "Email address not found"}
+			return sent()
 		}
 		return err
 	}
 	code, err := user.generateRecoveryCode()
+	if err != nil {
+		return err
+	}
 
 	if err := ctx.datamapper.updateUser(user); err != nil {
 		return err
@@ -230,5 +501,5 @@ func recoverPassword(ctx *context, w http.ResponseWriter, r *http.Request) error
 		}
 	}()
 
-	return renderString(w, http.StatusOK, "Password reset")
+	return sent()
 }
@@ -0,0 +1,51 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// user 1, with the password "current"
+type passwordStore struct {
+	mockDataMapper
+	updated *user
+}
+
+func (m *passwordStore) getActiveUser(userID int64) (*user, error) {
+	user := &user{ID: userID}
+	return user, user.changePassword("current")
+}
+
+func (m *passwordStore) updateUser(user *user) error {
+	m.updated = user
+	return nil
+}
+
+func TestChangePasswordLoggedIn(t *testing.T) {
+	store := &passwordStore{}
+	c := &context{
+		app: &app{
+			cfg:        &config{SessionExpiry: 30},
+			datamapper: store,
+			session:    &loggedInSessionManager{},
+		},
+		params: &params{make(map[string]string)},
+	}
+
+	r, _ := http.NewRequest("PUT", "/api/auth/changepass", strings.NewReader(`{"password": "new-password"}`))
+	err := changePassword(c, httptest.NewRecorder(), r)
+	if e, ok := err.(validationFailure); !ok || e.Errors["password"] == "" {
+		t.Error("Current password should be required:", err)
+	}
+	if store.updated != nil {
+		t.Error("Password should not be changed")
+	}
+
+	r, _ = http.NewRequest("PUT", "/api/auth/changepass",
+		strings.NewReader(`{"password": "new-password", "currentPassword": "wrong"}`))
+	if err := changePassword(c, httptest.NewRecorder(), r); err == nil || store.updated != nil {
+		t.Error("Wrong current password should be rejected")
+	}
+}
@@ -0,0 +1,100 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users group their photos into albums. A photo is in at most one album,
+// which must be its owner's; photos are moved with the bulk edit endpoint.
+
+const maxAlbumNameLength = 100
+
+type album struct {
+	ID        int64     `db:"id" json:"id"`
+	OwnerID   int64     `db:"owner_id" json:"ownerId"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (album *album) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	album.Name = strings.TrimSpace(album.Name)
+	if album.Name == "" {
+		errors["name"] = "Name is missing"
+	} else if len(album.Name) > maxAlbumNameLength {
+		errors["name"] = fmt.Sprintf("Name must be no more than %d characters", maxAlbumNameLength)
+	}
+	return nil
+}
+
+func (album *album) canEdit(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || album.OwnerID == user.ID
+}
+
+func createAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album := &album{}
+
+	if err := decodeJSON(r, album); err != nil {
+		return err
+	}
+
+	album.OwnerID = ctx.user.ID
+	album.CreatedAt = time.Now()
+
+	if err := ctx.validate(album, r); err != nil {
+		return err
+	}
+	if err := ctx.datamapper.createAlbum(album); err != nil {
+		return err
+	}
+	return renderJSON(w, album, http.StatusCreated)
+}
+
+func getAlbumsByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	albums, err := ctx.datamapper.getAlbums(ctx.params.getInt("ownerID"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, albums, http.StatusOK)
+}
+
+func getAlbumPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := ctx.datamapper.getAlbum(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	photos, err := ctx.datamapper.getPhotosByAlbum(getPage(r), album.ID, r.FormValue("orderBy"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
+}
+
+// deletes the album; its photos are kept
+func deleteAlbum(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	album, err := ctx.datamapper.getAlbum(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !album.canEdit(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to delete this album"}
+	}
+
+	if err := ctx.datamapper.removeAlbum(album); err != nil {
+		return err
+	}
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderString(w, http.StatusOK, "Album deleted")
+}
@@ -11,10 +11,11 @@ import (
 type authLevel int
 
 const (
-	authLevelIgnore authLevel = iota // we don't need the user in this handler
-	authLevelCheck                   // prefetch user, doesn't matter if not logged in
-	authLevelLogin                   // user required, 401 if not available
-	authLevelAdmin                   // admin required, 401 if no user, 403 if not admin
+	authLevelIgnore  authLevel = iota // we don't need the user in this handler
+	authLevelCheck                    // prefetch user, doesn't matter if not logged in
+	authLevelLogin                    // user required, 401 if not available
+	authLevelAdmin                    // admin required, 401 if no user, 403 if not admin
+	authLevelSession                  // user logged in with a session, 401 if no user, 403 for API tokens
 )
 
 // contains all the objects needed to run the application
@@ -57,7 +58,7 @@ func newApp() (*app, error) {
 	app.cache = newCache(app.cfg)
 	app.auth = newAuthenticator(app.cfg)
 
-	app.session, err = newSessionManager(app.cfg)
+	app.session, err = newSessionManager(app.cfg, app.datamapper)
 	if err != nil {
 		return app, err
 	}
@@ -88,6 +89,7 @@ func (app *app) initDB() error {
 // errors appropriately.
 func (app *app) handler(h handlerFunc, level authLevel) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		useForwardedFor(r, app.cfg.isTrustedProxy)
 		handleError(w, r, func() error {
 			user, err := app.authenticate(r, level)
 			if err != nil {
@@ -120,20 +122,38 @@ func (app *app) authenticate(r *http.Request, level authLevel) (*user, error) {
 			if !user.IsAdmin {
 				return httpError{http.StatusForbidden, "You must be an admin"}
 			}
+		case authLevelSession:
+			if !user.IsAuthenticated {
+				return errLoginRequired
+			}
+			// API tokens can't manage the account, e.g. to mint more tokens
+			if user.SessionID == 0 {
+				return httpError{http.StatusForbidden, "API tokens are not allowed to manage the account"}
+			}
 		}
 		return nil
 	}
 
 	user := &user{}
 
-	userID, err := app.session.readToken(r)
-	if err != nil {
-		return user, err
+	// scripts authenticate with an API token rather than a session
+	token := &accessToken{}
+	if key := getAPIToken(r); key != "" {
+		userID, err := app.readAPIToken(r, key)
+		if err != nil {
+			return nil, err
+		}
+		token.userID = userID
+	} else {
+		var err error
+		if token, err = app.session.readToken(r); err != nil {
+			return user, err
+		}
 	}
-	if userID == 0 {
+	if token.userID == 0 {
 		return user, checkAuthLevel(user)
 	}
-	user, err = app.datamapper.getActiveUser(userID)
+	user, err := app.datamapper.getActiveUser(token.userID)
 	if err != nil {
 		if isErrSqlNoRows(err) {
 			return user, checkAuthLevel(user)
@@ -141,6 +161,7 @@ func (app *app) authenticate(r *http.Request, level authLevel) (*user, error) {
 		return nil, err
 	}
 	user.IsAuthenticated = true
+	user.SessionID = token.sessionID
 
 	return user, checkAuthLevel(user)
 }
@@ -158,6 +179,15 @@ func (app *app) initRouter() {
 	photos.HandleFunc("/", app.handler(upload, authLevelLogin)).Methods("POST").Name("photos")
 	photos.HandleFunc("/search", app.handler(searchPhotos, authLevelIgnore)).Methods("GET").Name("search")
 	photos.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(photosByOwnerID, authLevelIgnore)).Methods("GET").Name("owner")
+	photos.HandleFunc("/calendar", app.handler(getPhotoCalendar, authLevelIgnore)).Methods("GET").Name("photoCalendar")
+	photos.HandleFunc("/calendar/photos", app.handler(getPhotosByDate, authLevelIgnore)).Methods("GET").Name("photosByDate")
+	photos.HandleFunc("/bulk", app.handler(bulkEditPhotos, authLevelLogin)).Methods("POST").Name("bulkEditPhotos")
+	photos.HandleFunc("/trash", app.handler(getTrash, authLevelLogin)).Methods("GET").Name("trash")
+	photos.HandleFunc("/trash/{id:[0-9]+}", app.handler(purgePhoto, authLevelLogin)).Methods("DELETE").Name("purgePhoto")
+	photos.HandleFunc("/trash/{id:[0-9]+}/restore", app.handler(restorePhoto, authLevelLogin)).Methods("POST").Name("restorePhoto")
+	photos.HandleFunc("/map", app.handler(getPhotoMap, authLevelIgnore)).Methods("GET").Name("photoMap")
+	photos.HandleFunc("/timeline", app.handler(getTimeline, authLevelLogin)).Methods("GET").Name("timeline")
+	photos.HandleFunc("/favorites", app.handler(getFavorites, authLevelLogin)).Methods("GET").Name("favorites")
 
 	photos.HandleFunc("/{id:[0-9]+}", app.handler(getPhotoDetail, authLevelCheck)).Methods("GET").Name("photoDetail")
 	photos.HandleFunc("/{id:[0-9]+}", app.handler(deletePhoto, authLevelLogin)).Methods("DELETE").Name("deletePhoto")
@@ -165,21 +195,93 @@ func (app *app) initRouter() {
 	photos.HandleFunc("/{id:[0-9]+}/tags", app.handler(editPhotoTags, authLevelLogin)).Methods("PATCH").Name("editPhotoTags")
 	photos.HandleFunc("/{id:[0-9]+}/upvote", app.handler(voteUp, authLevelLogin)).Methods("PATCH").Name("upvote")
 	photos.HandleFunc("/{id:[0-9]+}/downvote", app.handler(voteDown, authLevelLogin)).Methods("PATCH").Name("downvote")
+	photos.HandleFunc("/{id:[0-9]+}/vote", app.handler(retractVote, authLevelLogin)).Methods("DELETE").Name("retractVote")
+	photos.HandleFunc("/{id:[0-9]+}/favorite", app.handler(addFavorite, authLevelLogin)).Methods("PUT").Name("addFavorite")
+	photos.HandleFunc("/{id:[0-9]+}/favorite", app.handler(removeFavorite, authLevelLogin)).Methods("DELETE").Name("removeFavorite")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(getComments, authLevelCheck)).Methods("GET").Name("comments")
+	photos.HandleFunc("/{id:[0-9]+}/comments", app.handler(addComment, authLevelLogin)).Methods("POST").Name("addComment")
+	photos.HandleFunc("/{id:[0-9]+}/comments/enabled", app.handler(editPhotoComments, authLevelLogin)).Methods("PATCH").Name("editPhotoComments")
+	photos.HandleFunc("/{id:[0-9]+}/location", app.handler(editPhotoLocation, authLevelLogin)).Methods("PATCH").Name("editPhotoLocation")
+
+	albums := api.PathPrefix("/albums/").Subrouter()
+
+	albums.HandleFunc("/", app.handler(createAlbum, authLevelLogin)).Methods("POST").Name("createAlbum")
+	albums.HandleFunc("/owner/{ownerID:[0-9]+}", app.handler(getAlbumsByOwnerID, authLevelIgnore)).Methods("GET").Name("albums")
+	albums.HandleFunc("/{id:[0-9]+}/photos", app.handler(getAlbumPhotos, authLevelIgnore)).Methods("GET").Name("albumPhotos")
+	albums.HandleFunc("/{id:[0-9]+}", app.handler(deleteAlbum, authLevelLogin)).Methods("DELETE").Name("deleteAlbum")
+
+	comments := api.PathPrefix("/comments/").Subrouter()
+
+	comments.HandleFunc("/{id:[0-9]+}", app.handler(editComment, authLevelLogin)).Methods("PATCH").Name("editComment")
+	comments.HandleFunc("/{id:[0-9]+}", app.handler(deleteComment, authLevelLogin)).Methods("DELETE").Name("deleteComment")
+
+	users := api.PathPrefix("/users/").Subrouter()
+
+	users.HandleFunc("/{id:[0-9]+}", app.handler(getProfile, authLevelIgnore)).Methods("GET").Name("profile")
+	users.HandleFunc("/{id:[0-9]+}/follow", app.handler(followUser, authLevelLogin)).Methods("PUT").Name("followUser")
+	users.HandleFunc("/{id:[0-9]+}/follow", app.handler(unfollowUser, authLevelLogin)).Methods("DELETE").Name("unfollowUser")
+	users.HandleFunc("/{id:[0-9]+}/2fa", app.handler(resetTwoFactor, authLevelAdmin)).Methods("DELETE").Name("resetTwoFactor")
+	users.HandleFunc("/{id:[0-9]+}/followers", app.handler(getFollowers, authLevelIgnore)).Methods("GET").Name("followers")
+	users.HandleFunc("/{id:[0-9]+}/following", app.handler(getFollowing, authLevelIgnore)).Methods("GET").Name("following")
 
 	auth := api.PathPrefix("/auth/").Subrouter()
 
 	auth.HandleFunc("/", app.handler(getSessionInfo, authLevelCheck)).Methods("GET").Name("sessionInfo")
 	auth.HandleFunc("/", app.handler(login, authLevelIgnore)).Methods("POST").Name("login")
-	auth.HandleFunc("/", app.handler(logout, authLevelLogin)).Methods("DELETE").Name("logout")
+	auth.HandleFunc("/", app.handler(logout, authLevelSession)).Methods("DELETE").Name("logout")
+	auth.HandleFunc("/refresh", app.handler(refreshSession, authLevelIgnore)).Methods("POST").Name("refreshSession")
+	auth.HandleFunc("/sessions", app.handler(getSessions, authLevelSession)).Methods("GET").Name("sessions")
+	auth.HandleFunc("/sessions", app.handler(logoutEverywhere, authLevelSession)).Methods("DELETE").Name("logoutEverywhere")
+	auth.HandleFunc("/sessions/{id:[0-9]+}", app.handler(revokeSession, authLevelSession)).Methods("DELETE").Name("revokeSession")
+	auth.HandleFunc("/tokens", app.handler(getAPITokens, authLevelSession)).Methods("GET").Name("apiTokens")
+	auth.HandleFunc("/tokens", app.handler(createAPIToken, authLevelSession)).Methods("POST").Name("createAPIToken")
+	auth.HandleFunc("/tokens/{id:[0-9]+}", app.handler(removeAPIToken, authLevelSession)).Methods("DELETE").Name("removeAPIToken")
+	auth.HandleFunc("/2fa", app.handler(getTwoFactorStatus, authLevelSession)).Methods("GET").Name("twoFactorStatus")
+	auth.HandleFunc("/2fa", app.handler(disableTwoFactor, authLevelSession)).Methods("DELETE").Name("disableTwoFactor")
+	auth.HandleFunc("/2fa/enroll", app.handler(enrollTwoFactor, authLevelSession)).Methods("POST").Name("enrollTwoFactor")
+	auth.HandleFunc("/2fa/enable", app.handler(enableTwoFactor, authLevelSession)).Methods("POST").Name("enableTwoFactor")
+	auth.HandleFunc("/2fa/backup-codes", app.handler(regenerateBackupCodes, authLevelSession)).Methods("POST").Name("backupCodes")
+	auth.HandleFunc("/2fa/verify", app.handler(verifyTwoFactor, authLevelIgnore)).Methods("POST").Name("verifyTwoFactor")
 	auth.HandleFunc("/emailExists", app.handler(emailExists, authLevelIgnore)).Methods("GET").Name("emailExists")
 	auth.HandleFunc("/signup", app.handler(signup, authLevelIgnore)).Methods("POST").Name("signup")
 	auth.HandleFunc("/recoverpass", app.handler(recoverPassword, authLevelIgnore)).Methods("PUT").Name("recoverPassword")
 	auth.HandleFunc("/changepass", app.handler(changePassword, authLevelIgnore)).Methods("PUT").Name("changePassword")
+	auth.HandleFunc("/email", app.handler(changeEmail, authLevelSession)).Methods("PUT").Name("changeEmail")
+	auth.HandleFunc("/email/confirm", app.handler(confirmEmailChange, authLevelIgnore)).Methods("POST").Name("confirmEmailChange")
+	auth.HandleFunc("/email/cancel", app.handler(cancelEmailChange, authLevelIgnore)).Methods("POST").Name("cancelEmailChange")
+	auth.HandleFunc("/profile", app.handler(getOwnProfile, authLevelSession)).Methods("GET").Name("ownProfile")
+	auth.HandleFunc("/profile", app.handler(updateProfile, authLevelSession)).Methods("PATCH").Name("updateProfile")
+	auth.HandleFunc("/profile/avatar", app.handler(updateAvatar, authLevelSession)).Methods("PUT").Name("updateAvatar")
+	auth.HandleFunc("/profile/avatar", app.handler(removeAvatar, authLevelSession)).Methods("DELETE").Name("removeAvatar")
+	auth.HandleFunc("/account", app.handler(deleteAccount, authLevelSession)).Methods("DELETE").Name("deleteAccount")
+	auth.HandleFunc("/export", app.handler(getExports, authLevelSession)).Methods("GET").Name("exports")
+	auth.HandleFunc("/export", app.handler(requestExport, authLevelSession)).Methods("POST").Name("requestExport")
+	auth.HandleFunc("/export/download", app.handler(downloadExport, authLevelIgnore)).Methods("GET").Name("downloadExport")
+	auth.HandleFunc("/verify", app.handler(verifyEmail, authLevelIgnore)).Methods("POST").Name("verifyEmail")
+	auth.HandleFunc("/verify/resend", app.handler(resendVerification, authLevelSession)).Methods("POST").Name("resendVerification")
 
 	auth.HandleFunc("/oauth2/{provider}/url", app.handler(getAuthRedirectURL, authLevelIgnore)).Methods("GET")
 	auth.HandleFunc("/oauth2/{provider}/callback/", app.handler(authCallback, authLevelIgnore)).Methods("GET")
+	auth.HandleFunc("/oauth2/signup", app.handler(oauthSignup, authLevelIgnore)).Methods("POST").Name("oauthSignup")
+	auth.HandleFunc("/identities", app.handler(getIdentities, authLevelSession)).Methods("GET").Name("identities")
+	auth.HandleFunc("/identities", app.handler(linkIdentity, authLevelSession)).Methods("POST").Name("linkIdentity")
+	auth.HandleFunc("/identities/{id:[0-9]+}", app.handler(unlinkIdentity, authLevelSession)).Methods("DELETE").Name("unlinkIdentity")
 
 	api.HandleFunc("/tags/", app.handler(getTags, authLevelIgnore)).Methods("GET").Name("tags")
+	api.HandleFunc("/tags/autocomplete", app.handler(autocompleteTags, authLevelIgnore)).Methods("GET").Name("autocompleteTags")
+	api.HandleFunc("/tags/tree", app.handler(getTagTree, authLevelIgnore)).Methods("GET").Name("tagTree")
+	api.HandleFunc("/tags/related", app.handler(getRelatedTags, authLevelIgnore)).Methods("GET").Name("relatedTags")
+	api.HandleFunc("/tags/synonyms", app.handler(getTagSynonyms, authLevelAdmin)).Methods("GET").Name("tagSynonyms")
+	// tag names can contain "/", so they come last in the path
+	api.HandleFunc("/tags/synonyms/{synonym:.+}", app.handler(addTagSynonym, authLevelAdmin)).Methods("PUT").Name("addTagSynonym")
+	api.HandleFunc("/tags/synonyms/{synonym:.+}", app.handler(removeTagSynonym, authLevelAdmin)).Methods("DELETE").Name("removeTagSynonym")
+	api.HandleFunc("/tags/blocklist", app.handler(getBlockedTags, authLevelAdmin)).Methods("GET").Name("blockedTags")
+	api.HandleFunc("/tags/blocklist/{name:.+}", app.handler(blockTag, authLevelAdmin)).Methods("PUT").Name("blockTag")
+	api.HandleFunc("/tags/blocklist/{name:.+}", app.handler(unblockTag, authLevelAdmin)).Methods("DELETE").Name("unblockTag")
+	api.HandleFunc("/tags/rename/{name:.+}", app.handler(renameTag, authLevelAdmin)).Methods("PATCH").Name("renameTag")
+	api.HandleFunc("/tags/merge/{name:.+}", app.handler(mergeTags, authLevelAdmin)).Methods("POST").Name("mergeTags")
+	api.HandleFunc("/tags/follow/{name:.+}", app.handler(followTag, authLevelLogin)).Methods("PUT").Name("followTag")
+	api.HandleFunc("/tags/follow/{name:.+}", app.handler(unfollowTag, authLevelLogin)).Methods("DELETE").Name("unfollowTag")
 	api.Handle("/messages/{path:.*}", messageHandler).Name("messages")
 
 	feeds := app.router.PathPrefix("/feeds/").Subrouter()
@@ -187,6 +289,7 @@ func (app *app) initRouter() {
 	feeds.HandleFunc("", app.handler(latestFeed, authLevelIgnore)).Methods("GET").Name("latestFeed")
 	feeds.HandleFunc("popular/", app.handler(popularFeed, authLevelIgnore)).Methods("GET").Name("popularFeed")
 	feeds.HandleFunc("owner/{ownerID:[0-9]+}", app.handler(ownerFeed, authLevelIgnore)).Methods("GET").Name("ownerFeed")
+	feeds.HandleFunc("timeline/", app.handler(timelineFeed, authLevelLogin)).Methods("GET").Name("timelineFeed")
 
 	app.router.PathPrefix("/").Handler(http.FileServer(http.Dir(app.cfg.PublicDir)))
 
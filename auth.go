@@ -8,32 +8,45 @@ import (
 	"github.com/stretchr/objx"
 	"github.com/stretchr/signature"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// the user's account at an external provider
 type authInfo struct {
-	name, email string
+	provider, id  string
+	name, email   string
+	emailVerified bool // the provider has checked the user owns the address
 }
 
 type authenticator interface {
-	getRedirectURL(*http.Request, string) (string, error)
-	getUserInfo(*http.Request, string) (*authInfo, error)
+	getRedirectURL(http.ResponseWriter, *http.Request, string) (string, error)
+	getUserInfo(http.ResponseWriter, *http.Request, string) (*authInfo, error)
 }
 
 func newAuthenticator(cfg *config) authenticator {
 	gomniauth.SetSecurityKey(signature.RandomKey(64))
-	a := &defaultAuthenticator{cfg}
+	a := &defaultAuthenticator{cfg: cfg}
+	if cfg.OIDCIssuer != "" {
+		a.oidc = newOIDCProvider(cfg)
+	}
 	return a
 }
 
 type defaultAuthenticator struct {
-	cfg *config
+	cfg  *config
+	oidc *oidcProvider
+}
+
+func getCallbackURL(r *http.Request, providerName string) string {
+	return getBaseURL(r) + "/api/auth/oauth2/" + providerName + "/callback/"
 }
 
 func (a *defaultAuthenticator) getAuthProvider(r *http.Request, providerName string) (common.Provider, error) {
 	gomniauth.WithProviders(
 		google.New(a.cfg.GoogleClientID,
 			a.cfg.GoogleSecret,
-			getBaseURL(r)+"/api/auth/oauth2/google/callback/",
+			getCallbackURL(r, "google"),
 		),
 	)
 	provider, err := gomniauth.Provider(providerName)
@@ -43,7 +56,10 @@ func (a *defaultAuthenticator) getAuthProvider(r *http.Request, providerName str
 	return provider, nil
 }
 
-func (a *defaultAuthenticator) getRedirectURL(r *http.Request, providerName string) (string, error) {
+func (a *defaultAuthenticator) getRedirectURL(w http.ResponseWriter, r *http.Request, providerName string) (string, error) {
+	if providerName == oidcProviderName && a.oidc != nil {
+		return a.oidc.getRedirectURL(w, getCallbackURL(r, providerName))
+	}
 	provider, err := a.getAuthProvider(r, providerName)
 	if err != nil {
 		return "", errgo.Mask(err)
@@ -56,7 +72,10 @@ func (a *defaultAuthenticator) getRedirectURL(r *http.Request, providerName stri
 	return url, nil
 }
 
-func (a *defaultAuthenticator) getUserInfo(r *http.Request, providerName string) (*authInfo, error) {
+func (a *defaultAuthenticator) getUserInfo(w http.ResponseWriter, r *http.Request, providerName string) (*authInfo, error) {
+	if providerName == oidcProviderName && a.oidc != nil {
+		return a.oidc.getUserInfo(w, r, getCallbackURL(r, providerName))
+	}
 	provider, err := a.getAuthProvider(r, providerName)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -77,9 +96,38 @@ func (a *defaultAuthenticator) getUserInfo(r *http.Request, providerName string)
 		return nil, errgo.Mask(err)
 	}
 	info := &authInfo{
-		name:  user.Name(),
-		email: user.Email(),
+		provider:      providerName,
+		id:            user.IDForProvider(providerName),
+		name:          user.Name(),
+		email:         strings.ToLower(user.Email()),
+		emailVerified: isEmailVerified(user.Data()),
 	}
 
 	return info, nil
 }
+
+// reads verified_email from the provider's raw user info, as returned by
+// Google; without it the address isn't trusted
+func isEmailVerified(data objx.Map) bool {
+	return data.Get("verified_email").Bool()
+}
+
+// an external account linked to a user, which they can log in with
+type userIdentity struct {
+	ID             int64     `db:"id" json:"id"`
+	UserID         int64     `db:"user_id" json:"-"`
+	Provider       string    `db:"provider" json:"provider"`
+	ProviderUserID string    `db:"provider_user_id" json:"-"`
+	Email          string    `db:"email" json:"email"`
+	CreatedAt      time.Time `db:"created_at" json:"createdAt"`
+}
+
+func newUserIdentity(userID int64, info *authInfo) *userIdentity {
+	return &userIdentity{
+		UserID:         userID,
+		Provider:       info.provider,
+		ProviderUserID: info.id,
+		Email:          info.email,
+		CreatedAt:      time.Now(),
+	}
+}
@@ -0,0 +1,198 @@
+package photoshare
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/objx"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// a local stand-in for an OpenID Connect identity server; the ID token it
+// issues carries whatever nonce points to
+func newTestOIDCServer(t *testing.T, nonce *string) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "test-code" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   server.URL,
+			"sub":   "user-1234",
+			"aud":   "photoshare",
+			"nonce": *nonce,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		})
+		idToken := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".unsigned"
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-access-token" {
+			http.Error(w, "invalid_token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":                "user-1234",
+			"email":              "Tester@Example.com",
+			"email_verified":     true,
+			"name":               "Test User",
+			"preferred_username": "tester",
+		})
+	})
+
+	server = httptest.NewServer(mux)
+	return server
+}
+
+// starts a login, returning the provider's authorization URL and the request
+// the user's browser makes to the callback with the given state
+func startTestOIDCLogin(t *testing.T, p *oidcProvider, callback, state string) (*url.URL, *http.Request) {
+	w := httptest.NewRecorder()
+	redirect, err := p.getRedirectURL(w, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == "" {
+		state = u.Query().Get("state")
+	}
+	q := url.Values{"code": {"test-code"}, "state": {state}}
+	r, _ := http.NewRequest("GET", callback+"?"+q.Encode(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return u, r
+}
+
+func TestOIDCLogin(t *testing.T) {
+	var nonce string
+	server := newTestOIDCServer(t, &nonce)
+	defer server.Close()
+
+	p := newOIDCProvider(&config{
+		OIDCIssuer:   server.URL,
+		OIDCClientID: "photoshare",
+		OIDCSecret:   "secret",
+		OIDCScopes:   "openid email profile",
+	})
+	callback := "http://localhost/api/auth/oauth2/oidc/callback/"
+
+	u, r := startTestOIDCLogin(t, p, callback, "")
+	if u.Path != "/authorize" || u.Query().Get("client_id") != "photoshare" || u.Query().Get("redirect_uri") != callback {
+		t.Fatal("Unexpected redirect URL:", u)
+	}
+	nonce = u.Query().Get("nonce")
+
+	w := httptest.NewRecorder()
+	info, err := p.getUserInfo(w, r, callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.provider != oidcProviderName || info.id != "user-1234" || info.name != "tester" ||
+		info.email != "tester@example.com" || !info.emailVerified {
+		t.Errorf("Unexpected user info: %+v", info)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].MaxAge >= 0 {
+		t.Error("State cookie should be cleared")
+	}
+}
+
+func TestOIDCInvalidState(t *testing.T) {
+	var nonce string
+	server := newTestOIDCServer(t, &nonce)
+	defer server.Close()
+
+	p := newOIDCProvider(&config{OIDCIssuer: server.URL, OIDCClientID: "photoshare", OIDCSecret: "secret"})
+
+	// a state from another login
+	u, r := startTestOIDCLogin(t, p, "/callback", "forged")
+	nonce = u.Query().Get("nonce")
+	if _, err := p.getUserInfo(httptest.NewRecorder(), r, "/callback"); err == nil {
+		t.Error("Forged state should be rejected")
+	}
+
+	// no cookie, as when the callback is sent from someone else's browser
+	r, _ = http.NewRequest("GET", "/callback?code=test-code&state="+u.Query().Get("state"), nil)
+	if _, err := p.getUserInfo(httptest.NewRecorder(), r, "/callback"); err == nil {
+		t.Error("Callback without the state cookie should be rejected")
+	}
+}
+
+func TestOIDCInvalidNonce(t *testing.T) {
+	nonce := "another-login"
+	server := newTestOIDCServer(t, &nonce)
+	defer server.Close()
+
+	p := newOIDCProvider(&config{OIDCIssuer: server.URL, OIDCClientID: "photoshare", OIDCSecret: "secret"})
+
+	_, r := startTestOIDCLogin(t, p, "/callback", "")
+	if _, err := p.getUserInfo(httptest.NewRecorder(), r, "/callback"); err == nil {
+		t.Error("ID token with another nonce should be rejected")
+	}
+}
+
+type unverifiedUserStore struct {
+	mockDataMapper
+}
+
+func (m *unverifiedUserStore) getUserByEmail(email string) (*user, error) {
+	return &user{ID: 1, Email: email}, nil
+}
+
+// an account whose address hasn't been verified may not belong to the provider's user
+func TestLinkIdentityByEmailUnverified(t *testing.T) {
+	info := &authInfo{provider: oidcProviderName, id: "user-1234", email: "tester@example.com", emailVerified: true}
+
+	c := &context{app: &app{datamapper: &unverifiedUserStore{}}}
+	user, err := c.linkIdentityByEmail(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != nil {
+		t.Error("Identity should not be linked to an unverified account")
+	}
+
+	c = &context{app: &app{datamapper: &mockDataMapper{}}}
+	info.emailVerified = false
+	if user, _ := c.linkIdentityByEmail(info); user != nil {
+		t.Error("Identity should not be linked when the provider hasn't verified the address")
+	}
+}
+
+func TestIsEmailVerified(t *testing.T) {
+	if !isEmailVerified(objx.Map{"email": "tester@example.com", "verified_email": true}) {
+		t.Error("Verified address should be trusted")
+	}
+	for _, data := range []objx.Map{
+		{"email": "tester@example.com", "verified_email": false},
+		{"email": "tester@example.com"},
+		{"email": "tester@example.com", "verified_email": "true"},
+	} {
+		if isEmailVerified(data) {
+			t.Error("Address should not be trusted:", data)
+		}
+	}
+}
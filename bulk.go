@@ -0,0 +1,220 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxBulkItems = 500
+
+// bulk operations
+const (
+	bulkAddTags          = "add-tags"
+	bulkRemoveTags       = "remove-tags"
+	bulkSetTitle         = "set-title-pattern"
+	bulkMoveToAlbum      = "move-to-album"     // an album ID of 0 takes the photo out of its album
+	bulkChangeVisibility = "change-visibility" // shows or hides the photo location
+	bulkDelete           = "delete"            // moves the photo to the trash
+)
+
+var bulkOperations = []string{bulkAddTags, bulkRemoveTags, bulkSetTitle, bulkMoveToAlbum, bulkChangeVisibility, bulkDelete}
+
+// an operation applied to a list of photo IDs, or to the photos matching a search query
+type bulkEdit struct {
+	IDs       []int64  `json:"ids"`
+	Query     string   `json:"query"`
+	Operation string   `json:"operation"`
+	Tags      []string `json:"tags"`
+	Title     string   `json:"title"` // pattern, see expandTitle
+	AlbumID   int64    `json:"albumId"`
+	Visible   bool     `json:"visible"`
+
+	album *album // the album to move to, set on validation
+}
+
+func (edit *bulkEdit) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if (len(edit.IDs) == 0) == (edit.Query == "") {
+		errors["ids"] = "Either photo IDs or a search query is required"
+	}
+	if len(edit.IDs) > maxBulkItems {
+		errors["ids"] = fmt.Sprintf("No more than %d photos can be edited at once", maxBulkItems)
+	}
+
+	switch edit.Operation {
+	case bulkAddTags, bulkRemoveTags:
+		if len(edit.Tags) == 0 {
+			errors["tags"] = "Tags are missing"
+		}
+	case bulkSetTitle:
+		if strings.TrimSpace(edit.Title) == "" {
+			errors["title"] = "Title is missing"
+		}
+	case bulkMoveToAlbum:
+		if edit.AlbumID != 0 {
+			// only the user's own albums
+			album, err := ctx.datamapper.getAlbum(edit.AlbumID)
+			if err != nil && !isErrSqlNoRows(err) {
+				return err
+			}
+			if err != nil || album.OwnerID != ctx.user.ID {
+				errors["albumId"] = "Album not found"
+			}
+			edit.album = album
+		}
+	case bulkChangeVisibility, bulkDelete:
+	default:
+		errors["operation"] = "Operation must be one of " + strings.Join(bulkOperations, ", ")
+	}
+	return nil
+}
+
+// replaces {title} with the current title, {n} with the position of the photo
+// in the edit, starting at 1, and {date} with the date the photo was taken
+func (edit *bulkEdit) expandTitle(photo *photo, n int) string {
+	return strings.TrimSpace(strings.NewReplacer(
+		"{title}", photo.Title,
+		"{n}", strconv.Itoa(n),
+		"{date}", photo.captureDate().Format("2006-01-02"),
+	).Replace(edit.Title))
+}
+
+// returns the photo's tags after adding or removing the edit tags
+func (edit *bulkEdit) editTags(current []string) []string {
+	var (
+		tags  []string
+		names = make(map[string]bool)
+	)
+	for _, name := range edit.Tags {
+		names[cleanTagName(name)] = true
+	}
+	for _, name := range current {
+		if edit.Operation == bulkRemoveTags && names[name] {
+			continue
+		}
+		tags = append(tags, name)
+	}
+	if edit.Operation == bulkAddTags {
+		tags = append(tags, edit.Tags...)
+	}
+	return tags
+}
+
+type bulkSkipped struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type bulkResult struct {
+	Operation string        `json:"operation"`
+	Updated   []int64       `json:"updated"`
+	Skipped   []bulkSkipped `json:"skipped"`
+}
+
+func bulkEditPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	edit := &bulkEdit{}
+
+	if err := decodeJSON(r, edit); err != nil {
+		return err
+	}
+
+	if err := ctx.validate(edit, r); err != nil {
+		return err
+	}
+
+	var (
+		photos []photo
+		err    error
+	)
+
+	if edit.Query != "" {
+		// admins can edit any photos, so search them all
+		var ownerID int64
+		if !ctx.user.IsAdmin {
+			ownerID = ctx.user.ID
+		}
+		// one more than the limit, to tell if the query matches too many
+		photos, err = ctx.datamapper.getPhotosBySearch(edit.Query, ownerID, maxBulkItems+1)
+		if err == nil && len(photos) > maxBulkItems {
+			return validationFailure{map[string]string{
+				"query": fmt.Sprintf("More than %d photos match: narrow down the search", maxBulkItems),
+			}}
+		}
+	} else {
+		photos, err = ctx.datamapper.getPhotosByIDs(edit.IDs)
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		result   = &bulkResult{Operation: edit.Operation, Updated: []int64{}, Skipped: []bulkSkipped{}}
+		selected []*photo
+		found    = make(map[int64]bool)
+	)
+
+	for i := range photos {
+		photo := &photos[i]
+		found[photo.ID] = true
+
+		if !photo.canEdit(ctx.user) {
+			result.Skipped = append(result.Skipped, bulkSkipped{photo.ID, "You're not allowed to edit this photo"})
+			continue
+		}
+
+		switch edit.Operation {
+		case bulkSetTitle:
+			title := edit.expandTitle(photo, len(selected)+1)
+			if title == "" || len(title) > maxTitleLength {
+				result.Skipped = append(result.Skipped, bulkSkipped{photo.ID, "Invalid title"})
+				continue
+			}
+			photo.Title = title
+		case bulkMoveToAlbum:
+			if edit.album == nil {
+				photo.AlbumID = sql.NullInt64{}
+			} else if photo.OwnerID != edit.album.OwnerID {
+				result.Skipped = append(result.Skipped, bulkSkipped{photo.ID, "Photos can only be moved to their owner's albums"})
+				continue
+			} else {
+				photo.AlbumID = sql.NullInt64{Int64: edit.album.ID, Valid: true}
+			}
+		case bulkChangeVisibility:
+			photo.ShowLocation = edit.Visible
+		}
+
+		selected = append(selected, photo)
+	}
+
+	for _, id := range edit.IDs {
+		if !found[id] {
+			result.Skipped = append(result.Skipped, bulkSkipped{id, "Photo not found"})
+		}
+	}
+
+	if len(selected) == 0 {
+		return renderJSON(w, result, http.StatusOK)
+	}
+
+	if err := ctx.datamapper.bulkEditPhotos(selected, edit); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	msgType := "photo_updated"
+	if edit.Operation == bulkDelete {
+		msgType = "photo_deleted"
+	}
+
+	for _, photo := range selected {
+		result.Updated = append(result.Updated, photo.ID)
+		sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, msgType})
+	}
+	return renderJSON(w, result, http.StatusOK)
+}
@@ -0,0 +1,184 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records the photos of each bulk edit; see mockDataMapper.getPhotosByIDs for
+// the photos: IDs under 10 exist, odd IDs are owned by user 1, even by user 0
+type bulkEditStore struct {
+	mockDataMapper
+	edits   [][]*photo
+	matches int // photos owned by user 1 matching any search
+}
+
+func (m *bulkEditStore) bulkEditPhotos(photos []*photo, edit *bulkEdit) error {
+	m.edits = append(m.edits, photos)
+	return nil
+}
+
+func (m *bulkEditStore) getPhotosBySearch(q string, ownerID int64, limit int64) ([]photo, error) {
+	var photos []photo
+	for i := 0; i < m.matches && int64(i) < limit; i++ {
+		photos = append(photos, photo{ID: int64(i + 1), OwnerID: 1})
+	}
+	return photos, nil
+}
+
+func runBulkEdit(t *testing.T, user *user, body string) (*bulkEditStore, *bulkResult, error) {
+	return runBulkEditWith(t, &bulkEditStore{}, user, body)
+}
+
+func runBulkEditWith(t *testing.T, store *bulkEditStore, user *user, body string) (*bulkEditStore, *bulkResult, error) {
+	req, _ := http.NewRequest("POST", "http://localhost/api/photos/bulk", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: store,
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{make(map[string]string)},
+		user:   user,
+	}
+
+	if err := bulkEditPhotos(c, res, req); err != nil {
+		return store, nil, err
+	}
+	result := &bulkResult{}
+	if err := parseJSONBody(res, result); err != nil {
+		t.Fatal(err)
+	}
+	return store, result, nil
+}
+
+func TestBulkEditPhotosPermissions(t *testing.T) {
+	user := &user{ID: 1, IsAuthenticated: true}
+
+	store, result, err := runBulkEdit(t, user,
+		`{"ids": [1, 2, 3, 11], "operation": "set-title-pattern", "title": "Trip {n}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Updated) != 2 || result.Updated[0] != 1 || result.Updated[1] != 3 {
+		t.Error("The user's own photos should be updated:", result.Updated)
+	}
+	if len(result.Skipped) != 2 || result.Skipped[0].ID != 2 || result.Skipped[1].ID != 11 {
+		t.Error("Other users' and missing photos should be skipped:", result.Skipped)
+	}
+
+	// all the photos are edited together, in one transaction
+	if len(store.edits) != 1 || len(store.edits[0]) != 2 {
+		t.Fatal("Photos should be edited at once:", store.edits)
+	}
+	if store.edits[0][0].Title != "Trip 1" || store.edits[0][1].Title != "Trip 2" {
+		t.Error("Titles should be numbered by position:", store.edits[0][0].Title, store.edits[0][1].Title)
+	}
+
+	// admins can edit anyone's photos
+	user.IsAdmin = true
+	_, result, err = runBulkEdit(t, user, `{"ids": [1, 2], "operation": "change-visibility", "visible": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 2 || len(result.Skipped) != 0 {
+		t.Error("Admin should edit all photos:", result)
+	}
+}
+
+func TestBulkEditPhotosNoneAllowed(t *testing.T) {
+	store, result, err := runBulkEdit(t, &user{ID: 1, IsAuthenticated: true},
+		`{"ids": [2, 4], "operation": "delete"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 0 || len(result.Skipped) != 2 {
+		t.Error("Photos should be skipped:", result)
+	}
+	if len(store.edits) != 0 {
+		t.Error("Nothing should be edited")
+	}
+}
+
+func TestBulkEditQueryLimit(t *testing.T) {
+	user := &user{ID: 1, IsAuthenticated: true}
+	body := `{"query": "beach", "operation": "delete"}`
+
+	_, result, err := runBulkEditWith(t, &bulkEditStore{matches: maxBulkItems}, user, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != maxBulkItems {
+		t.Error("All matching photos should be edited:", len(result.Updated))
+	}
+
+	store, _, err := runBulkEditWith(t, &bulkEditStore{matches: maxBulkItems + 1}, user, body)
+	if _, ok := err.(validationFailure); !ok {
+		t.Error("Query matching too many photos should be rejected:", err)
+	}
+	if len(store.edits) != 0 {
+		t.Error("Nothing should be edited")
+	}
+}
+
+func TestBulkMoveToAlbum(t *testing.T) {
+	// an admin can edit all the photos, but only move their own to their album
+	user := &user{ID: 1, IsAuthenticated: true, IsAdmin: true}
+
+	store, result, err := runBulkEdit(t, user, `{"ids": [1, 2], "operation": "move-to-album", "albumId": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 1 || result.Updated[0] != 1 {
+		t.Error("Own photo should be moved:", result.Updated)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].ID != 2 {
+		t.Error("Other user's photo should be skipped:", result.Skipped)
+	}
+	if len(store.edits) != 1 || store.edits[0][0].AlbumID.Int64 != 1 {
+		t.Error("Photo should be in the album")
+	}
+
+	// albums are owned by the user with the same ID
+	if _, _, err := runBulkEdit(t, user, `{"ids": [1], "operation": "move-to-album", "albumId": 2}`); err == nil {
+		t.Error("Photos can't be moved to another user's album")
+	}
+
+	store, _, err = runBulkEdit(t, user, `{"ids": [1], "operation": "move-to-album"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.edits) != 1 || store.edits[0][0].AlbumID.Valid {
+		t.Error("Photo should be taken out of its album")
+	}
+}
+
+func TestBulkEditTitle(t *testing.T) {
+	edit := &bulkEdit{Operation: bulkSetTitle, Title: "{title} #{n} ({date})"}
+	p := &photo{Title: "Beach", TakenAt: sql.NullTime{Time: time.Date(2014, 8, 2, 10, 0, 0, 0, time.UTC), Valid: true}}
+	if title := edit.expandTitle(p, 3); title != "Beach #3 (2014-08-02)" {
+		t.Error("Unexpected title:", title)
+	}
+}
+
+func TestBulkEditTags(t *testing.T) {
+	current := []string{"beach", "summer"}
+
+	add := &bulkEdit{Operation: bulkAddTags, Tags: []string{"holiday"}}
+	if tags := add.editTags(current); len(tags) != 3 || tags[2] != "holiday" {
+		t.Error("Tag should be added:", tags)
+	}
+
+	remove := &bulkEdit{Operation: bulkRemoveTags, Tags: []string{" Summer "}}
+	if tags := remove.editTags(current); len(tags) != 1 || tags[0] != "beach" {
+		t.Error("Tag should be removed:", tags)
+	}
+}
@@ -0,0 +1,132 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// when the photo was taken, falling back to the upload time
+const captureDateSQL = "COALESCE(taken_at, created_at AT TIME ZONE 'UTC')"
+
+// to_char formats for each calendar grouping
+var calendarGroups = map[string]string{
+	"year":  "YYYY",
+	"month": "YYYY-MM",
+	"day":   "YYYY-MM-DD",
+}
+
+type dateCount struct {
+	Date      string `db:"date" json:"date"`
+	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
+}
+
+// limits calendar queries to the photos of one owner, tag and/or album
+type photoScope struct {
+	ownerID int64
+	tag     string
+	albumID int64
+}
+
+func getPhotoScope(r *http.Request) (*photoScope, error) {
+	scope := &photoScope{tag: cleanTagName(r.FormValue("tag"))}
+	if value := r.FormValue("ownerID"); value != "" {
+		ownerID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, httpError{http.StatusBadRequest, "Invalid owner ID"}
+		}
+		scope.ownerID = ownerID
+	}
+	if value := r.FormValue("albumID"); value != "" {
+		albumID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, httpError{http.StatusBadRequest, "Invalid album ID"}
+		}
+		scope.albumID = albumID
+	}
+	return scope, nil
+}
+
+func (s *photoScope) cacheKey() string {
+	return fmt.Sprintf("owner:%d:album:%d:tag:%s", s.ownerID, s.albumID, s.tag)
+}
+
+// returns the conditions for photos in scope, for a query on photos p
+func (s *photoScope) where(b *searchBuilder) []string {
+	var conditions []string
+	if s.ownerID != 0 {
+		conditions = append(conditions, "p.owner_id = "+b.param(s.ownerID))
+	}
+	if s.albumID != 0 {
+		conditions = append(conditions, "p.album_id = "+b.param(s.albumID))
+	}
+	if s.tag != "" {
+		conditions = append(conditions, (&searchTag{s.tag}).toSQL(b))
+	}
+	return conditions
+}
+
+// returns photo counts by year, month or day taken, e.g. for a timeline scrubber
+func getPhotoCalendar(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	group := r.FormValue("group")
+	if group == "" {
+		group = "month"
+	}
+	if _, ok := calendarGroups[group]; !ok {
+		return httpError{http.StatusBadRequest, "group must be year, month or day"}
+	}
+
+	scope, err := getPhotoScope(r)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := fmt.Sprintf("photos:calendar:%s:%s", group, scope.cacheKey())
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		counts, err := ctx.datamapper.getPhotoCalendar(scope, group)
+		if err != nil {
+			return counts, err
+		}
+		return counts, nil
+	})
+}
+
+// returns photos taken between two dates, newest first; from and to may be a year, month or day
+func getPhotosByDate(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	from, _, ok := parseDatePeriod(r.FormValue("from"))
+	if !ok {
+		return httpError{http.StatusBadRequest, "from must be YYYY-MM-DD, YYYY-MM or YYYY"}
+	}
+
+	// the whole of the last period is included; no end date means up to now
+	var to time.Time
+	if value := r.FormValue("to"); value != "" {
+		if _, to, ok = parseDatePeriod(value); !ok {
+			return httpError{http.StatusBadRequest, "to must be YYYY-MM-DD, YYYY-MM or YYYY"}
+		}
+		if !from.Before(to) {
+			return httpError{http.StatusBadRequest, "from must be before to"}
+		}
+	}
+
+	scope, err := getPhotoScope(r)
+	if err != nil {
+		return err
+	}
+
+	page := getPage(r)
+	cacheKey := fmt.Sprintf("photos:dates:%s:%s:%s:%s",
+		from.Format("2006-01-02"), to.Format("2006-01-02"), scope.cacheKey(), page.cacheKey())
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		photos, err := ctx.datamapper.getPhotosByDate(page, scope, from, to)
+		if err != nil {
+			return photos, err
+		}
+		return photos, nil
+	})
+}
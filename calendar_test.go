@@ -0,0 +1,42 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCaptureDate(t *testing.T) {
+	uploaded := time.Date(2014, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	p := &photo{CreatedAt: uploaded}
+	if !p.captureDate().Equal(uploaded) || p.captureDate().Location() != time.UTC {
+		t.Error("Capture date should fall back to the upload time in UTC")
+	}
+	taken := time.Date(2014, 5, 30, 18, 0, 0, 0, time.UTC)
+	p.TakenAt = sql.NullTime{Time: taken, Valid: true}
+	if !p.captureDate().Equal(taken) {
+		t.Error("Capture date should be the time taken")
+	}
+}
+
+func TestPhotoScope(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/photos/calendar?ownerID=1&albumID=2", nil)
+	scope, err := getPhotoScope(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &searchBuilder{}
+	conditions := scope.where(b)
+	if len(conditions) != 2 || conditions[1] != "p.album_id = $2" || b.params[1] != int64(2) {
+		t.Error("Photos should be limited to the album:", conditions)
+	}
+	if scope.cacheKey() != "owner:1:album:2:tag:" {
+		t.Error("Album should be part of the cache key:", scope.cacheKey())
+	}
+
+	r, _ = http.NewRequest("GET", "/api/photos/calendar?albumID=x", nil)
+	if _, err := getPhotoScope(r); err == nil {
+		t.Error("Invalid album ID should be rejected")
+	}
+}
@@ -23,6 +23,8 @@ func Serve() {
 
 	runtime.GOMAXPROCS((runtime.NumCPU() * 2) + 1)
 
+	app.startJobs()
+
 	n := negroni.Classic()
 	n.UseHandler(app.router)
 	n.Run(fmt.Sprintf(":%d", app.cfg.ServerPort))
@@ -42,16 +44,19 @@ func storeFile(app *app,
 		logError(err)
 	}
 	defer file.Close()
-	err = app.filestore.store(file, name, contentType)
-	if err != nil {
-		logError(err)
-	}
 	photo := &photo{
 		Title:    title,
 		Filename: name,
 		Tags:     tags,
 		OwnerID:  userID,
 	}
+	if err := photo.readMetadata(file); err != nil {
+		logError(err)
+	}
+	err = app.filestore.store(file, name, contentType)
+	if err != nil {
+		logError(err)
+	}
 	if err := app.datamapper.createPhoto(photo); err != nil {
 		return err
 	}
@@ -70,7 +75,11 @@ func scanDir(app *app, userID int64, baseDir, dirname string) {
 			scanDir(app, userID, baseDir, filepath.Join(dirname, name))
 		} else {
 			fullPath := filepath.Join(dirname, name)
-			tags := filepath.SplitList(dirname[len(baseDir):])
+			// the directory path below baseDir is a single hierarchical tag, e.g. travel/japan
+			var tags []string
+			if tag := cleanTagName(filepath.ToSlash(dirname[len(baseDir):])); tag != "" {
+				tags = append(tags, tag)
+			}
 			ext := strings.ToLower(filepath.Ext(name))
 			if ext != ".jpg" && ext != ".png" {
 				continue
@@ -91,7 +100,7 @@ func scanDir(app *app, userID int64, baseDir, dirname string) {
 	}
 }
 
-// Import from a given directory. Subdirs will be tags. Title will be filename.
+// Import from a given directory. Subdirs will be hierarchical tags. Title will be filename.
 func Import() {
 
 	email := flag.String("user", "", "User email address")
@@ -0,0 +1,165 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+func getComments(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	comments, err := ctx.datamapper.getComments(getPage(r), photo, ctx.user)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, comments, http.StatusOK)
+}
+
+func addComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.checkVerified(restrictComment); err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !photo.canComment(ctx.user) {
+		return httpError{http.StatusForbidden, "Comments are disabled for this photo"}
+	}
+
+	s := &struct {
+		Body     string `json:"body"`
+		ParentID int64  `json:"parentId"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	comment := &comment{
+		PhotoID: photo.ID,
+		OwnerID: ctx.user.ID,
+		Body:    s.Body,
+	}
+
+	if s.ParentID != 0 {
+		parent, err := ctx.datamapper.getComment(s.ParentID)
+		if err != nil {
+			if isErrSqlNoRows(err) {
+				return httpError{http.StatusBadRequest, "Invalid parent comment"}
+			}
+			return err
+		}
+		if parent.PhotoID != photo.ID {
+			return httpError{http.StatusBadRequest, "Invalid parent comment"}
+		}
+		comment.ParentID = sql.NullInt64{Int64: parent.ID, Valid: true}
+	}
+
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createComment(comment); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "comment_added"})
+
+	detail := &commentDetail{
+		comment:     *comment,
+		OwnerName:   ctx.user.Name,
+		Permissions: newCommentPermissions(comment, photo, ctx.user),
+	}
+	return renderJSON(w, detail, http.StatusCreated)
+}
+
+func editComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !comment.canEdit(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to edit this comment"}
+	}
+
+	s := &struct {
+		Body string `json:"body"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	comment.Body = s.Body
+
+	if err := ctx.validate(comment, r); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.updateComment(comment); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", comment.PhotoID, "comment_updated"})
+	return renderString(w, http.StatusOK, "Comment updated")
+}
+
+func deleteComment(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	comment, err := ctx.datamapper.getComment(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	photo, err := ctx.datamapper.getPhoto(comment.PhotoID)
+	if err != nil {
+		return err
+	}
+
+	if !comment.canDelete(ctx.user, photo) {
+		return httpError{http.StatusForbidden, "You're not allowed to delete this comment"}
+	}
+
+	if err := ctx.datamapper.removeComment(comment); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", comment.PhotoID, "comment_deleted"})
+	return renderString(w, http.StatusOK, "Comment deleted")
+}
+
+// allows the photo owner to switch comments on or off
+func editPhotoComments(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Enabled bool `json:"enabled"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.CommentsEnabled = s.Enabled
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
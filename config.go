@@ -3,8 +3,10 @@ package photoshare
 import (
 	"errors"
 	"github.com/danryan/env"
+	"net"
 	"os"
 	"path"
+	"strings"
 )
 
 type config struct {
@@ -32,6 +34,7 @@ type config struct {
 	UploadsDir    string `env:"key=UPLOADS_DIR"`
 	ThumbnailsDir string `env:"key=THUMBNAILS_DIR"`
 	TemplatesDir  string `env:"key=TEMPLATES_DIR"`
+	ExportsDir    string `env:"key=EXPORTS_DIR"`
 
 	PrivateKey string `env:"key=PRIVATE_KEY required=true"`
 	PublicKey  string `env:"key=PUBLIC_KEY required=true"`
@@ -41,7 +44,28 @@ type config struct {
 	GoogleClientID string `env:"key=GOOGLE_CLIENT_ID"`
 	GoogleSecret   string `env:"key=GOOGLE_SECRET"`
 
+	// a generic OpenID Connect provider, enabled if the issuer is set
+	OIDCIssuer   string `env:"key=OIDC_ISSUER"`
+	OIDCClientID string `env:"key=OIDC_CLIENT_ID"`
+	OIDCSecret   string `env:"key=OIDC_SECRET"`
+	OIDCScopes   string `env:"key=OIDC_SCOPES"`
+
 	ServerPort int `env:"key=PORT default=5000"`
+
+	TrendingInterval int `env:"key=TRENDING_INTERVAL default=10"` // minutes
+	TrashRetention   int `env:"key=TRASH_RETENTION default=30"`   // days
+	SessionExpiry    int `env:"key=SESSION_EXPIRY default=30"`    // days since the session was last refreshed
+	LockoutThreshold int `env:"key=LOCKOUT_THRESHOLD default=10"` // failed logins before an account is locked
+	LockoutDuration  int `env:"key=LOCKOUT_DURATION default=30"`  // minutes
+
+	RecoveryCodeExpiry int `env:"key=RECOVERY_CODE_EXPIRY default=60"` // minutes a password reset link is valid
+
+	// comma-separated actions users can't take until they verify their email address
+	UnverifiedRestrictions string `env:"key=UNVERIFIED_RESTRICTIONS default=upload"`
+
+	// comma-separated addresses or CIDR ranges of the proxies whose
+	// X-Forwarded-For header we believe; by default nobody's
+	TrustedProxies string `env:"key=TRUSTED_PROXIES"`
 }
 
 func newConfig() (*config, error) {
@@ -70,6 +94,10 @@ func newConfig() (*config, error) {
 		return cfg, errors.New("test DB name same as DB name")
 	}
 
+	if cfg.TrendingInterval < 1 {
+		return cfg, errors.New("TRENDING_INTERVAL must be at least 1 minute")
+	}
+
 	if cfg.BaseDir == "" {
 		cfg.BaseDir = getDefaultBaseDir()
 	}
@@ -86,13 +114,51 @@ func newConfig() (*config, error) {
 		cfg.ThumbnailsDir = path.Join(cfg.UploadsDir, "thumbnails")
 	}
 
+	if cfg.OIDCScopes == "" {
+		cfg.OIDCScopes = "openid email profile"
+	}
+
 	if cfg.TemplatesDir == "" {
 		cfg.TemplatesDir = path.Join(cfg.BaseDir, "templates")
 	}
 
+	// outside the public directory, so archives can only be had with their download link
+	if cfg.ExportsDir == "" {
+		cfg.ExportsDir = path.Join(cfg.BaseDir, "exports")
+	}
+
 	return cfg, nil
 }
 
+// returns true if users must verify their email address before the action
+func (cfg *config) restrictsUnverified(action string) bool {
+	for _, value := range strings.Split(cfg.UnverifiedRestrictions, ",") {
+		if strings.TrimSpace(value) == action {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if the address is one of our proxies
+func (cfg *config) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, value := range strings.Split(cfg.TrustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxy := net.ParseIP(value); proxy != nil && proxy.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func getDefaultBaseDir() string {
 	defaultBaseDir, err := os.Getwd()
 	if err != nil {
@@ -6,11 +6,48 @@ import (
 	"github.com/coopernurse/gorp"
 	"github.com/juju/errgo"
 	_ "github.com/lib/pq" // PostgreSQL library
+	"html"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
+// sort keys for each orderBy option, see pagination.go
+var photoOrderings = map[string]photoOrdering{
+	"latest": {sortByCreatedAt, sortByID},
+	"votes": {sortKey{"(up_votes - down_votes)", "bigint", func(p *photo) interface{} {
+		return p.UpVotes - p.DownVotes
+	}}, sortByCreatedAt, sortByID},
+	"hot":           {sortByScore("hot_score", func(p *photo) float64 { return p.HotScore }), sortByCreatedAt, sortByID},
+	"best":          {sortByScore("wilson_score", func(p *photo) float64 { return p.WilsonScore }), sortByCreatedAt, sortByID},
+	"controversial": {sortByScore("controversy_score", func(p *photo) float64 { return p.ControversyScore }), sortByCreatedAt, sortByID},
+	"trending": {sortByScore("trending_score", func(p *photo) float64 { return p.TrendingScore }),
+		sortByScore("hot_score", func(p *photo) float64 { return p.HotScore }), sortByID},
+	"taken": {sortByCaptureDate, sortByID},
+}
+
+// returns the name of the ordering to use, and its sort keys
+func orderPhotosBy(orderBy, defaultOrderBy string) (string, photoOrdering) {
+	if ordering, ok := photoOrderings[orderBy]; ok {
+		return orderBy, ordering
+	}
+	return defaultOrderBy, photoOrderings[defaultOrderBy]
+}
+
+// ts_headline markers, replaced by <mark> tags once the highlight is escaped
+const (
+	highlightStart   = "[[["
+	highlightStop    = "]]]"
+	highlightOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", HighlightAll=TRUE"
+)
+
+func formatHighlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.Replace(s, highlightStart, "<mark>", -1)
+	return strings.Replace(s, highlightStop, "</mark>", -1)
+}
+
 func dbConnect(user, pwd, name, host string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s password=%s host=%s sslmode=disable",
 		user,
@@ -36,8 +73,27 @@ func initDB(db *sql.DB, logSql bool) (*gorp.DbMap, error) {
 	}
 
 	dbMap.AddTableWithName(user{}, "users").SetKeys(true, "ID")
-	dbMap.AddTableWithName(photo{}, "photos").SetKeys(true, "ID")
+	photos := dbMap.AddTableWithName(photo{}, "photos").SetKeys(true, "ID")
+
+	// vote counters and scores are maintained by triggers
+	for _, field := range []string{
+		"UpVotes",
+		"DownVotes",
+		"HotScore",
+		"WilsonScore",
+		"ControversyScore",
+		"TrendingScore",
+	} {
+		photos.ColMap(field).SetTransient(true)
+	}
+
 	dbMap.AddTableWithName(tag{}, "tags").SetKeys(true, "ID")
+	dbMap.AddTableWithName(comment{}, "comments").SetKeys(true, "ID")
+	dbMap.AddTableWithName(userSession{}, "sessions").SetKeys(true, "ID")
+	dbMap.AddTableWithName(apiToken{}, "api_tokens").SetKeys(true, "ID")
+	dbMap.AddTableWithName(userIdentity{}, "user_identities").SetKeys(true, "ID")
+	dbMap.AddTableWithName(dataExport{}, "data_exports").SetKeys(true, "ID")
+	dbMap.AddTableWithName(album{}, "albums").SetKeys(true, "ID")
 
 	return dbMap, nil
 }
@@ -45,27 +101,126 @@ func initDB(db *sql.DB, logSql bool) (*gorp.DbMap, error) {
 type dataMapper interface {
 	createPhoto(*photo) error
 	removePhoto(*photo) error
+	trashPhoto(*photo) error
+	restorePhoto(*photo) error
 	updatePhoto(*photo) error
 	updateTags(*photo) error
 
 	createUser(*user) error
 	updateUser(*user) error
+	deleteUser(int64, bool) ([]string, error)
+
+	createComment(*comment) error
+	updateComment(*comment) error
+	removeComment(*comment) error
+
+	addFavorite(*photo, *user) error
+	removeFavorite(*photo, *user) error
+
+	registerVote(*photo, *user, int64) (bool, error)
+	removeVote(*photo, *user) (bool, error)
+
+	followUser(int64, int64) error
+	unfollowUser(int64, int64) error
+	followTag(int64, string) error
+	unfollowTag(int64, string) error
 
 	updateMany(...interface{}) error
+	bulkEditPhotos([]*photo, *bulkEdit) error
+
+	createAlbum(*album) error
+	removeAlbum(*album) error
+	getAlbum(int64) (*album, error)
+	getAlbums(int64) ([]album, error)
+	getPhotosByAlbum(*page, int64, string) (*photoList, error)
 
 	getPhoto(int64) (*photo, error)
+	getTrashedPhoto(int64) (*photo, error)
+	getPhotosByIDs([]int64) ([]photo, error)
+	getPhotosBySearch(string, int64, int64) ([]photo, error)
+	getTrash(*page, int64) (*trashList, error)
+	getExpiredTrash(time.Time) ([]photo, error)
 	getPhotoDetail(int64, *user) (*photoDetail, error)
 	getTagCounts() ([]tagCount, error)
+	getPhotoMap(*boundingBox, float64) ([]mapCluster, error)
+	getPhotoCalendar(*photoScope, string) ([]dateCount, error)
+	getPhotosByDate(*page, *photoScope, time.Time, time.Time) (*photoList, error)
+	getTagsByPrefix(string, int64) ([]tagSuggestion, error)
+	getTag(string) (*tag, error)
+	getTagTree() ([]*tagNode, error)
+	renameTag(*tag, string) error
+	mergeTags(*tag, *tag) error
+	getTagSynonyms() ([]tagSynonym, error)
+	addTagSynonym(*tag, string) error
+	removeTagSynonym(string) (bool, error)
+	getBlockedTags() ([]blockedTag, error)
+	blockTag(string) error
+	unblockTag(string) (bool, error)
+	getRelatedTags([]string, int64) ([]tagSuggestion, error)
 	getPhotos(*page, string) (*photoList, error)
-	getPhotosByOwnerID(*page, int64) (*photoList, error)
-	searchPhotos(*page, string) (*photoList, error)
+	getPhotosByOwnerID(*page, int64, string) (*photoList, error)
+	getFavorites(*page, int64) (*photoList, error)
+	getTimeline(*page, int64) (*photoList, error)
+	getFollowers(*page, int64) (*userList, error)
+	getFollowing(*page, int64) (*userList, error)
+	searchPhotos(*page, string, string) (*searchResultList, error)
+
+	refreshTrendingScores() error
+
+	getComment(int64) (*comment, error)
+	getComments(*page, *photo, *user) (*commentList, error)
 
 	isUserNameAvailable(*user) (bool, error)
 	isUserEmailAvailable(*user) (bool, error)
 	getActiveUser(userID int64) (*user, error)
 	getUserByRecoveryCode(string) (*user, error)
+	getUserByVerifyToken(string) (*user, error)
+	getUserByEmailChangeToken(string) (*user, error)
 	getUserByEmail(string) (*user, error)
 	getUserByNameOrEmail(identifier string) (*user, error)
+	getUserByIdentity(string, string) (*user, error)
+
+	createUserWithIdentity(*user, *userIdentity) error
+	addIdentity(*userIdentity) error
+	getIdentities(int64) ([]userIdentity, error)
+	removeIdentity(int64, int64) (bool, error)
+
+	setBackupCodes(int64, []string) error
+	useBackupCode(int64, string) (bool, error)
+	useTOTPStep(int64, int64) (bool, error)
+	getBackupCodeCount(int64) (int64, error)
+	resetTwoFactor(int64) error
+
+	getThrottle(string) (*throttle, error)
+	addThrottleFailure(string, time.Time, time.Time) (int64, error)
+	blockThrottle(string, time.Time) error
+	clearThrottle(string) error
+	removeExpiredThrottles(time.Time) error
+
+	createSession(*userSession) error
+	rotateSession(*userSession) (bool, error)
+	getSessionByToken(string) (*userSession, error)
+	getSessions(int64) ([]userSession, error)
+	isSessionActive(int64, int64) (bool, error)
+	revokeSession(int64, int64) (bool, error)
+	revokeSessions(int64) error
+	removeExpiredSessions(time.Time) error
+
+	createAPIToken(*apiToken) error
+	getAPIToken(string) (*apiToken, error)
+	getAPITokens(int64) ([]apiToken, error)
+	touchAPIToken(int64) error
+	removeAPIToken(int64, int64) (bool, error)
+	removeAPITokens(int64) (int64, error)
+
+	createExport(*dataExport) error
+	updateExport(*dataExport) error
+	removeExport(*dataExport) error
+	getExports(int64) ([]dataExport, error)
+	getPendingExports() ([]dataExport, error)
+	getExpiredExports(time.Time) ([]dataExport, error)
+	getExportByToken(string) (*dataExport, error)
+	getUserData(int64) (*userData, error)
 }
 
 type defaultDataMapper struct {
@@ -78,31 +233,200 @@ type transaction struct {
 
 func (t *transaction) updateTags(photo *photo) error {
 
+	names, err := t.normalizeTags(photo.Tags)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		if photo.ID != 0 {
+			_, err := t.Exec("DELETE FROM photo_tags WHERE photo_id=$1", photo.ID)
+			return errgo.Mask(err)
+		}
+		return nil
+	}
+
+	var (
+		args   = []string{"$1"}
+		params = []interface{}{interface{}(photo.ID)}
+	)
+	for i, name := range names {
+		args = append(args, fmt.Sprintf("$%d", i+2))
+		params = append(params, interface{}(name))
+	}
+
+	if _, err := t.Exec(fmt.Sprintf("SELECT add_tags(%s)", strings.Join(args, ",")), params...); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+
+}
+
+// lower-cases tag names, replaces synonyms with their tag and rejects blocked tags
+func (t *transaction) normalizeTags(tags []string) ([]string, error) {
+
 	var (
-		args    = []string{"$1"}
-		params  = []interface{}{interface{}(photo.ID)}
-		isEmpty = true
-		counter = 1
+		names   []string
+		blocked []blockedTag
 	)
-	for _, name := range photo.Tags {
-		name = strings.TrimSpace(name)
+
+	for _, name := range tags {
+		name = cleanTagName(name)
 		if name != "" {
-			counter++
-			args = append(args, fmt.Sprintf("$%d", counter))
-			params = append(params, interface{}(strings.ToLower(name)))
-			isEmpty = false
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return names, nil
+	}
+
+	if _, err := t.Select(&blocked,
+		"SELECT * FROM tag_blocklist WHERE name = ANY($1::text[])",
+		stringSliceToPgArr(names)); err != nil {
+		return names, errgo.Mask(err)
+	}
+
+	if len(blocked) > 0 {
+		return names, validationFailure{map[string]string{
+			"tags": fmt.Sprintf("The tag %s is not allowed", blocked[0].Name),
+		}}
+	}
+	return t.resolveSynonyms(names)
+}
+
+// replaces synonyms among the clean tag names with their tag, dropping duplicates
+func (t *transaction) resolveSynonyms(names []string) ([]string, error) {
+
+	var synonyms []tagSynonym
+
+	if _, err := t.Select(&synonyms,
+		"SELECT s.name, t.name AS tag FROM tag_synonyms s "+
+			"JOIN tags t ON t.id = s.tag_id WHERE s.name = ANY($1::text[])",
+		stringSliceToPgArr(names)); err != nil {
+		return names, errgo.Mask(err)
+	}
+
+	replacements := make(map[string]string)
+	for _, synonym := range synonyms {
+		replacements[synonym.Name] = synonym.Tag
+	}
+
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+
+	for _, name := range names {
+		if tag, ok := replacements[name]; ok {
+			name = tag
+		}
+		if !seen[name] {
+			result = append(result, name)
+			seen[name] = true
+		}
+	}
+	return result, nil
+}
+
+// moves all uses of the source tag to the target tag, then removes the source tag
+// rejects a rename if the new names of the tag, its descendants or its new
+// ancestors are blocked, or are synonyms, which would hide the renamed tags
+func (t *transaction) checkRenamedTagNames(from, to string) error {
+
+	var (
+		descendants []tag
+		blocked     []blockedTag
+		synonyms    []tagSynonym
+	)
+
+	if _, err := t.Select(&descendants, "SELECT * FROM tags WHERE starts_with(name, $1 || '/')", from); err != nil {
+		return errgo.Mask(err)
+	}
+
+	names := []string{to}
+	for _, descendant := range descendants {
+		names = append(names, to+descendant.Name[len(from):])
+	}
+	for parent := parentTagName(to); parent != ""; parent = parentTagName(parent) {
+		names = append(names, parent)
+	}
+
+	if _, err := t.Select(&blocked,
+		"SELECT * FROM tag_blocklist WHERE name = ANY($1::text[]) ORDER BY name",
+		stringSliceToPgArr(names)); err != nil {
+		return errgo.Mask(err)
+	}
+	if len(blocked) > 0 {
+		return validationFailure{map[string]string{
+			"name": fmt.Sprintf("The tag %s is not allowed", blocked[0].Name),
+		}}
+	}
+
+	if _, err := t.Select(&synonyms,
+		"SELECT s.name, t.name AS tag FROM tag_synonyms s "+
+			"JOIN tags t ON t.id = s.tag_id WHERE s.name = ANY($1::text[]) ORDER BY s.name",
+		stringSliceToPgArr(names)); err != nil {
+		return errgo.Mask(err)
+	}
+	if len(synonyms) > 0 {
+		return validationFailure{map[string]string{
+			"name": fmt.Sprintf("%s is a synonym of %s", synonyms[0].Name, synonyms[0].Tag),
+		}}
+	}
+	return nil
+}
+
+func (t *transaction) mergeTags(source, target *tag) error {
+
+	var queries = []string{
+		"INSERT INTO photo_tags(photo_id, tag_id) SELECT photo_id, $2 FROM photo_tags " +
+			"WHERE tag_id=$1 AND photo_id NOT IN (SELECT photo_id FROM photo_tags WHERE tag_id=$2)",
+		"INSERT INTO tag_follows(user_id, tag_id) SELECT user_id, $2 FROM tag_follows " +
+			"WHERE tag_id=$1 AND user_id NOT IN (SELECT user_id FROM tag_follows WHERE tag_id=$2)",
+		"UPDATE tag_synonyms SET tag_id=$2 WHERE tag_id=$1",
+	}
+
+	for _, q := range queries {
+		if _, err := t.Exec(q, source.ID, target.ID); err != nil {
+			return errgo.Mask(err)
 		}
 	}
+	return t.removeTag(source.ID)
+}
 
-	if isEmpty && photo.ID != 0 {
-		_, err := t.Exec("DELETE FROM photo_tags WHERE photo_id=$1", photo.ID)
+func (t *transaction) removeTag(tagID int64) error {
+	// photo_tags has no foreign key on tag_id
+	if _, err := t.Exec("DELETE FROM photo_tags WHERE tag_id=$1", tagID); err != nil {
 		return errgo.Mask(err)
 	}
-	if _, err := t.Exec(fmt.Sprintf("SELECT add_tags(%s)", strings.Join(args, ",")), params...); err != nil {
+	if _, err := t.Exec("DELETE FROM tags WHERE id=$1", tagID); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
+}
 
+// applies one photo's share of a bulk edit; titles and visibility are already set on the photo
+func (t *transaction) bulkEditPhoto(photo *photo, edit *bulkEdit) error {
+	switch edit.Operation {
+	case bulkAddTags, bulkRemoveTags:
+		var tags []tag
+		if _, err := t.Select(&tags,
+			"SELECT t.* FROM tags t JOIN photo_tags pt ON pt.tag_id=t.id "+
+				"WHERE pt.photo_id=$1", photo.ID); err != nil {
+			return errgo.Mask(err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		photo.Tags = edit.editTags(names)
+		return t.updateTags(photo)
+	case bulkDelete:
+		photo.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	_, err := t.Update(photo)
+	return errgo.Mask(err)
 }
 
 func newDataMapper(db *sql.DB, logSql bool) (dataMapper, error) {
@@ -131,7 +455,7 @@ func (d *defaultDataMapper) createPhoto(photo *photo) error {
 	}
 	if err := t.updateTags(photo); err != nil {
 		t.Rollback()
-		return errgo.Mask(err)
+		return err
 	}
 	return errgo.Mask(t.Commit())
 }
@@ -154,6 +478,63 @@ func (d *defaultDataMapper) updateUser(user *user) error {
 	return nil
 }
 
+// removes everything personal about the user and deactivates them; the row is
+// kept for their comments, and photos unless removePhotos is set. Returns the
+// filenames of removed photos, to be cleaned up after the commit.
+func (d *defaultDataMapper) deleteUser(userID int64, removePhotos bool) ([]string, error) {
+
+	var filenames []string
+
+	t, err := d.begin()
+	if err != nil {
+		return filenames, errgo.Mask(err)
+	}
+
+	if removePhotos {
+		var photos []photo
+		if _, err := t.Select(&photos, "SELECT * FROM photos WHERE owner_id=$1", userID); err != nil {
+			t.Rollback()
+			return filenames, errgo.Mask(err)
+		}
+		for _, photo := range photos {
+			filenames = append(filenames, photo.Filename)
+		}
+		if _, err := t.Exec("DELETE FROM photos WHERE owner_id=$1", userID); err != nil {
+			t.Rollback()
+			return filenames, errgo.Mask(err)
+		}
+	}
+
+	var queries = []string{
+		"DELETE FROM votes WHERE user_id=$1",
+		"DELETE FROM favorites WHERE user_id=$1",
+		"DELETE FROM follows WHERE follower_id=$1 OR followee_id=$1",
+		"DELETE FROM tag_follows WHERE user_id=$1",
+		"DELETE FROM sessions WHERE user_id=$1",
+		"DELETE FROM api_tokens WHERE user_id=$1",
+		"DELETE FROM user_identities WHERE user_id=$1",
+		"DELETE FROM backup_codes WHERE user_id=$1",
+		"DELETE FROM data_exports WHERE user_id=$1",
+		"DELETE FROM albums WHERE owner_id=$1",
+	}
+	for _, q := range queries {
+		if _, err := t.Exec(q, userID); err != nil {
+			t.Rollback()
+			return filenames, errgo.Mask(err)
+		}
+	}
+
+	if _, err := t.Exec("UPDATE users SET name=$2, email='', password='', admin=false, active=false, "+
+		"recovery_code=NULL, recovery_code_created_at=NULL, totp_secret=NULL, totp_enabled=false, "+
+		"email_verified=false, verification_token=NULL, verification_sent_at=NULL, pending_email=NULL, email_change_token=NULL, "+
+		"display_name='', bio='', website='', avatar='' WHERE id=$1",
+		userID, deletedUserName(userID)); err != nil {
+		t.Rollback()
+		return filenames, errgo.Mask(err)
+	}
+	return filenames, errgo.Mask(t.Commit())
+}
+
 func (d *defaultDataMapper) removePhoto(photo *photo) error {
 	if _, err := d.Delete(photo); err != nil {
 		return errgo.Mask(err)
@@ -173,6 +554,72 @@ func (d *defaultDataMapper) updateTags(photo *photo) error {
 	return errgo.Mask(tx.Commit())
 }
 
+// applies the edit to all the photos in one transaction
+func (d *defaultDataMapper) bulkEditPhotos(photos []*photo, edit *bulkEdit) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if edit.Operation == bulkRemoveTags {
+		// photos are tagged with the tag a synonym stands for, so remove both
+		var names []string
+		for _, name := range edit.Tags {
+			names = append(names, cleanTagName(name))
+		}
+		resolved, err := t.resolveSynonyms(names)
+		if err != nil {
+			t.Rollback()
+			return err
+		}
+		edit.Tags = append(names, resolved...)
+	}
+	for _, photo := range photos {
+		if err := t.bulkEditPhoto(photo, edit); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) createAlbum(album *album) error {
+	return errgo.Mask(d.Insert(album))
+}
+
+// removes the album, leaving its photos out of any album
+func (d *defaultDataMapper) removeAlbum(album *album) error {
+	_, err := d.Delete(album)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getAlbum(albumID int64) (*album, error) {
+	a := &album{}
+	if albumID == 0 {
+		return a, sql.ErrNoRows
+	}
+	obj, err := d.Get(a, albumID)
+	if err != nil {
+		return a, errgo.Mask(err)
+	}
+	if obj == nil {
+		return a, sql.ErrNoRows
+	}
+	return obj.(*album), nil
+}
+
+func (d *defaultDataMapper) getAlbums(ownerID int64) ([]album, error) {
+	albums := []album{}
+	if _, err := d.Select(&albums, "SELECT * FROM albums WHERE owner_id=$1 ORDER BY name, id",
+		ownerID); err != nil {
+		return albums, errgo.Mask(err)
+	}
+	return albums, nil
+}
+
+func (d *defaultDataMapper) getPhotosByAlbum(page *page, albumID int64, orderBy string) (*photoList, error) {
+	return d.getPhotoList(page, orderBy, "taken", "p.album_id = $1", albumID)
+}
+
 func (d *defaultDataMapper) updateMany(items ...interface{}) error {
 	tx, err := d.begin()
 	if err != nil {
@@ -199,12 +646,70 @@ func (d *defaultDataMapper) getPhoto(photoID int64) (*photo, error) {
 	if err != nil {
 		return p, errgo.Mask(err)
 	}
-	if obj == nil {
+	if obj == nil || obj.(*photo).DeletedAt.Valid {
 		return p, sql.ErrNoRows
 	}
 	return obj.(*photo), nil
 }
 
+// returns the photo only if it is in the trash
+func (d *defaultDataMapper) getTrashedPhoto(photoID int64) (*photo, error) {
+	p := &photo{}
+	if err := d.SelectOne(p, "SELECT * FROM photos WHERE id=$1 AND deleted_at IS NOT NULL", photoID); err != nil {
+		return p, errgo.Mask(err, isErrSqlNoRows)
+	}
+	return p, nil
+}
+
+func (d *defaultDataMapper) trashPhoto(photo *photo) error {
+	photo.DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	_, err := d.Exec("UPDATE photos SET deleted_at=$2 WHERE id=$1", photo.ID, photo.DeletedAt.Time)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) restorePhoto(photo *photo) error {
+	photo.DeletedAt = sql.NullTime{}
+	_, err := d.Exec("UPDATE photos SET deleted_at=NULL WHERE id=$1", photo.ID)
+	return errgo.Mask(err)
+}
+
+// returns the owner's trash, most recently deleted first
+func (d *defaultDataMapper) getTrash(page *page, ownerID int64) (*trashList, error) {
+	var (
+		photos []photo
+		err    error
+		total  int64
+	)
+
+	if err := page.offsetOnly(); err != nil {
+		return nil, err
+	}
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(id) FROM photos "+
+			"WHERE owner_id=$1 AND deleted_at IS NOT NULL", ownerID); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT * FROM photos WHERE owner_id=$1 AND deleted_at IS NOT NULL "+
+			"ORDER BY deleted_at DESC, id DESC LIMIT $2 OFFSET $3",
+		ownerID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return newTrashList(photos, total, page), nil
+}
+
+// returns photos in the trash since before the given time
+func (d *defaultDataMapper) getExpiredTrash(deletedBefore time.Time) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos,
+		"SELECT * FROM photos WHERE deleted_at < $1", deletedBefore); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
 func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
 
 	photo := &photoDetail{}
@@ -213,11 +718,14 @@ func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDet
 		return photo, sql.ErrNoRows
 	}
 
-	q := "SELECT p.*, u.name AS owner_name " +
+	q := "SELECT p.*, u.name AS owner_name, " +
+		"(SELECT COUNT(*) FROM favorites f WHERE f.photo_id = p.id) AS num_favorites, " +
+		"EXISTS(SELECT 1 FROM favorites f WHERE f.photo_id = p.id AND f.user_id = $2) AS is_favorite, " +
+		"COALESCE((SELECT v.direction FROM votes v WHERE v.photo_id = p.id AND v.user_id = $2), 0) AS vote " +
 		"FROM photos p JOIN users u ON u.id = p.owner_id " +
-		"WHERE p.id=$1"
+		"WHERE p.id=$1 AND p.deleted_at IS NULL"
 
-	if err := d.SelectOne(photo, q, photoID); err != nil {
+	if err := d.SelectOne(photo, q, photoID, user.ID); err != nil {
 		return photo, errgo.Mask(err)
 	}
 
@@ -232,142 +740,786 @@ func (d *defaultDataMapper) getPhotoDetail(photoID int64, user *user) (*photoDet
 		photo.Tags = append(photo.Tags, tag.Name)
 	}
 
+	photo.CaptureDate = photo.captureDate()
+	photo.Location = photo.location(user)
+
 	photo.Permissions = &permissions{
 		photo.canEdit(user),
 		photo.canDelete(user),
 		photo.canVote(user),
+		photo.canComment(user),
+		photo.canFavorite(user),
+	}
+
+	comments, err := d.getComments(newPage(1), &photo.photo, user)
+	if err != nil {
+		return photo, err
 	}
+	photo.Comments = comments
+
 	return photo, nil
 
 }
 
-func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
+func (d *defaultDataMapper) addFavorite(photo *photo, user *user) error {
+	_, err := d.Exec("INSERT INTO favorites(user_id, photo_id) "+
+		"SELECT $1, $2 WHERE NOT EXISTS "+
+		"(SELECT 1 FROM favorites WHERE user_id=$1 AND photo_id=$2)", user.ID, photo.ID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) removeFavorite(photo *photo, user *user) error {
+	_, err := d.Exec("DELETE FROM favorites WHERE user_id=$1 AND photo_id=$2", user.ID, photo.ID)
+	return errgo.Mask(err)
+}
+
+// returns photos favorited by the user, most recently added first
+func (d *defaultDataMapper) getFavorites(page *page, userID int64) (*photoList, error) {
 	var (
 		photos []photo
 		err    error
 		total  int64
 	)
 
-	if ownerID == 0 {
+	if userID == 0 {
 		return nil, sql.ErrNoRows
 	}
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos WHERE owner_id=$1", ownerID); err != nil {
-		return nil, errgo.Mask(err)
+	if err := page.offsetOnly(); err != nil {
+		return nil, err
+	}
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(p.id) FROM photos p JOIN favorites f ON f.photo_id = p.id "+
+			"WHERE f.user_id=$1 AND p.deleted_at IS NULL", userID); err != nil {
+			return nil, errgo.Mask(err)
+		}
 	}
 
 	if _, err = d.Select(&photos,
-		"SELECT * FROM photos WHERE owner_id = $1"+
-			"ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $2 OFFSET $3",
-		ownerID, page.size, page.offset); err != nil {
+		"SELECT p.* FROM photos p JOIN favorites f ON f.photo_id = p.id "+
+			"WHERE f.user_id = $1 AND p.deleted_at IS NULL "+
+			"ORDER BY f.created_at DESC LIMIT $2 OFFSET $3",
+		userID, page.size, page.offset); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return newPhotoList(photos, total, page.index), nil
+	return newPhotoList(photos, total, page), nil
+}
+
+// records or switches the vote; returns false if the user has already voted this way
+func (d *defaultDataMapper) registerVote(photo *photo, user *user, direction int64) (bool, error) {
+	result, err := d.Exec("INSERT INTO votes(user_id, photo_id, direction) "+
+		"VALUES($1, $2, $3) ON CONFLICT (user_id, photo_id) "+
+		"DO UPDATE SET direction = EXCLUDED.direction, created_at = now() "+
+		"WHERE votes.direction <> EXCLUDED.direction", user.ID, photo.ID, direction)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
+}
+
+// retracts the vote; returns false if the user has not voted on the photo
+func (d *defaultDataMapper) removeVote(photo *photo, user *user) (bool, error) {
+	result, err := d.Exec("DELETE FROM votes WHERE user_id=$1 AND photo_id=$2", user.ID, photo.ID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
+}
+
+func rowsAffected(result sql.Result) (bool, error) {
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
 
+func (d *defaultDataMapper) followUser(followerID, followeeID int64) error {
+	_, err := d.Exec("INSERT INTO follows(follower_id, followee_id) "+
+		"SELECT $1, $2 WHERE NOT EXISTS "+
+		"(SELECT 1 FROM follows WHERE follower_id=$1 AND followee_id=$2)", followerID, followeeID)
+	return errgo.Mask(err)
 }
 
-func (d *defaultDataMapper) searchPhotos(page *page, q string) (*photoList, error) {
+func (d *defaultDataMapper) unfollowUser(followerID, followeeID int64) error {
+	_, err := d.Exec("DELETE FROM follows WHERE follower_id=$1 AND followee_id=$2", followerID, followeeID)
+	return errgo.Mask(err)
+}
 
-	var (
-		clauses []string
-		params  []interface{}
-		err     error
-		photos  []photo
-		total   int64
-	)
+func (d *defaultDataMapper) followTag(userID int64, name string) error {
+	tagID, err := d.SelectInt("SELECT add_tag($1)", cleanTagName(name))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = d.Exec("INSERT INTO tag_follows(user_id, tag_id) "+
+		"SELECT $1, $2 WHERE NOT EXISTS "+
+		"(SELECT 1 FROM tag_follows WHERE user_id=$1 AND tag_id=$2)", userID, tagID)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) unfollowTag(userID int64, name string) error {
+	_, err := d.Exec("DELETE FROM tag_follows WHERE user_id=$1 AND tag_id IN "+
+		"(SELECT id FROM tags WHERE name=$2)", userID, cleanTagName(name))
+	return errgo.Mask(err)
+}
 
-	if q == "" {
-		return nil, nil
+// returns photos from followed users and followed tags, newest first
+func (d *defaultDataMapper) getTimeline(page *page, userID int64) (*photoList, error) {
+	if userID == 0 {
+		return nil, sql.ErrNoRows
 	}
+	return d.getPhotoList(page, "", "latest", "(p.owner_id IN "+
+		"(SELECT followee_id FROM follows WHERE follower_id=$1) "+
+		"OR p.id IN (SELECT pt.photo_id FROM photo_tags pt "+
+		"JOIN tags t ON t.id = pt.tag_id "+
+		"JOIN tags ft ON ft.id = t.id OR starts_with(t.name, ft.name || '/') "+
+		"JOIN tag_follows tf ON tf.tag_id = ft.id WHERE tf.user_id=$1))", userID)
+}
 
-	for num, word := range strings.Split(q, " ") {
-		word = strings.TrimSpace(word)
-		if word == "" || num > 6 {
-			break
-		}
+func (d *defaultDataMapper) getFollowers(page *page, userID int64) (*userList, error) {
+	return d.getFollowList(page, userID, "followee_id", "follower_id")
+}
 
-		num++
+func (d *defaultDataMapper) getFollowing(page *page, userID int64) (*userList, error) {
+	return d.getFollowList(page, userID, "follower_id", "followee_id")
+}
+
+func (d *defaultDataMapper) getFollowList(page *page, userID int64, matchCol, userCol string) (*userList, error) {
+	var (
+		users []userSummary
+		err   error
+		total int64
+	)
 
-		if strings.HasPrefix(word, "@") {
-			word = word[1:]
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT p.* FROM photos p "+
-					"INNER JOIN users u ON u.id = p.owner_id  "+
-					"WHERE UPPER(u.name::text) = UPPER($%d)", num))
-		} else if strings.HasPrefix(word, "#") {
-			word = word[1:]
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT p.* FROM photos p "+
-					"INNER JOIN photo_tags pt ON pt.photo_id = p.id "+
-					"INNER JOIN tags t ON pt.tag_id=t.id "+
-					"WHERE UPPER(t.name::text) = UPPER($%d)", num))
-		} else {
-			word = "%" + word + "%"
-			clauses = append(clauses, fmt.Sprintf(
-				"SELECT DISTINCT p.* FROM photos p "+
-					"INNER JOIN users u ON u.id = p.owner_id  "+
-					"LEFT JOIN photo_tags pt ON pt.photo_id = p.id "+
-					"LEFT JOIN tags t ON pt.tag_id=t.id "+
-					"WHERE UPPER(p.title::text) LIKE UPPER($%d) OR "+
-					"UPPER(u.name::text) LIKE UPPER($%d) OR t.name LIKE $%d",
-				num, num, num))
+	if err := page.offsetOnly(); err != nil {
+		return nil, err
+	}
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(*) FROM follows f "+
+			"JOIN users u ON u.id = f."+userCol+" "+
+			"WHERE u.active=true AND f."+matchCol+"=$1", userID); err != nil {
+			return nil, errgo.Mask(err)
 		}
+	}
 
-		params = append(params, interface{}(word))
+	if _, err = d.Select(&users,
+		"SELECT u.id, u.name FROM follows f "+
+			"JOIN users u ON u.id = f."+userCol+" "+
+			"WHERE u.active=true AND f."+matchCol+"=$1 "+
+			"ORDER BY f.created_at DESC LIMIT $2 OFFSET $3",
+		userID, page.size, page.offset); err != nil {
+		return nil, errgo.Mask(err)
 	}
+	return newUserList(users, total, page), nil
+}
 
-	clausesSql := strings.Join(clauses, " INTERSECT ")
+func (d *defaultDataMapper) createComment(comment *comment) error {
+	return errgo.Mask(d.Insert(comment))
+}
 
-	countSql := fmt.Sprintf("SELECT COUNT(id) FROM (%s) q", clausesSql)
+func (d *defaultDataMapper) updateComment(comment *comment) error {
+	if _, err := d.Update(comment); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
 
-	if total, err = d.SelectInt(countSql, params...); err != nil {
-		return nil, errgo.Mask(err)
+func (d *defaultDataMapper) removeComment(comment *comment) error {
+	if _, err := d.Delete(comment); err != nil {
+		return errgo.Mask(err)
 	}
+	return nil
+}
 
-	numParams := len(params)
+func (d *defaultDataMapper) getComment(commentID int64) (*comment, error) {
 
-	sql := fmt.Sprintf("SELECT * FROM (%s) q ORDER BY (up_votes - down_votes) DESC, created_at DESC LIMIT $%d OFFSET $%d",
-		clausesSql, numParams+1, numParams+2)
+	c := &comment{}
 
-	params = append(params, interface{}(page.size))
-	params = append(params, interface{}(page.offset))
+	if commentID == 0 {
+		return c, sql.ErrNoRows
+	}
 
-	if _, err = d.Select(&photos, sql, params...); err != nil {
-		return nil, errgo.Mask(err)
+	obj, err := d.Get(c, commentID)
+	if err != nil {
+		return c, errgo.Mask(err)
+	}
+	if obj == nil {
+		return c, sql.ErrNoRows
 	}
-	return newPhotoList(photos, total, page.index), nil
+	return obj.(*comment), nil
 }
 
-func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, error) {
+// returns a page of top-level comments for the photo, each with its full thread of replies
+func (d *defaultDataMapper) getComments(page *page, photo *photo, user *user) (*commentList, error) {
 
 	var (
-		total  int64
-		photos []photo
-		err    error
+		comments []commentDetail
+		replies  []commentDetail
+		total    int64
+		err      error
 	)
-	if orderBy == "votes" {
-		orderBy = "(up_votes - down_votes)"
-	} else {
-		orderBy = "created_at"
-	}
 
-	if total, err = d.SelectInt("SELECT COUNT(id) FROM photos"); err != nil {
-		return nil, errgo.Mask(err)
+	if err := page.offsetOnly(); err != nil {
+		return nil, err
+	}
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(id) FROM comments "+
+			"WHERE photo_id=$1 AND parent_id IS NULL", photo.ID); err != nil {
+			return nil, errgo.Mask(err)
+		}
 	}
 
-	if _, err = d.Select(&photos,
-		"SELECT * FROM photos "+
-			"ORDER BY "+orderBy+" DESC LIMIT $1 OFFSET $2", page.size, page.offset); err != nil {
+	if _, err = d.Select(&comments,
+		"SELECT c.*, u.name AS owner_name "+
+			"FROM comments c JOIN users u ON u.id = c.owner_id "+
+			"WHERE c.photo_id=$1 AND c.parent_id IS NULL "+
+			"ORDER BY c.created_at LIMIT $2 OFFSET $3",
+		photo.ID, page.size, page.offset); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return newPhotoList(photos, total, page.index), nil
-}
 
-func (d *defaultDataMapper) getTagCounts() ([]tagCount, error) {
-	var tags []tagCount
-	if _, err := d.Select(&tags, "SELECT name, photo, num_photos FROM tag_counts"); err != nil {
-		return tags, errgo.Mask(err)
+	if len(comments) == 0 {
+		return newCommentList(comments, total, page), nil
 	}
-	return tags, nil
+
+	var (
+		threads = make(map[int64]*commentDetail)
+		rootIDs []int64
+	)
+
+	for i := range comments {
+		c := &comments[i]
+		c.Permissions = newCommentPermissions(&c.comment, photo, user)
+		threads[c.ID] = c
+		rootIDs = append(rootIDs, c.ID)
+	}
+
+	if _, err = d.Select(&replies,
+		"WITH RECURSIVE thread AS ("+
+			"SELECT * FROM comments WHERE parent_id = ANY($1::int[]) "+
+			"UNION ALL "+
+			"SELECT c.* FROM comments c JOIN thread t ON c.parent_id = t.id) "+
+			"SELECT t.*, u.name AS owner_name FROM thread t "+
+			"JOIN users u ON u.id = t.owner_id ORDER BY t.created_at",
+		intSliceToPgArr(rootIDs)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	// replies are ordered by creation, so a parent is always seen before its children
+	for i := range replies {
+		c := &replies[i]
+		c.Permissions = newCommentPermissions(&c.comment, photo, user)
+		threads[c.ID] = c
+		if parent, ok := threads[c.ParentID.Int64]; ok {
+			parent.Replies = append(parent.Replies, c)
+		}
+	}
+
+	return newCommentList(comments, total, page), nil
+}
+
+func (d *defaultDataMapper) getPhotosByOwnerID(page *page, ownerID int64, orderBy string) (*photoList, error) {
+	if ownerID == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return d.getPhotoList(page, orderBy, "votes", "p.owner_id = $1", ownerID)
+}
+
+// full text search over photo titles, tags and owner names, see search.go for the query syntax
+func (d *defaultDataMapper) searchPhotos(page *page, q string, orderBy string) (*searchResultList, error) {
+
+	var (
+		results   []searchResult
+		total     int64
+		err       error
+		rank      = "0"
+		highlight = "p.title"
+	)
+
+	query, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.root == nil {
+		return newSearchResultList(results, 0, page), nil
+	}
+
+	b := &searchBuilder{}
+	from, where := query.toSQL(b)
+
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(p.id) FROM "+from+where, b.params...); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	if len(query.keywords) > 0 {
+		var tsqueries []string
+		for _, keyword := range query.keywords {
+			tsqueries = append(tsqueries, keyword.tsquery(b.param(keyword.text)))
+		}
+		tsquery := strings.Join(tsqueries, " || ")
+		rank = "ts_rank_cd(ps.document, " + tsquery + ")"
+		highlight = "ts_headline('english', p.title || ' ' || COALESCE(" +
+			"(SELECT string_agg(replace(t.name, '/', ' '), ' ') FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id " +
+			"WHERE pt.photo_id = p.id), ''), " + tsquery + ", '" + highlightOptions + "')"
+	}
+
+	if query.sort != "" {
+		orderBy = query.sort
+	}
+
+	// rank is cast so that cursor values compare exactly
+	rank = "(" + rank + ")::float8"
+
+	var ordering photoOrdering
+	if orderBy == "" || orderBy == "relevance" {
+		orderBy = "relevance"
+		ordering = photoOrdering{{rank, "float8", nil}, sortByCreatedAt, sortByID}
+	} else {
+		orderBy, ordering = orderPhotosBy(orderBy, "votes")
+	}
+
+	limit := " LIMIT " + b.param(page.size+1)
+
+	if page.cursor != "" {
+		values, err := ordering.decodeCursor(orderBy, page.cursor)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND " + ordering.after(values, b.param)
+	} else {
+		limit += " OFFSET " + b.param(page.offset)
+	}
+
+	sql := fmt.Sprintf("SELECT p.*, %s AS rank, %s AS highlight FROM %s%s ORDER BY %s%s",
+		rank, highlight, from, where, ordering.clause(), limit)
+
+	if _, err = d.Select(&results, sql, b.params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var next []interface{}
+	if int64(len(results)) > page.size {
+		results = results[:page.size]
+		last := &results[len(results)-1]
+		next = ordering.values(&last.photo)
+		if orderBy == "relevance" {
+			next[0] = last.Rank
+		}
+	}
+
+	for i := range results {
+		results[i].Highlight = formatHighlight(results[i].Highlight)
+	}
+
+	list := newSearchResultList(results, total, page)
+	if next != nil {
+		if list.NextCursor, err = encodeCursor(orderBy, next); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return list, nil
+}
+
+// returns up to limit photos matching the search, optionally only those of one owner
+func (d *defaultDataMapper) getPhotosBySearch(q string, ownerID int64, limit int64) ([]photo, error) {
+
+	var photos []photo
+
+	query, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.root == nil {
+		return photos, nil
+	}
+
+	b := &searchBuilder{}
+	from, where := query.toSQL(b)
+
+	if ownerID != 0 {
+		where += " AND p.owner_id = " + b.param(ownerID)
+	}
+
+	if _, err := d.Select(&photos,
+		"SELECT p.* FROM "+from+where+" ORDER BY p.id LIMIT "+b.param(limit), b.params...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+func (d *defaultDataMapper) getPhotosByIDs(ids []int64) ([]photo, error) {
+	var photos []photo
+	if _, err := d.Select(&photos,
+		"SELECT * FROM photos WHERE id = ANY($1::bigint[]) AND deleted_at IS NULL ORDER BY id",
+		intSliceToPgArr(ids)); err != nil {
+		return photos, errgo.Mask(err)
+	}
+	return photos, nil
+}
+
+func (d *defaultDataMapper) getPhotos(page *page, orderBy string) (*photoList, error) {
+	return d.getPhotoList(page, orderBy, "latest", "")
+}
+
+// returns a page of photos p, not in the trash, matching the condition, which may use params $1...
+func (d *defaultDataMapper) getPhotoList(page *page, orderBy, defaultOrderBy, condition string, params ...interface{}) (*photoList, error) {
+
+	var (
+		total  int64
+		photos []photo
+		err    error
+		q      = queryParams(params)
+		where  = "WHERE p.deleted_at IS NULL"
+	)
+
+	if condition != "" {
+		where += " AND " + condition
+	}
+
+	orderBy, ordering := orderPhotosBy(orderBy, defaultOrderBy)
+
+	if !page.skipCount {
+		if total, err = d.SelectInt("SELECT COUNT(p.id) FROM photos p "+where, q...); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+
+	var limit string
+
+	if page.cursor != "" {
+		values, err := ordering.decodeCursor(orderBy, page.cursor)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND " + ordering.after(values, q.add)
+		limit = "LIMIT " + q.add(page.size+1)
+	} else {
+		limit = "LIMIT " + q.add(page.size+1) + " OFFSET " + q.add(page.offset)
+	}
+
+	if _, err = d.Select(&photos,
+		"SELECT p.* FROM photos p "+where+" ORDER BY "+ordering.clause()+" "+limit, q...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	// the extra row tells us if there is a next page
+	var next []interface{}
+	if int64(len(photos)) > page.size {
+		photos = photos[:page.size]
+		next = ordering.values(&photos[len(photos)-1])
+	}
+
+	list := newPhotoList(photos, total, page)
+	if next != nil {
+		if list.NextCursor, err = encodeCursor(orderBy, next); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return list, nil
+}
+
+// groups visible photos within the box into a grid of cells of the given size in degrees,
+// returning the busiest cells with their most popular photo
+func (d *defaultDataMapper) getPhotoMap(box *boundingBox, cellSize float64) ([]mapCluster, error) {
+	var (
+		clusters []mapCluster
+		q        queryParams
+	)
+
+	where := "WHERE deleted_at IS NULL AND show_location AND latitude BETWEEN " + q.add(box.minLat) + " AND " + q.add(box.maxLat)
+
+	// the box crosses the 180th meridian
+	if box.minLng > box.maxLng {
+		where += " AND (longitude >= " + q.add(box.minLng) + " OR longitude <= " + q.add(box.maxLng) + ")"
+	} else {
+		where += " AND longitude BETWEEN " + q.add(box.minLng) + " AND " + q.add(box.maxLng)
+	}
+
+	cell := q.add(cellSize)
+
+	if _, err := d.Select(&clusters,
+		"WITH cells AS (SELECT AVG(latitude) AS latitude, AVG(longitude) AS longitude, "+
+			"COUNT(id) AS num_photos, (array_agg(id ORDER BY hot_score DESC, id DESC))[1] AS photo_id "+
+			"FROM photos "+where+" "+
+			"GROUP BY floor(latitude / "+cell+"), floor(longitude / "+cell+") "+
+			"ORDER BY num_photos DESC LIMIT "+q.add(maxMapClusters)+") "+
+			"SELECT c.*, p.title, p.photo FROM cells c JOIN photos p ON p.id = c.photo_id",
+		q...); err != nil {
+		return clusters, errgo.Mask(err)
+	}
+	return clusters, nil
+}
+
+func (d *defaultDataMapper) getPhotoCalendar(scope *photoScope, group string) ([]dateCount, error) {
+	var (
+		counts []dateCount
+		b      = &searchBuilder{}
+		where  = "WHERE p.deleted_at IS NULL"
+	)
+	for _, condition := range scope.where(b) {
+		where += " AND " + condition
+	}
+	if _, err := d.Select(&counts,
+		"SELECT to_char("+captureDateSQL+", '"+calendarGroups[group]+"') AS date, COUNT(p.id) AS num_photos "+
+			"FROM photos p "+where+" GROUP BY date ORDER BY date DESC", b.params...); err != nil {
+		return counts, errgo.Mask(err)
+	}
+	return counts, nil
+}
+
+// returns photos taken from the start date until before the end date, if not zero
+func (d *defaultDataMapper) getPhotosByDate(page *page, scope *photoScope, from, to time.Time) (*photoList, error) {
+	b := &searchBuilder{}
+	conditions := append(scope.where(b), captureDateSQL+" >= "+b.param(from)+"::timestamp")
+	if !to.IsZero() {
+		conditions = append(conditions, captureDateSQL+" < "+b.param(to)+"::timestamp")
+	}
+	return d.getPhotoList(page, "taken", "taken", strings.Join(conditions, " AND "), b.params...)
+}
+
+func (d *defaultDataMapper) refreshTrendingScores() error {
+	_, err := d.Exec("SELECT refresh_trending_scores()")
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getTagCounts() ([]tagCount, error) {
+	var tags []tagCount
+	if _, err := d.Select(&tags, "SELECT name, photo, num_photos FROM tag_counts"); err != nil {
+		return tags, errgo.Mask(err)
+	}
+	return tags, nil
+}
+
+// returns tags starting with prefix, most used first
+func (d *defaultDataMapper) getTagsByPrefix(prefix string, limit int64) ([]tagSuggestion, error) {
+	var tags []tagSuggestion
+	if _, err := d.Select(&tags,
+		"SELECT t.name, COUNT(pt.photo_id) AS num_photos "+
+			"FROM tags t JOIN photo_tags pt ON pt.tag_id = t.id "+
+			"JOIN photos p ON p.id = pt.photo_id AND p.deleted_at IS NULL "+
+			"WHERE t.name LIKE $1 OR t.name LIKE $3 GROUP BY t.id, t.name "+
+			"ORDER BY num_photos DESC, t.name LIMIT $2",
+		escapeLike(strings.ToLower(prefix))+"%", limit,
+		"%/"+escapeLike(strings.ToLower(prefix))+"%"); err != nil {
+		return tags, errgo.Mask(err)
+	}
+	return tags, nil
+}
+
+// returns tags most often used on the same photos as the given tags
+func (d *defaultDataMapper) getRelatedTags(names []string, limit int64) ([]tagSuggestion, error) {
+	var tags []tagSuggestion
+	for i, name := range names {
+		names[i] = cleanTagName(name)
+	}
+	if _, err := d.Select(&tags,
+		"SELECT t.name, COUNT(DISTINCT pt.photo_id) AS num_photos "+
+			"FROM photo_tags pt "+
+			"JOIN photos p ON p.id = pt.photo_id AND p.deleted_at IS NULL "+
+			"JOIN photo_tags other ON other.photo_id = pt.photo_id AND other.tag_id <> pt.tag_id "+
+			"JOIN tags t ON t.id = other.tag_id "+
+			"WHERE pt.tag_id IN (SELECT id FROM tags WHERE name = ANY($1::text[])) "+
+			"AND t.name <> ALL($1::text[]) "+
+			"GROUP BY t.name ORDER BY num_photos DESC, t.name LIMIT $2",
+		stringSliceToPgArr(names), limit); err != nil {
+		return tags, errgo.Mask(err)
+	}
+	return tags, nil
+}
+
+// returns all tags in use as a tree, with photo counts including descendants
+func (d *defaultDataMapper) getTagTree() ([]*tagNode, error) {
+	var tags []*tagNode
+	if _, err := d.Select(&tags,
+		"SELECT * FROM (SELECT t.id, t.parent_id, t.name, "+
+			"(SELECT COUNT(DISTINCT pt.photo_id) FROM photo_tags pt JOIN tags d ON d.id = pt.tag_id "+
+			"JOIN photos p ON p.id = pt.photo_id AND p.deleted_at IS NULL "+
+			"WHERE d.id = t.id OR starts_with(d.name, t.name || '/')) AS num_photos "+
+			"FROM tags t) AS tree WHERE num_photos > 0 ORDER BY name"); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buildTagTree(tags), nil
+}
+
+func (d *defaultDataMapper) getTag(name string) (*tag, error) {
+	tag := &tag{}
+	if err := d.SelectOne(tag, "SELECT * FROM tags WHERE name=$1", cleanTagName(name)); err != nil {
+		return tag, errgo.Mask(err, isErrSqlNoRows)
+	}
+	return tag, nil
+}
+
+// renames the tag and its descendants, creating any new ancestors; the new
+// names are normalized like those of photo tags, but blocked names and
+// synonyms are rejected rather than resolved
+func (d *defaultDataMapper) renameTag(tag *tag, name string) error {
+
+	name = cleanTagName(name)
+
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	conflicts, err := t.SelectInt("SELECT COUNT(d.id) FROM tags d "+
+		"JOIN tags e ON e.name = $2 || substr(d.name, length($1) + 1) "+
+		"WHERE starts_with(d.name, $1 || '/')", tag.Name, name)
+	if err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if conflicts > 0 {
+		t.Rollback()
+		return validationFailure{map[string]string{"name": "A tag below this one already exists under the new name"}}
+	}
+
+	if err := t.checkRenamedTagNames(tag.Name, name); err != nil {
+		t.Rollback()
+		return err
+	}
+
+	if _, err := t.Exec("UPDATE tags SET name = $2 || substr(name, length($1) + 1) "+
+		"WHERE starts_with(name, $1 || '/')", tag.Name, name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+
+	tag.Name = name
+	tag.ParentID = sql.NullInt64{}
+
+	if parent := parentTagName(name); parent != "" {
+		parentID, err := t.SelectInt("SELECT add_tag($1)", parent)
+		if err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+		tag.ParentID = sql.NullInt64{Int64: parentID, Valid: true}
+	}
+
+	if _, err := t.Update(tag); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) mergeTags(source, target *tag) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.mergeTags(source, target); err != nil {
+		t.Rollback()
+		return err
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) getTagSynonyms() ([]tagSynonym, error) {
+	var synonyms []tagSynonym
+	if _, err := d.Select(&synonyms,
+		"SELECT s.name, t.name AS tag FROM tag_synonyms s "+
+			"JOIN tags t ON t.id = s.tag_id ORDER BY t.name, s.name"); err != nil {
+		return synonyms, errgo.Mask(err)
+	}
+	return synonyms, nil
+}
+
+// any existing tag with the synonym name is merged into the tag
+func (d *defaultDataMapper) addTagSynonym(target *tag, name string) error {
+
+	name = cleanTagName(name)
+
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	var existing []*tag
+	if _, err := t.Select(&existing, "SELECT * FROM tags WHERE name=$1", name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+
+	for _, source := range existing {
+		if err := t.mergeTags(source, target); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+
+	if _, err := t.Exec("INSERT INTO tag_synonyms(name, tag_id) VALUES($1, $2) "+
+		"ON CONFLICT (name) DO UPDATE SET tag_id = EXCLUDED.tag_id", name, target.ID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) removeTagSynonym(name string) (bool, error) {
+	result, err := d.Exec("DELETE FROM tag_synonyms WHERE name=$1", cleanTagName(name))
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
+}
+
+func (d *defaultDataMapper) getBlockedTags() ([]blockedTag, error) {
+	var tags []blockedTag
+	if _, err := d.Select(&tags, "SELECT * FROM tag_blocklist ORDER BY name"); err != nil {
+		return tags, errgo.Mask(err)
+	}
+	return tags, nil
+}
+
+// blocks the name and removes the tag, and any synonym of that name, from all photos
+func (d *defaultDataMapper) blockTag(name string) error {
+
+	name = cleanTagName(name)
+
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	var queries = []string{
+		"INSERT INTO tag_blocklist(name) VALUES($1) ON CONFLICT DO NOTHING",
+		"DELETE FROM tag_synonyms WHERE name=$1",
+	}
+
+	for _, q := range queries {
+		if _, err := t.Exec(q, name); err != nil {
+			t.Rollback()
+			return errgo.Mask(err)
+		}
+	}
+
+	var existing []*tag
+	if _, err := t.Select(&existing, "SELECT * FROM tags WHERE name=$1", name); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+
+	for _, tag := range existing {
+		if err := t.removeTag(tag.ID); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) unblockTag(name string) (bool, error) {
+	result, err := d.Exec("DELETE FROM tag_blocklist WHERE name=$1", cleanTagName(name))
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
 }
 
 func (d *defaultDataMapper) isUserNameAvailable(user *user) (bool, error) {
@@ -416,18 +1568,35 @@ func (d *defaultDataMapper) getActiveUser(userID int64) (*user, error) {
 
 }
 
-func (d *defaultDataMapper) getUserByRecoveryCode(code string) (*user, error) {
+// finds the user by the hash of their recovery code
+func (d *defaultDataMapper) getUserByRecoveryCode(codeHash string) (*user, error) {
 
 	user := &user{}
-	if code == "" {
+	if codeHash == "" {
 		return user, sql.ErrNoRows
 	}
-	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND recovery_code=$2", true, code); err != nil {
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND recovery_code=$2", true, codeHash); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
+
+}
+func (d *defaultDataMapper) getUserByVerifyToken(tokenHash string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND verification_token=$2", true, tokenHash); err != nil {
 		return user, errgo.Mask(err)
 	}
 	return user, nil
+}
 
+func (d *defaultDataMapper) getUserByEmailChangeToken(tokenHash string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email_change_token=$2", true, tokenHash); err != nil {
+		return user, errgo.Mask(err)
+	}
+	return user, nil
 }
+
 func (d *defaultDataMapper) getUserByEmail(email string) (*user, error) {
 	user := &user{}
 	if err := d.SelectOne(user, "SELECT * FROM users WHERE active=$1 AND email=$2", true, email); err != nil {
@@ -445,3 +1614,406 @@ func (d *defaultDataMapper) getUserByNameOrEmail(identifier string) (*user, erro
 
 	return user, nil
 }
+
+func (d *defaultDataMapper) createSession(s *userSession) error {
+	return errgo.Mask(d.Insert(s))
+}
+
+// stores the rotated refresh token of the session, unless the previous one
+// has been rotated out already, e.g. by a concurrent refresh, or the session
+// revoked; returns false if so
+func (d *defaultDataMapper) rotateSession(s *userSession) (bool, error) {
+	result, err := d.Exec("UPDATE sessions SET token_hash=$1, previous_token_hash=$2, "+
+		"ip_address=$3, last_used_at=$4, expires_at=$5 "+
+		"WHERE id=$6 AND token_hash=$2 AND revoked_at IS NULL",
+		s.TokenHash, s.PreviousTokenHash.String, s.IPAddress, s.LastUsedAt, s.ExpiresAt, s.ID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
+}
+
+// finds the session by the hash of its current or previous refresh token
+func (d *defaultDataMapper) getSessionByToken(hash string) (*userSession, error) {
+	s := &userSession{}
+	if err := d.SelectOne(s, "SELECT * FROM sessions WHERE token_hash=$1 OR previous_token_hash=$1", hash); err != nil {
+		return s, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+// returns the sessions of the user that have not expired or been revoked, most recently used first
+func (d *defaultDataMapper) getSessions(userID int64) ([]userSession, error) {
+	sessions := []userSession{}
+	if _, err := d.Select(&sessions,
+		"SELECT * FROM sessions WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > $2 "+
+			"ORDER BY last_used_at DESC", userID, time.Now()); err != nil {
+		return sessions, errgo.Mask(err)
+	}
+	return sessions, nil
+}
+
+func (d *defaultDataMapper) isSessionActive(sessionID, userID int64) (bool, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM sessions "+
+		"WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL AND expires_at > $3",
+		sessionID, userID, time.Now())
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// returns false if the user has no such active session
+func (d *defaultDataMapper) revokeSession(userID, sessionID int64) (bool, error) {
+	result, err := d.Exec("UPDATE sessions SET revoked_at=$1 WHERE user_id=$2 AND id=$3 AND revoked_at IS NULL",
+		time.Now(), userID, sessionID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) revokeSessions(userID int64) error {
+	_, err := d.Exec("UPDATE sessions SET revoked_at=$1 WHERE user_id=$2 AND revoked_at IS NULL",
+		time.Now(), userID)
+	return errgo.Mask(err)
+}
+
+// deletes sessions that expired or were revoked before the given time
+func (d *defaultDataMapper) removeExpiredSessions(before time.Time) error {
+	_, err := d.Exec("DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $1", before)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) createAPIToken(t *apiToken) error {
+	return errgo.Mask(d.Insert(t))
+}
+
+// finds an unexpired token by its hash
+func (d *defaultDataMapper) getAPIToken(hash string) (*apiToken, error) {
+	t := &apiToken{}
+	if err := d.SelectOne(t, "SELECT * FROM api_tokens WHERE token_hash=$1 AND expires_at > $2",
+		hash, time.Now()); err != nil {
+		return t, errgo.Mask(err)
+	}
+	return t, nil
+}
+
+func (d *defaultDataMapper) getAPITokens(userID int64) ([]apiToken, error) {
+	tokens := []apiToken{}
+	if _, err := d.Select(&tokens, "SELECT * FROM api_tokens WHERE user_id=$1 ORDER BY created_at DESC",
+		userID); err != nil {
+		return tokens, errgo.Mask(err)
+	}
+	return tokens, nil
+}
+
+// records when the token was used, at most once a minute
+func (d *defaultDataMapper) touchAPIToken(tokenID int64) error {
+	now := time.Now()
+	_, err := d.Exec("UPDATE api_tokens SET last_used_at=$1 WHERE id=$2 "+
+		"AND (last_used_at IS NULL OR last_used_at < $3)", now, tokenID, now.Add(-time.Minute))
+	return errgo.Mask(err)
+}
+
+// returns false if the user has no such token
+func (d *defaultDataMapper) removeAPIToken(userID, tokenID int64) (bool, error) {
+	result, err := d.Exec("DELETE FROM api_tokens WHERE user_id=$1 AND id=$2", userID, tokenID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// removes all the user's tokens, returning how many there were
+func (d *defaultDataMapper) removeAPITokens(userID int64) (int64, error) {
+	result, err := d.Exec("DELETE FROM api_tokens WHERE user_id=$1", userID)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	return num, errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getUserByIdentity(provider, providerUserID string) (*user, error) {
+	user := &user{}
+	if err := d.SelectOne(user, "SELECT u.* FROM users u "+
+		"JOIN user_identities i ON i.user_id = u.id "+
+		"WHERE u.active=$1 AND i.provider=$2 AND i.provider_user_id=$3",
+		true, provider, providerUserID); err != nil {
+		return user, errgo.Mask(err)
+	}
+	user.HasIdentity = true
+	return user, nil
+}
+
+// creates a user signing up with an external login
+func (d *defaultDataMapper) createUserWithIdentity(user *user, identity *userIdentity) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := t.Insert(user); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	identity.UserID = user.ID
+	if err := t.Insert(identity); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+func (d *defaultDataMapper) addIdentity(identity *userIdentity) error {
+	return errgo.Mask(d.Insert(identity))
+}
+
+func (d *defaultDataMapper) getIdentities(userID int64) ([]userIdentity, error) {
+	identities := []userIdentity{}
+	if _, err := d.Select(&identities, "SELECT * FROM user_identities WHERE user_id=$1 ORDER BY created_at",
+		userID); err != nil {
+		return identities, errgo.Mask(err)
+	}
+	return identities, nil
+}
+
+// returns false if the user has no such identity
+func (d *defaultDataMapper) removeIdentity(userID, identityID int64) (bool, error) {
+	result, err := d.Exec("DELETE FROM user_identities WHERE user_id=$1 AND id=$2", userID, identityID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+// replaces the user's backup codes with the given hashes
+func (d *defaultDataMapper) setBackupCodes(userID int64, hashes []string) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("DELETE FROM backup_codes WHERE user_id=$1", userID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("INSERT INTO backup_codes(user_id, code_hash) SELECT $1, unnest($2::text[])",
+		userID, stringSliceToPgArr(hashes)); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// records the time step of a TOTP code as used; returns false if it, or a
+// later one, has been used already, e.g. by a concurrent login
+func (d *defaultDataMapper) useTOTPStep(userID, step int64) (bool, error) {
+	result, err := d.Exec("UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1", step, userID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return rowsAffected(result)
+}
+
+// marks the code used, returning false if the user has no such unused code
+func (d *defaultDataMapper) useBackupCode(userID int64, hash string) (bool, error) {
+	result, err := d.Exec("UPDATE backup_codes SET used_at=$1 WHERE user_id=$2 AND code_hash=$3 AND used_at IS NULL",
+		time.Now(), userID, hash)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	num, err := result.RowsAffected()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return num > 0, nil
+}
+
+func (d *defaultDataMapper) getBackupCodeCount(userID int64) (int64, error) {
+	num, err := d.SelectInt("SELECT COUNT(id) FROM backup_codes WHERE user_id=$1 AND used_at IS NULL", userID)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return num, nil
+}
+
+// turns off two-factor authentication, removing the secret and backup codes
+func (d *defaultDataMapper) resetTwoFactor(userID int64) error {
+	t, err := d.begin()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("UPDATE users SET totp_secret=NULL, totp_enabled=false WHERE id=$1", userID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	if _, err := t.Exec("DELETE FROM backup_codes WHERE user_id=$1", userID); err != nil {
+		t.Rollback()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(t.Commit())
+}
+
+// returns the failures recorded for the key, if any
+func (d *defaultDataMapper) getThrottle(key string) (*throttle, error) {
+	t := &throttle{}
+	if err := d.SelectOne(t, "SELECT * FROM login_throttles WHERE key=$1", key); err != nil {
+		if isErrSqlNoRows(err) {
+			return &throttle{Key: key}, nil
+		}
+		return t, errgo.Mask(err)
+	}
+	return t, nil
+}
+
+// adds a failure at now, starting the count again if the last one was before
+// the window; returns the number of failures
+func (d *defaultDataMapper) addThrottleFailure(key string, now, window time.Time) (int64, error) {
+	failures, err := d.SelectInt("INSERT INTO login_throttles (key, failures, last_failure_at) "+
+		"VALUES ($1, 1, $2) ON CONFLICT (key) DO UPDATE SET "+
+		"failures = CASE WHEN login_throttles.last_failure_at < $3 THEN 1 ELSE login_throttles.failures + 1 END, "+
+		"last_failure_at = $2 RETURNING failures", key, now, window)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return failures, nil
+}
+
+func (d *defaultDataMapper) blockThrottle(key string, until time.Time) error {
+	_, err := d.Exec("UPDATE login_throttles SET blocked_until=$1 WHERE key=$2", until, key)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) clearThrottle(key string) error {
+	_, err := d.Exec("DELETE FROM login_throttles WHERE key=$1", key)
+	return errgo.Mask(err)
+}
+
+// deletes keys with no failures since the given time that are no longer blocked
+func (d *defaultDataMapper) removeExpiredThrottles(before time.Time) error {
+	_, err := d.Exec("DELETE FROM login_throttles WHERE last_failure_at < $1 "+
+		"AND (blocked_until IS NULL OR blocked_until < $2)", before, time.Now())
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) createExport(export *dataExport) error {
+	return errgo.Mask(d.Insert(export))
+}
+
+// returns sql.ErrNoRows if the export has been removed, e.g. with its user
+func (d *defaultDataMapper) updateExport(export *dataExport) error {
+	count, err := d.Update(export)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *defaultDataMapper) removeExport(export *dataExport) error {
+	_, err := d.Delete(export)
+	return errgo.Mask(err)
+}
+
+func (d *defaultDataMapper) getExports(userID int64) ([]dataExport, error) {
+	var exports []dataExport
+	if _, err := d.Select(&exports,
+		"SELECT * FROM data_exports WHERE user_id=$1 ORDER BY created_at DESC", userID); err != nil {
+		return exports, errgo.Mask(err)
+	}
+	return exports, nil
+}
+
+func (d *defaultDataMapper) getPendingExports() ([]dataExport, error) {
+	var exports []dataExport
+	if _, err := d.Select(&exports,
+		"SELECT * FROM data_exports WHERE status=$1 ORDER BY created_at", exportPending); err != nil {
+		return exports, errgo.Mask(err)
+	}
+	return exports, nil
+}
+
+// returns exports whose links expired before the given time, and ones that
+// failed or have been stuck since a request interval before it
+func (d *defaultDataMapper) getExpiredExports(before time.Time) ([]dataExport, error) {
+	var exports []dataExport
+	if _, err := d.Select(&exports,
+		"SELECT * FROM data_exports WHERE expires_at < $1 OR (status IN ($2, $3) AND created_at < $4)",
+		before, exportFailed, exportProcessing, before.Add(-time.Hour*exportRequestInterval)); err != nil {
+		return exports, errgo.Mask(err)
+	}
+	return exports, nil
+}
+
+// finds a ready export by the hash of its download token
+func (d *defaultDataMapper) getExportByToken(tokenHash string) (*dataExport, error) {
+	export := &dataExport{}
+	if err := d.SelectOne(export,
+		"SELECT e.* FROM data_exports e JOIN users u ON u.id = e.user_id "+
+			"WHERE e.token_hash=$1 AND e.status=$2 AND e.expires_at > $3 AND u.active=true",
+		tokenHash, exportReady, time.Now()); err != nil {
+		return export, errgo.Mask(err)
+	}
+	return export, nil
+}
+
+// returns everything the user has added, trashed photos included
+func (d *defaultDataMapper) getUserData(userID int64) (*userData, error) {
+
+	// empty lists rather than nulls in the manifest
+	data := &userData{
+		Photos:   []exportPhoto{},
+		Votes:    []exportVote{},
+		Comments: []comment{},
+	}
+
+	var photos []photo
+	if _, err := d.Select(&photos,
+		"SELECT * FROM photos WHERE owner_id=$1 ORDER BY created_at", userID); err != nil {
+		return data, errgo.Mask(err)
+	}
+
+	var tags []struct {
+		PhotoID int64  `db:"photo_id"`
+		Name    string `db:"name"`
+	}
+	if _, err := d.Select(&tags,
+		"SELECT pt.photo_id, t.name FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id "+
+			"JOIN photos p ON p.id = pt.photo_id WHERE p.owner_id=$1 ORDER BY t.name", userID); err != nil {
+		return data, errgo.Mask(err)
+	}
+	photoTags := make(map[int64][]string)
+	for _, tag := range tags {
+		photoTags[tag.PhotoID] = append(photoTags[tag.PhotoID], tag.Name)
+	}
+
+	for _, photo := range photos {
+		photo.Tags = photoTags[photo.ID]
+		data.Photos = append(data.Photos, newExportPhoto(photo))
+	}
+
+	if _, err := d.Select(&data.Votes,
+		"SELECT photo_id, direction, created_at FROM votes WHERE user_id=$1 ORDER BY created_at", userID); err != nil {
+		return data, errgo.Mask(err)
+	}
+
+	if _, err := d.Select(&data.Comments,
+		"SELECT * FROM comments WHERE owner_id=$1 ORDER BY created_at", userID); err != nil {
+		return data, errgo.Mask(err)
+	}
+	return data, nil
+}
@@ -2,7 +2,10 @@ package photoshare
 
 import (
 	"database/sql"
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func TestGetIfNotNone(t *testing.T) {
@@ -66,7 +69,7 @@ func TestSearchPhotos(t *testing.T) {
 		return
 	}
 
-	result, err := datamapper.searchPhotos(newPage(1), "test")
+	result, err := datamapper.searchPhotos(newPage(1), "test", "")
 	if err != nil {
 		t.Error(err)
 		return
@@ -131,15 +134,970 @@ func TestCanEdit(t *testing.T) {
 	}
 }
 
-func TestHasVoted(t *testing.T) {
+func TestCanVote(t *testing.T) {
 
-	u := &user{}
-	if u.hasVoted(1) {
-		t.Error("The user has not voted yet")
+	u := &user{ID: 2}
+	p := &photo{ID: 1, OwnerID: 1}
+	if p.canVote(u) {
+		t.Error("Non-authenticated should not be able to vote")
 	}
 
-	u.registerVote(1)
-	if !u.hasVoted(1) {
-		t.Error("The user should have voted")
+	u.IsAuthenticated = true
+	if !p.canVote(u) {
+		t.Error("The user should be able to vote")
+	}
+
+	p.OwnerID = u.ID
+	if p.canVote(u) {
+		t.Error("The owner should not be able to vote")
+	}
+}
+
+func TestRegisterVote(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Error(err)
+		return
+	}
+	voter := &user{Name: "voter", Email: "voter@gmail.com", Password: "test"}
+	if err := datamapper.createUser(voter); err != nil {
+		t.Error(err)
+		return
+	}
+	photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if ok, err := datamapper.registerVote(photo, voter, upVote); err != nil || !ok {
+		t.Error("First vote should succeed", err)
+		return
+	}
+	if ok, err := datamapper.registerVote(photo, voter, upVote); err != nil || ok {
+		t.Error("Same vote twice should be rejected", err)
+		return
+	}
+	if ok, err := datamapper.registerVote(photo, voter, downVote); err != nil || !ok {
+		t.Error("Switching vote should succeed", err)
+		return
+	}
+
+	detail, err := datamapper.getPhotoDetail(photo.ID, voter)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if detail.UpVotes != 0 || detail.DownVotes != 1 {
+		t.Error("There should be exactly 1 down vote")
+	}
+	if detail.Vote != downVote {
+		t.Error("The user vote should be down")
+	}
+
+	if ok, err := datamapper.removeVote(photo, voter); err != nil || !ok {
+		t.Error("Retracting vote should succeed", err)
+		return
+	}
+	if ok, err := datamapper.removeVote(photo, voter); err != nil || ok {
+		t.Error("Retracting twice should be rejected", err)
+		return
+	}
+
+	detail, err = datamapper.getPhotoDetail(photo.ID, voter)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if detail.UpVotes != 0 || detail.DownVotes != 0 || detail.Vote != 0 {
+		t.Error("There should be no votes")
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Error(err)
+		return
+	}
+	fan := &user{Name: "fan", Email: "fan@gmail.com", Password: "test"}
+	if err := datamapper.createUser(fan); err != nil {
+		t.Error(err)
+		return
+	}
+	photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// adding twice should be a no-op
+	for i := 0; i < 2; i++ {
+		if err := datamapper.addFavorite(photo, fan); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	result, err := datamapper.getFavorites(newPage(1), fan.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result.Items) != 1 {
+		t.Error("There should be 1 favorite")
+	}
+
+	page := newPage(1)
+	page.cursor = "abc"
+	if _, err := datamapper.getFavorites(page, fan.ID); err == nil {
+		t.Error("Favorites cannot be paged with a cursor")
+	}
+
+	if err := datamapper.removeFavorite(photo, fan); err != nil {
+		t.Error(err)
+		return
+	}
+	result, err = datamapper.getFavorites(newPage(1), fan.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Total != 0 {
+		t.Error("There should be no favorites")
+	}
+}
+
+func TestFollows(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	var users []*user
+	for _, name := range []string{"follower", "followee", "other"} {
+		user := &user{Name: name, Email: name + "@gmail.com", Password: "test"}
+		if err := datamapper.createUser(user); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	follower, followee, other := users[0], users[1], users[2]
+
+	fromFollowee := &photo{Title: "followed user", OwnerID: followee.ID, Filename: "a.jpg"}
+	withTag := &photo{Title: "followed tag", OwnerID: other.ID, Filename: "b.jpg", Tags: []string{"travel/japan"}}
+	unfollowed := &photo{Title: "unfollowed", OwnerID: other.ID, Filename: "c.jpg", Tags: []string{"food"}}
+	for _, photo := range []*photo{fromFollowee, withTag, unfollowed} {
+		if err := datamapper.createPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// following twice should be a no-op
+	for i := 0; i < 2; i++ {
+		if err := datamapper.followUser(follower.ID, followee.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := datamapper.followTag(follower.ID, "travel"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	followers, err := datamapper.getFollowers(newPage(1), followee.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if followers.Total != 1 || followers.Items[0].ID != follower.ID {
+		t.Error("Followee should have 1 follower:", followers.Items)
+	}
+	following, err := datamapper.getFollowing(newPage(1), follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if following.Total != 1 || following.Items[0].ID != followee.ID {
+		t.Error("Follower should follow 1 user:", following.Items)
+	}
+
+	// photos tagged below a followed tag are included
+	timeline, err := datamapper.getTimeline(newPage(1), follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeline.Total != 2 || len(timeline.Items) != 2 {
+		t.Fatal("Timeline should have the followed user's and tag's photos:", timeline.Items)
+	}
+
+	page := newPage(1)
+	page.setSize(1)
+	first, err := datamapper.getTimeline(page, follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.cursor = first.NextCursor
+	second, err := datamapper.getTimeline(page, follower.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Items) != 1 || len(second.Items) != 1 || first.Items[0].ID == second.Items[0].ID {
+		t.Error("Timeline should be paged by cursor")
+	}
+
+	if err := datamapper.unfollowUser(follower.ID, followee.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.unfollowTag(follower.ID, "travel"); err != nil {
+		t.Fatal(err)
+	}
+
+	if timeline, _ = datamapper.getTimeline(newPage(1), follower.ID); timeline.Total != 0 {
+		t.Error("Timeline should be empty after unfollowing")
+	}
+	if followers, _ = datamapper.getFollowers(newPage(1), followee.ID); followers.Total != 0 {
+		t.Error("Followee should have no followers after unfollowing")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Error(err)
+		return
+	}
+	photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := datamapper.trashPhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := datamapper.getPhoto(photo.ID); !isErrSqlNoRows(err) {
+		t.Error("Trashed photo should not be found")
+	}
+	result, err := datamapper.getPhotos(newPage(1), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Total != 0 {
+		t.Error("Trashed photo should not be listed")
+	}
+	trash, err := datamapper.getTrash(newPage(1), owner.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(trash.Items) != 1 {
+		t.Error("Photo should be in the trash")
+	}
+
+	page := newPage(1)
+	page.cursor = "abc"
+	if _, err := datamapper.getTrash(page, owner.ID); err == nil {
+		t.Error("Trash cannot be paged with a cursor")
+	}
+
+	expired, err := datamapper.getExpiredTrash(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(expired) != 0 {
+		t.Error("Photo should not have expired yet")
+	}
+
+	if err := datamapper.restorePhoto(photo); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := datamapper.getPhoto(photo.ID); err != nil {
+		t.Error("Restored photo should be found")
+	}
+}
+
+func getTestPhotoTags(t *testing.T, datamapper dataMapper, photo *photo, user *user) []string {
+	detail, err := datamapper.getPhotoDetail(photo.ID, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return detail.Tags
+}
+
+func TestTagSynonyms(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	first := &photo{Title: "first", OwnerID: user.ID, Filename: "a.jpg", Tags: []string{"New York", "nyc"}}
+	if err := datamapper.createPhoto(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing tag with the synonym name is merged
+	tag, err := datamapper.getTag("new york")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.addTagSynonym(tag, " NYC "); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getTag("nyc"); !isErrSqlNoRows(err) {
+		t.Error("Synonym tag should be merged")
+	}
+	if tags := getTestPhotoTags(t, datamapper, first, user); len(tags) != 1 || tags[0] != "new york" {
+		t.Error("Photo should keep the merged tag once:", tags)
+	}
+
+	// new photos get the tag instead of the synonym
+	second := &photo{Title: "second", OwnerID: user.ID, Filename: "b.jpg", Tags: []string{"NYC"}}
+	if err := datamapper.createPhoto(second); err != nil {
+		t.Fatal(err)
+	}
+	if tags := getTestPhotoTags(t, datamapper, second, user); len(tags) != 1 || tags[0] != "new york" {
+		t.Error("Synonym should be replaced with its tag:", tags)
+	}
+
+	if ok, err := datamapper.removeTagSynonym("Nyc"); err != nil || !ok {
+		t.Error("Synonym should be removed:", err)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	both := &photo{Title: "both", OwnerID: user.ID, Filename: "a.jpg", Tags: []string{"cat", "kitten"}}
+	if err := datamapper.createPhoto(both); err != nil {
+		t.Fatal(err)
+	}
+	source := &photo{Title: "source", OwnerID: user.ID, Filename: "b.jpg", Tags: []string{"kitten"}}
+	if err := datamapper.createPhoto(source); err != nil {
+		t.Fatal(err)
+	}
+
+	kitten, _ := datamapper.getTag("kitten")
+	cat, _ := datamapper.getTag("cat")
+	if err := datamapper.followTag(user.ID, "kitten"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := datamapper.mergeTags(kitten, cat); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getTag("kitten"); !isErrSqlNoRows(err) {
+		t.Error("Source tag should be removed")
+	}
+	if tags := getTestPhotoTags(t, datamapper, both, user); len(tags) != 1 || tags[0] != "cat" {
+		t.Error("Photo should have the target tag once:", tags)
+	}
+	if tags := getTestPhotoTags(t, datamapper, source, user); len(tags) != 1 || tags[0] != "cat" {
+		t.Error("Photo should have the target tag:", tags)
+	}
+
+	// the timeline shows the photos of followed tags
+	if result, err := datamapper.getTimeline(newPage(1), user.ID); err != nil || result.Total != 2 {
+		t.Error("Followers should follow the target tag:", err)
+	}
+}
+
+func TestTagBlocklist(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+	tagged := &photo{Title: "test", OwnerID: user.ID, Filename: "a.jpg", Tags: []string{"spam", "beach"}}
+	if err := datamapper.createPhoto(tagged); err != nil {
+		t.Fatal(err)
+	}
+
+	// names are normalized before they are blocked
+	if err := datamapper.blockTag(" SPAM "); err != nil {
+		t.Fatal(err)
+	}
+	if tags := getTestPhotoTags(t, datamapper, tagged, user); len(tags) != 1 || tags[0] != "beach" {
+		t.Error("Blocked tag should be removed from photos:", tags)
+	}
+
+	tagged.Tags = []string{"Spam/"}
+	if err := datamapper.updatePhoto(tagged); err == nil {
+		t.Error("Blocked tag should be rejected after normalizing")
+	}
+
+	// tags can't be renamed to blocked names or synonyms
+	beach, _ := datamapper.getTag("beach")
+	if err := datamapper.renameTag(beach, "SPAM"); err == nil {
+		t.Error("Tag should not be renamed to a blocked name")
+	}
+	if err := datamapper.renameTag(beach, "spam/beach"); err == nil {
+		t.Error("Tag should not be moved below a blocked name")
+	}
+	if err := datamapper.addTagSynonym(beach, "seaside"); err != nil {
+		t.Fatal(err)
+	}
+	other := &photo{Title: "other", OwnerID: user.ID, Filename: "b.jpg", Tags: []string{"coast"}}
+	if err := datamapper.createPhoto(other); err != nil {
+		t.Fatal(err)
+	}
+	coast, _ := datamapper.getTag("coast")
+	if err := datamapper.renameTag(coast, " Seaside "); err == nil {
+		t.Error("Tag should not be renamed to a synonym")
+	}
+
+	if ok, err := datamapper.unblockTag("Spam"); err != nil || !ok {
+		t.Error("Tag should be unblocked:", err)
+	}
+}
+
+func TestBulkEditPhotos(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	p := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg", Tags: []string{"new york", "usa"}}
+	if err := datamapper.createPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := datamapper.getTag("new york")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.addTagSynonym(tag, "nyc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the synonym removes the tag it stands for
+	if err := datamapper.bulkEditPhotos([]*photo{p},
+		&bulkEdit{Operation: bulkRemoveTags, Tags: []string{"NYC"}}); err != nil {
+		t.Fatal(err)
+	}
+	detail, err := datamapper.getPhotoDetail(p.ID, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Tags) != 1 || detail.Tags[0] != "usa" {
+		t.Error("Tag should be removed by its synonym:", detail.Tags)
+	}
+
+	album := &album{OwnerID: owner.ID, Name: "Holidays", CreatedAt: time.Now()}
+	if err := datamapper.createAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	p.AlbumID = sql.NullInt64{Int64: album.ID, Valid: true}
+	if err := datamapper.bulkEditPhotos([]*photo{p}, &bulkEdit{Operation: bulkMoveToAlbum, AlbumID: album.ID}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := datamapper.getPhotosByAlbum(newPage(1), album.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 || result.Items[0].ID != p.ID {
+		t.Error("Photo should be in the album:", result.Items)
+	}
+
+	// deleting the album keeps its photos
+	if err := datamapper.removeAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	if photo, err := datamapper.getPhoto(p.ID); err != nil || photo.AlbumID.Valid {
+		t.Error("Photo should be kept out of any album:", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("POST", "/api/auth/", nil)
+	var sessions []*userSession
+	for i := 0; i < 2; i++ {
+		s := newUserSession(user.ID, r, time.Hour)
+		if _, err := s.rotateToken(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := datamapper.createSession(s); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	if ok, err := datamapper.isSessionActive(sessions[0].ID, user.ID); err != nil || !ok {
+		t.Fatal("Session should be active", err)
+	}
+
+	// the token is rotated once, even by concurrent refreshes
+	stale := *sessions[1]
+	for _, s := range []*userSession{sessions[1], &stale} {
+		if _, err := s.rotateToken(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := datamapper.rotateSession(sessions[1]); err != nil || !ok {
+		t.Fatal("Session should be rotated", err)
+	}
+	if ok, _ := datamapper.rotateSession(&stale); ok {
+		t.Error("Rotated out token should not rotate the session again")
+	}
+
+	if ok, _ := datamapper.revokeSession(user.ID, sessions[0].ID); !ok {
+		t.Fatal("Session should be revoked")
+	}
+	if ok, _ := datamapper.isSessionActive(sessions[0].ID, user.ID); ok {
+		t.Error("Revoked session should not be active")
+	}
+	if active, _ := datamapper.getSessions(user.ID); len(active) != 1 {
+		t.Error("Only one session should be listed")
+	}
+
+	if err := datamapper.revokeSessions(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := datamapper.isSessionActive(sessions[1].ID, user.ID); ok {
+		t.Error("All sessions should be revoked")
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	token := &apiToken{UserID: user.ID, Name: "backup", Scope: scopeRead, TokenHash: hashToken("pat_test"),
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := datamapper.createAPIToken(token); err != nil {
+		t.Fatal(err)
+	}
+	expired := &apiToken{UserID: user.ID, Name: "old", Scope: scopeRead, TokenHash: hashToken("pat_old"),
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	if err := datamapper.createAPIToken(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := datamapper.getAPIToken(hashToken("pat_test")); err != nil || found.UserID != user.ID {
+		t.Error("Token should be found", err)
+	}
+	if _, err := datamapper.getAPIToken(hashToken("pat_old")); !isErrSqlNoRows(err) {
+		t.Error("Expired token should not be found")
+	}
+
+	if ok, _ := datamapper.removeAPIToken(user.ID+1, token.ID); ok {
+		t.Error("Other users should not be able to remove the token")
+	}
+	if ok, _ := datamapper.removeAPIToken(user.ID, token.ID); !ok {
+		t.Error("Token should be removed")
+	}
+
+	// only the expired token is left
+	if num, err := datamapper.removeAPITokens(user.ID); err != nil || num != 1 {
+		t.Error("Remaining tokens should be removed:", num, err)
+	}
+}
+
+func TestUserIdentities(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	info := &authInfo{provider: oidcProviderName, id: "user-1234", email: "tester@gmail.com"}
+	user := &user{Name: "tester", Email: info.email}
+	identity := newUserIdentity(0, info)
+	if err := datamapper.createUserWithIdentity(user, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := datamapper.getUserByIdentity(info.provider, info.id)
+	if err != nil || found.ID != user.ID {
+		t.Fatal("User should be found by identity", err)
+	}
+	if _, err := datamapper.getUserByIdentity("google", info.id); !isErrSqlNoRows(err) {
+		t.Error("Identity of another provider should not match")
+	}
+
+	if ok, _ := datamapper.removeIdentity(user.ID, identity.ID); !ok {
+		t.Fatal("Identity should be removed")
+	}
+	if identities, _ := datamapper.getIdentities(user.ID); len(identities) != 0 {
+		t.Error("User should have no identities")
+	}
+}
+
+func TestUseBackupCode(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, hashes, _ := generateBackupCodes()
+	if err := datamapper.setBackupCodes(user.ID, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := datamapper.useBackupCode(user.ID, hashBackupCode(codes[0])); !ok {
+		t.Fatal("Code should be accepted")
+	}
+	if ok, _ := datamapper.useBackupCode(user.ID, hashBackupCode(codes[0])); ok {
+		t.Error("Code should only be accepted once")
+	}
+	if num, _ := datamapper.getBackupCodeCount(user.ID); num != numBackupCodes-1 {
+		t.Error("One code should be used up")
+	}
+}
+
+func TestUseTOTPStep(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := datamapper.useTOTPStep(user.ID, 100); !ok {
+		t.Fatal("Step should be accepted")
+	}
+	if ok, _ := datamapper.useTOTPStep(user.ID, 100); ok {
+		t.Error("Step should only be accepted once")
+	}
+	if ok, _ := datamapper.useTOTPStep(user.ID, 99); ok {
+		t.Error("Earlier step should not be accepted")
+	}
+}
+
+func TestLoginThrottles(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	now := time.Now()
+	for i := int64(1); i <= 3; i++ {
+		failures, err := datamapper.addThrottleFailure("account:1", now, now.Add(-throttleWindow))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != i {
+			t.Error("Failures should be counted:", failures)
+		}
+	}
+
+	later := now.Add(throttleWindow * 2)
+	if failures, _ := datamapper.addThrottleFailure("account:1", later, later.Add(-throttleWindow)); failures != 1 {
+		t.Error("Old failures should be forgotten")
+	}
+
+	if err := datamapper.blockThrottle("account:1", later); err != nil {
+		t.Fatal(err)
+	}
+	if th, _ := datamapper.getThrottle("account:1"); !th.BlockedUntil.Valid {
+		t.Error("Key should be blocked")
+	}
+
+	if err := datamapper.clearThrottle("account:1"); err != nil {
+		t.Fatal(err)
+	}
+	if th, _ := datamapper.getThrottle("account:1"); th.Failures != 0 {
+		t.Error("Key should be cleared")
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	token, err := user.generateVerifyToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := datamapper.getUserByVerifyToken(token); !isErrSqlNoRows(err) {
+		t.Error("Only the token hash should be stored")
+	}
+
+	user, err = datamapper.getUserByVerifyToken(hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified || user.verifyTokenExpired(time.Now()) {
+		t.Error("New user should have an unexpired token")
+	}
+	if !user.verifyTokenExpired(time.Now().Add(time.Hour * (verificationExpiry + 1))) {
+		t.Error("Token should expire")
+	}
+
+	user.markVerified()
+	if err := datamapper.updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getUserByVerifyToken(hashToken(token)); !isErrSqlNoRows(err) {
+		t.Error("Token should be used up")
+	}
+
+	// a change of the verified address is confirmed from it first
+	user.PendingEmail = sql.NullString{String: "new@gmail.com", Valid: true}
+	token, err = user.generateChangeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := datamapper.updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	user, err = datamapper.getUserByEmailChangeToken(hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "tester@gmail.com" || user.VerifyToken.Valid {
+		t.Error("Address should not be changed until confirmed:", user.Email)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	user := &user{Name: "tester", Email: "tester@gmail.com", Password: "test"}
+	if err := datamapper.createUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := user.generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.RecoveryCode.String == code {
+		t.Error("Recovery code should be hashed")
+	}
+	if err := datamapper.updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err = datamapper.getUserByRecoveryCode(hashToken(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.recoveryCodeExpired(time.Now(), 60) {
+		t.Error("Recovery code should not have expired yet")
+	}
+	if !user.recoveryCodeExpired(time.Now().Add(time.Minute*61), 60) {
+		t.Error("Recovery code should expire")
+	}
+
+	user.resetRecoveryCode()
+	if err := datamapper.updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getUserByRecoveryCode(hashToken(code)); !isErrSqlNoRows(err) {
+		t.Error("Recovery code should only be used once")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	for _, removePhotos := range []bool{false, true} {
+
+		owner := &user{Name: fmt.Sprintf("owner-%v", removePhotos), Email: "owner@gmail.com", Password: "test"}
+		if err := datamapper.createUser(owner); err != nil {
+			t.Fatal(err)
+		}
+		photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg"}
+		if err := datamapper.createPhoto(photo); err != nil {
+			t.Fatal(err)
+		}
+		export := &dataExport{UserID: owner.ID, Status: exportPending, CreatedAt: time.Now()}
+		if err := datamapper.createExport(export); err != nil {
+			t.Fatal(err)
+		}
+
+		filenames, err := datamapper.deleteUser(owner.ID, removePhotos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := datamapper.getActiveUser(owner.ID); !isErrSqlNoRows(err) {
+			t.Error("Deleted user should not be active")
+		}
+		if exports, _ := datamapper.getExports(owner.ID); len(exports) != 0 {
+			t.Error("Deleted user's exports should be removed")
+		}
+
+		_, err = datamapper.getPhoto(photo.ID)
+		if removePhotos {
+			if !isErrSqlNoRows(err) {
+				t.Error("Photo should be removed")
+			}
+			if len(filenames) != 1 || filenames[0] != photo.Filename {
+				t.Error("Removed photo's file should be returned:", filenames)
+			}
+		} else if err != nil {
+			t.Error("Photo should be kept:", err)
+		}
+	}
+}
+
+func TestDataExports(t *testing.T) {
+
+	cfg, _ := newConfig()
+	tdb := makeTestDB(cfg)
+	defer tdb.clean()
+
+	datamapper, _ := newDataMapper(tdb.dbMap.Db, false)
+
+	owner := &user{Name: "owner", Email: "owner@gmail.com", Password: "test"}
+	if err := datamapper.createUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	photo := &photo{Title: "test", OwnerID: owner.ID, Filename: "test.jpg", Tags: []string{"beach"}}
+	if err := datamapper.createPhoto(photo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.registerVote(photo, owner, upVote); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := datamapper.getUserData(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Photos) != 1 || len(data.Photos[0].Tags) != 1 || data.Photos[0].File != "photos/test.jpg" {
+		t.Error("Photo and its tags should be exported:", data.Photos)
+	}
+	if len(data.Votes) != 1 || data.Votes[0].Direction != upVote {
+		t.Error("Vote should be exported:", data.Votes)
+	}
+
+	export := &dataExport{UserID: owner.ID, Status: exportPending, BaseURL: "http://localhost", CreatedAt: time.Now()}
+	if err := datamapper.createExport(export); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := datamapper.getPendingExports(); len(pending) != 1 {
+		t.Error("Export should be pending")
+	}
+
+	export.Status = exportReady
+	export.TokenHash = sql.NullString{String: hashToken("token"), Valid: true}
+	export.ExpiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, exportExpiry), Valid: true}
+	if err := datamapper.updateExport(export); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getExportByToken(hashToken("token")); err != nil {
+		t.Error("Ready export should be found by its token:", err)
+	}
+
+	owner.IsActive = false
+	if err := datamapper.updateUser(owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datamapper.getExportByToken(hashToken("token")); !isErrSqlNoRows(err) {
+		t.Error("Export of an inactive user should not be found:", err)
+	}
+
+	expired, err := datamapper.getExpiredExports(time.Now().AddDate(0, 0, exportExpiry+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 {
+		t.Error("Export should expire")
 	}
 }
@@ -0,0 +1,24 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos ADD COLUMN comments_enabled boolean DEFAULT true;
+
+CREATE TABLE comments (
+    id serial PRIMARY KEY,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    owner_id integer NOT NULL REFERENCES users(id),
+    parent_id integer NULL REFERENCES comments(id) ON DELETE CASCADE,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    body text
+);
+
+CREATE INDEX idx_comments_photo_id ON comments (photo_id, created_at);
+CREATE INDEX idx_comments_parent_id ON comments (parent_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE comments;
+ALTER TABLE photos DROP COLUMN comments_enabled;
@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE favorites (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (user_id, photo_id)
+);
+
+CREATE INDEX idx_favorites_photo_id ON favorites (photo_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE favorites;
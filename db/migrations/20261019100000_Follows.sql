@@ -0,0 +1,28 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE follows (
+    follower_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    followee_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (follower_id, followee_id)
+);
+
+CREATE INDEX idx_follows_followee_id ON follows (followee_id);
+
+CREATE TABLE tag_follows (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    tag_id bigint NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (user_id, tag_id)
+);
+
+CREATE INDEX idx_photos_owner_id_created_at ON photos (owner_id, created_at DESC);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_photos_owner_id_created_at;
+DROP TABLE tag_follows;
+DROP TABLE follows;
@@ -0,0 +1,73 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE votes (
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    photo_id integer NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    direction smallint NOT NULL CHECK (direction IN (-1, 1)),
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (user_id, photo_id)
+);
+
+CREATE INDEX idx_votes_photo_id ON votes (photo_id);
+
+-- The old array did not record the vote direction, so we infer it from the
+-- photo counters where unambiguous and assume an up vote otherwise. The
+-- counters are then recomputed from the votes, so they match from now on.
+
+INSERT INTO votes (user_id, photo_id, direction)
+SELECT DISTINCT uv.user_id, p.id,
+    CASE WHEN p.up_votes = 0 AND p.down_votes > 0 THEN -1 ELSE 1 END
+FROM (SELECT id AS user_id, unnest(votes) AS photo_id FROM users) uv
+JOIN photos p ON p.id = uv.photo_id;
+
+UPDATE photos p SET
+    up_votes = COALESCE(v.up_votes, 0),
+    down_votes = COALESCE(v.down_votes, 0)
+FROM photos p2 LEFT JOIN (
+    SELECT photo_id,
+        count(*) FILTER (WHERE direction > 0) AS up_votes,
+        count(*) FILTER (WHERE direction < 0) AS down_votes
+    FROM votes GROUP BY photo_id
+) v ON v.photo_id = p2.id
+WHERE p2.id = p.id;
+
+ALTER TABLE users DROP COLUMN votes;
+
+-- +goose StatementBegin
+CREATE FUNCTION update_vote_counts() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF (TG_OP = 'DELETE' OR TG_OP = 'UPDATE') THEN
+    UPDATE photos SET
+        up_votes = up_votes - (CASE WHEN OLD.direction > 0 THEN 1 ELSE 0 END),
+        down_votes = down_votes - (CASE WHEN OLD.direction < 0 THEN 1 ELSE 0 END)
+    WHERE id = OLD.photo_id;
+END IF;
+IF (TG_OP = 'INSERT' OR TG_OP = 'UPDATE') THEN
+    UPDATE photos SET
+        up_votes = up_votes + (CASE WHEN NEW.direction > 0 THEN 1 ELSE 0 END),
+        down_votes = down_votes + (CASE WHEN NEW.direction < 0 THEN 1 ELSE 0 END)
+    WHERE id = NEW.photo_id;
+END IF;
+RETURN NULL;
+END;$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER votes_update_counts
+    AFTER INSERT OR UPDATE OR DELETE ON votes
+    FOR EACH ROW EXECUTE PROCEDURE update_vote_counts();
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users ADD COLUMN votes int[] DEFAULT '{}';
+
+UPDATE users u SET votes = v.photo_ids
+FROM (SELECT user_id, array_agg(photo_id) AS photo_ids FROM votes GROUP BY user_id) v
+WHERE v.user_id = u.id;
+
+DROP TRIGGER votes_update_counts ON votes;
+DROP FUNCTION update_vote_counts();
+DROP TABLE votes;
@@ -0,0 +1,98 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos
+	ADD COLUMN hot_score double precision NOT NULL DEFAULT 0,
+	ADD COLUMN wilson_score double precision NOT NULL DEFAULT 0,
+	ADD COLUMN controversy_score double precision NOT NULL DEFAULT 0,
+	ADD COLUMN trending_score double precision NOT NULL DEFAULT 0;
+
+-- net score on a log scale plus a constant boost for newer photos, so that
+-- a photo needs ten times the votes to outrank one posted 12.5 hours later
+
+-- +goose StatementBegin
+CREATE FUNCTION hot_score(ups integer, downs integer, created timestamp with time zone) RETURNS double precision
+    LANGUAGE sql IMMUTABLE
+    AS $_$SELECT sign($1 - $2)::double precision * log(greatest(abs($1 - $2), 1)::double precision) +
+    extract(epoch FROM COALESCE($3, 'epoch'::timestamptz))::double precision / 45000$_$;
+-- +goose StatementEnd
+
+-- lower bound of the Wilson score interval at 95% confidence
+
+-- +goose StatementBegin
+CREATE FUNCTION wilson_score(ups integer, downs integer) RETURNS double precision
+    LANGUAGE sql IMMUTABLE
+    AS $_$SELECT CASE WHEN $1 + $2 = 0 THEN 0 ELSE
+    (($1::double precision / ($1 + $2)) + 1.9208 / ($1 + $2) -
+    1.96 * sqrt(((($1::double precision * $2) / ($1 + $2)) / ($1 + $2) + 0.9604 / ($1 + $2)) / ($1 + $2))) /
+    (1 + 3.8416 / ($1 + $2)) END$_$;
+-- +goose StatementEnd
+
+-- high when there are many votes split evenly between up and down
+
+-- +goose StatementBegin
+CREATE FUNCTION controversy_score(ups integer, downs integer) RETURNS double precision
+    LANGUAGE sql IMMUTABLE
+    AS $_$SELECT CASE WHEN $1 <= 0 OR $2 <= 0 THEN 0 ELSE
+    power(($1 + $2)::double precision, least($1, $2)::double precision / greatest($1, $2)) END$_$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION update_photo_scores() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+NEW.hot_score := hot_score(NEW.up_votes, NEW.down_votes, NEW.created_at);
+NEW.wilson_score := wilson_score(NEW.up_votes, NEW.down_votes);
+NEW.controversy_score := controversy_score(NEW.up_votes, NEW.down_votes);
+RETURN NEW;
+END;$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER photos_update_scores
+    BEFORE INSERT OR UPDATE OF up_votes, down_votes, created_at ON photos
+    FOR EACH ROW EXECUTE PROCEDURE update_photo_scores();
+
+-- trending scores depend on the current time, so are refreshed periodically by the server
+
+-- +goose StatementBegin
+CREATE FUNCTION refresh_trending_scores() RETURNS void
+    LANGUAGE sql
+    AS $$
+UPDATE photos p SET trending_score = 0
+WHERE p.trending_score <> 0 AND NOT EXISTS (
+    SELECT 1 FROM votes v WHERE v.photo_id = p.id AND v.created_at > now() - interval '7 days');
+UPDATE photos p SET trending_score = t.score
+FROM (SELECT photo_id, SUM(direction) AS score FROM votes
+    WHERE created_at > now() - interval '7 days' GROUP BY photo_id) t
+WHERE t.photo_id = p.id AND p.trending_score <> t.score;
+$$;
+-- +goose StatementEnd
+
+UPDATE photos SET
+	hot_score = hot_score(up_votes, down_votes, created_at),
+	wilson_score = wilson_score(up_votes, down_votes),
+	controversy_score = controversy_score(up_votes, down_votes);
+
+SELECT refresh_trending_scores();
+
+CREATE INDEX idx_photos_hot_score ON photos (hot_score DESC);
+CREATE INDEX idx_photos_wilson_score ON photos (wilson_score DESC);
+CREATE INDEX idx_photos_controversy_score ON photos (controversy_score DESC);
+CREATE INDEX idx_photos_trending_score ON photos (trending_score DESC);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TRIGGER photos_update_scores ON photos;
+DROP FUNCTION update_photo_scores();
+DROP FUNCTION refresh_trending_scores();
+DROP FUNCTION controversy_score(integer, integer);
+DROP FUNCTION wilson_score(integer, integer);
+DROP FUNCTION hot_score(integer, integer, timestamp with time zone);
+
+ALTER TABLE photos
+	DROP COLUMN hot_score,
+	DROP COLUMN wilson_score,
+	DROP COLUMN controversy_score,
+	DROP COLUMN trending_score;
@@ -0,0 +1,101 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE photo_search (
+    photo_id integer PRIMARY KEY REFERENCES photos(id) ON DELETE CASCADE,
+    document tsvector
+);
+
+CREATE INDEX idx_photo_search_document ON photo_search USING gin (document);
+
+-- rebuilds the search document for a photo from its title, tags and owner name
+
+-- +goose StatementBegin
+CREATE FUNCTION refresh_photo_search(pid bigint) RETURNS void
+    LANGUAGE sql
+    AS $_$
+INSERT INTO photo_search (photo_id, document)
+SELECT p.id,
+    setweight(to_tsvector('english', COALESCE(p.title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE((
+        SELECT string_agg(t.name, ' ') FROM photo_tags pt
+        JOIN tags t ON t.id = pt.tag_id WHERE pt.photo_id = p.id), '')), 'B') ||
+    setweight(to_tsvector('simple', COALESCE(u.name, '')), 'C')
+FROM photos p JOIN users u ON u.id = p.owner_id
+WHERE p.id = $1
+ON CONFLICT (photo_id) DO UPDATE SET document = EXCLUDED.document;
+$_$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION photos_refresh_search() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+PERFORM refresh_photo_search(NEW.id);
+RETURN NULL;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION photo_tags_refresh_search() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+IF (TG_OP = 'DELETE') THEN
+    PERFORM refresh_photo_search(OLD.photo_id);
+ELSE
+    PERFORM refresh_photo_search(NEW.photo_id);
+END IF;
+RETURN NULL;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION tags_refresh_search() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+PERFORM refresh_photo_search(photo_id) FROM photo_tags WHERE tag_id = NEW.id;
+RETURN NULL;
+END;$$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION users_refresh_search() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$BEGIN
+PERFORM refresh_photo_search(id) FROM photos WHERE owner_id = NEW.id;
+RETURN NULL;
+END;$$;
+-- +goose StatementEnd
+
+CREATE TRIGGER photos_refresh_search
+    AFTER INSERT OR UPDATE OF title, owner_id ON photos
+    FOR EACH ROW EXECUTE PROCEDURE photos_refresh_search();
+
+CREATE TRIGGER photo_tags_refresh_search
+    AFTER INSERT OR UPDATE OR DELETE ON photo_tags
+    FOR EACH ROW EXECUTE PROCEDURE photo_tags_refresh_search();
+
+CREATE TRIGGER tags_refresh_search
+    AFTER UPDATE OF name ON tags
+    FOR EACH ROW EXECUTE PROCEDURE tags_refresh_search();
+
+CREATE TRIGGER users_refresh_search
+    AFTER UPDATE OF name ON users
+    FOR EACH ROW EXECUTE PROCEDURE users_refresh_search();
+
+SELECT refresh_photo_search(id) FROM photos;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TRIGGER users_refresh_search ON users;
+DROP TRIGGER tags_refresh_search ON tags;
+DROP TRIGGER photo_tags_refresh_search ON photo_tags;
+DROP TRIGGER photos_refresh_search ON photos;
+DROP FUNCTION users_refresh_search();
+DROP FUNCTION tags_refresh_search();
+DROP FUNCTION photo_tags_refresh_search();
+DROP FUNCTION photos_refresh_search();
+DROP FUNCTION refresh_photo_search(bigint);
+DROP TABLE photo_search;
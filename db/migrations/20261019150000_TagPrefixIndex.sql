@@ -0,0 +1,12 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE INDEX idx_tags_name_prefix ON tags (name text_pattern_ops);
+CREATE INDEX idx_photo_tags_tag_id ON photo_tags (tag_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_tags_name_prefix;
+DROP INDEX idx_photo_tags_tag_id;
@@ -0,0 +1,19 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE tag_synonyms (
+    name text PRIMARY KEY,
+    tag_id bigint NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE TABLE tag_blocklist (
+    name text PRIMARY KEY,
+    created_at timestamp with time zone DEFAULT now()
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE tag_blocklist;
+DROP TABLE tag_synonyms;
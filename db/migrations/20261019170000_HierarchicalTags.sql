@@ -0,0 +1,138 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- tag names are full paths, e.g. travel/japan/kyoto, with parent travel/japan
+
+ALTER TABLE tags ADD COLUMN parent_id bigint REFERENCES tags(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_tags_parent_id ON tags (parent_id);
+
+-- creates the tag and any missing ancestors, returning the tag id
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE plpgsql
+    AS $$DECLARE
+tid BIGINT;
+pid BIGINT;
+sep INTEGER;
+BEGIN
+sep := length(name) - position('/' in reverse(name)) + 1;
+IF position('/' in name) > 1 AND sep < length(name) THEN
+    pid := add_tag(left(name, sep - 1)::character varying);
+END IF;
+SELECT t.id INTO tid FROM tags t WHERE t.name = add_tag.name;
+IF tid IS NULL THEN
+    INSERT INTO tags (name, parent_id) VALUES (add_tag.name, pid) RETURNING id INTO tid;
+ELSIF pid IS NOT NULL THEN
+    UPDATE tags SET parent_id = pid WHERE id = tid AND parent_id IS DISTINCT FROM pid;
+END IF;
+RETURN tid;
+END;$$;
+-- +goose StatementEnd
+
+-- existing names with slashes are cleaned up the way new tags are: empty and
+-- surrounding levels dropped, e.g. "/Travel//japan/" becomes "travel/japan".
+-- A name that is already taken is merged into that tag.
+
+-- +goose StatementBegin
+DO $$DECLARE
+r RECORD;
+clean character varying;
+tid BIGINT;
+BEGIN
+FOR r IN SELECT id, name FROM tags WHERE position('/' in name) > 0 LOOP
+    clean := array_to_string(ARRAY(
+        SELECT trim(l.level) FROM unnest(string_to_array(lower(r.name), '/')) WITH ORDINALITY AS l(level, n)
+        WHERE trim(l.level) <> '' ORDER BY l.n), '/');
+    CONTINUE WHEN clean = r.name;
+    tid := NULL;
+    IF clean <> '' THEN
+        SELECT t.id INTO tid FROM tags t WHERE t.name = clean;
+        IF tid IS NULL THEN
+            UPDATE tags SET name = clean WHERE id = r.id;
+            CONTINUE;
+        END IF;
+        INSERT INTO photo_tags (photo_id, tag_id) SELECT photo_id, tid FROM photo_tags
+            WHERE tag_id = r.id AND photo_id NOT IN (SELECT photo_id FROM photo_tags WHERE tag_id = tid);
+        INSERT INTO tag_follows (user_id, tag_id) SELECT user_id, tid FROM tag_follows
+            WHERE tag_id = r.id AND user_id NOT IN (SELECT user_id FROM tag_follows WHERE tag_id = tid);
+        UPDATE tag_synonyms SET tag_id = tid WHERE tag_id = r.id;
+    END IF;
+    -- merged, or nothing but slashes
+    DELETE FROM photo_tags WHERE tag_id = r.id;
+    DELETE FROM tags WHERE id = r.id;
+END LOOP;
+END;$$;
+-- +goose StatementEnd
+
+SELECT add_tag(name) FROM tags WHERE position('/' in name) > 0;
+
+-- path separators are indexed as spaces so each level is searchable
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION refresh_photo_search(pid bigint) RETURNS void
+    LANGUAGE sql
+    AS $_$
+INSERT INTO photo_search (photo_id, document)
+SELECT p.id,
+    setweight(to_tsvector('english', COALESCE(p.title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE((
+        SELECT string_agg(replace(t.name, '/', ' '), ' ') FROM photo_tags pt
+        JOIN tags t ON t.id = pt.tag_id WHERE pt.photo_id = p.id), '')), 'B') ||
+    setweight(to_tsvector('simple', COALESCE(u.name, '')), 'C')
+FROM photos p JOIN users u ON u.id = p.owner_id
+WHERE p.id = $1
+ON CONFLICT (photo_id) DO UPDATE SET document = EXCLUDED.document;
+$_$;
+-- +goose StatementEnd
+
+SELECT refresh_photo_search(pt.photo_id) FROM photo_tags pt
+    JOIN tags t ON t.id = pt.tag_id WHERE position('/' in t.name) > 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION refresh_photo_search(pid bigint) RETURNS void
+    LANGUAGE sql
+    AS $_$
+INSERT INTO photo_search (photo_id, document)
+SELECT p.id,
+    setweight(to_tsvector('english', COALESCE(p.title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE((
+        SELECT string_agg(t.name, ' ') FROM photo_tags pt
+        JOIN tags t ON t.id = pt.tag_id WHERE pt.photo_id = p.id), '')), 'B') ||
+    setweight(to_tsvector('simple', COALESCE(u.name, '')), 'C')
+FROM photos p JOIN users u ON u.id = p.owner_id
+WHERE p.id = $1
+ON CONFLICT (photo_id) DO UPDATE SET document = EXCLUDED.document;
+$_$;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION add_tag(name character varying) RETURNS bigint
+    LANGUAGE sql
+    AS $_$WITH s AS (
+    SELECT id
+    FROM tags
+    WHERE name=$1
+ ), i AS (
+INSERT INTO tags (name)
+SELECT $1
+WHERE NOT EXISTS (
+    (SELECT 1 FROM s)
+    )
+    RETURNING id
+    )
+    SELECT id
+    FROM i
+    UNION ALL
+    SELECT id
+    FROM s;
+$_$;
+-- +goose StatementEnd
+
+DROP INDEX idx_tags_parent_id;
+ALTER TABLE tags DROP COLUMN parent_id;
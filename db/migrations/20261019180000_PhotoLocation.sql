@@ -0,0 +1,34 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE photos
+    ADD COLUMN latitude double precision,
+    ADD COLUMN longitude double precision,
+    ADD COLUMN show_location boolean NOT NULL DEFAULT false;
+
+CREATE INDEX idx_photos_location ON photos (latitude, longitude)
+    WHERE show_location AND latitude IS NOT NULL;
+
+-- great-circle distance in kilometres (haversine formula)
+
+-- +goose StatementBegin
+CREATE FUNCTION distance_km(lat1 double precision, lng1 double precision,
+        lat2 double precision, lng2 double precision) RETURNS double precision
+    LANGUAGE sql IMMUTABLE
+    AS $_$
+SELECT 2 * 6371 * asin(sqrt(
+    power(sin(radians($3 - $1) / 2), 2) +
+    cos(radians($1)) * cos(radians($3)) * power(sin(radians($4 - $2) / 2), 2)));
+$_$;
+-- +goose StatementEnd
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP FUNCTION distance_km(double precision, double precision, double precision, double precision);
+DROP INDEX idx_photos_location;
+ALTER TABLE photos
+    DROP COLUMN latitude,
+    DROP COLUMN longitude,
+    DROP COLUMN show_location;
@@ -0,0 +1,14 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- camera wall clock time from EXIF, without a time zone
+ALTER TABLE photos ADD COLUMN taken_at timestamp without time zone;
+
+CREATE INDEX idx_photos_capture_date ON photos ((COALESCE(taken_at, created_at AT TIME ZONE 'UTC')) DESC, id DESC);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_photos_capture_date;
+ALTER TABLE photos DROP COLUMN taken_at;
@@ -0,0 +1,53 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- photos in the trash have deleted_at set until they are purged
+ALTER TABLE photos ADD COLUMN deleted_at timestamp with time zone;
+
+CREATE INDEX idx_photos_deleted_at ON photos (owner_id, deleted_at DESC) WHERE deleted_at IS NOT NULL;
+
+CREATE OR REPLACE VIEW tag_counts AS
+ SELECT t.id, t.name, ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON p.id = pt.photo_id
+     WHERE t.id = pt.tag_id AND p.deleted_at IS NULL) AS num_photos, ( SELECT p.photo
+           FROM photos p
+      JOIN photo_tags pt ON pt.photo_id = p.id
+     WHERE pt.tag_id = t.id AND p.deleted_at IS NULL
+     ORDER BY (p.up_votes - p.down_votes) DESC, p.created_at DESC
+    LIMIT 1) AS photo
+   FROM tags t
+  GROUP BY t.id
+ HAVING (( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON p.id = pt.photo_id
+     WHERE t.id = pt.tag_id AND p.deleted_at IS NULL)) > 0
+  ORDER BY ( SELECT count(*) AS count
+           FROM photo_tags pt
+      JOIN photos p ON p.id = pt.photo_id
+     WHERE t.id = pt.tag_id AND p.deleted_at IS NULL) DESC;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+CREATE OR REPLACE VIEW tag_counts AS
+ SELECT t.id, t.name, ( SELECT count(*) AS count
+           FROM photo_tags pt
+          WHERE t.id = pt.tag_id) AS num_photos, ( SELECT p.photo
+           FROM photos p
+      JOIN photo_tags pt ON pt.photo_id = p.id
+     WHERE pt.tag_id = t.id
+     ORDER BY (p.up_votes - p.down_votes) DESC, p.created_at DESC
+    LIMIT 1) AS photo
+   FROM tags t
+  GROUP BY t.id
+ HAVING (( SELECT count(*) AS count
+           FROM photo_tags pt
+          WHERE t.id = pt.tag_id)) > 0
+  ORDER BY ( SELECT count(*) AS count
+           FROM photo_tags pt
+          WHERE t.id = pt.tag_id) DESC;
+
+DROP INDEX idx_photos_deleted_at;
+ALTER TABLE photos DROP COLUMN deleted_at;
@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- accounts at external OAuth2/OpenID Connect providers used to log in
+CREATE TABLE user_identities (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider text NOT NULL,
+    provider_user_id text NOT NULL,
+    email text NOT NULL DEFAULT '',
+    created_at timestamp with time zone NOT NULL,
+    UNIQUE (provider, provider_user_id)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities (user_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE user_identities;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- recent failed attempts per account or IP address, e.g. "account:12" or "login-ip:10.0.0.1"
+CREATE TABLE login_throttles (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp with time zone NOT NULL,
+    blocked_until timestamp with time zone
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE login_throttles;
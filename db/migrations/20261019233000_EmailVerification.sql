@@ -0,0 +1,22 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- existing users are trusted; new ones verify their address with the token
+-- emailed to them, of which only the hash is stored
+ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN verification_token text;
+ALTER TABLE users ADD COLUMN verification_sent_at timestamp with time zone;
+
+UPDATE users SET email_verified = true;
+
+CREATE UNIQUE INDEX idx_users_verification_token ON users (verification_token);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_users_verification_token;
+
+ALTER TABLE users DROP COLUMN verification_sent_at;
+ALTER TABLE users DROP COLUMN verification_token;
+ALTER TABLE users DROP COLUMN email_verified;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- recovery codes are now stored as hashes and expire, so outstanding
+-- plaintext codes are dropped; users can request new ones
+ALTER TABLE users ADD COLUMN recovery_code_created_at timestamp with time zone;
+
+UPDATE users SET recovery_code = NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+UPDATE users SET recovery_code = NULL;
+
+ALTER TABLE users DROP COLUMN recovery_code_created_at;
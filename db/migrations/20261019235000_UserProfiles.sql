@@ -0,0 +1,21 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN website text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar text NOT NULL DEFAULT '';
+
+-- the new address of an email change, until it's confirmed with the
+-- verification token
+ALTER TABLE users ADD COLUMN pending_email text;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE users DROP COLUMN pending_email;
+ALTER TABLE users DROP COLUMN avatar;
+ALTER TABLE users DROP COLUMN website;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
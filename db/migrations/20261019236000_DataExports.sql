@@ -0,0 +1,25 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- archives of a user's data, built in the background; the download link
+-- carries a token of which only the hash is stored
+CREATE TABLE data_exports (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    base_url text NOT NULL,
+    filename text NOT NULL DEFAULT '',
+    token_hash text,
+    created_at timestamp with time zone NOT NULL,
+    completed_at timestamp with time zone,
+    expires_at timestamp with time zone
+);
+
+CREATE INDEX idx_data_exports_user_id ON data_exports (user_id);
+CREATE UNIQUE INDEX idx_data_exports_token_hash ON data_exports (token_hash);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE data_exports;
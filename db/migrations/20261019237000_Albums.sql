@@ -0,0 +1,24 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE albums (
+    id serial PRIMARY KEY,
+    owner_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name character varying(100) NOT NULL,
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX idx_albums_owner_id ON albums (owner_id);
+
+-- a photo is in at most one album, of its owner's
+ALTER TABLE photos ADD COLUMN album_id integer REFERENCES albums(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_photos_album_id ON photos (album_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_photos_album_id;
+ALTER TABLE photos DROP COLUMN album_id;
+DROP TABLE albums;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- a change of a verified address must be confirmed from the current address
+-- first, with the token emailed to it; only its hash is stored
+ALTER TABLE users ADD COLUMN email_change_token text;
+
+CREATE UNIQUE INDEX idx_users_email_change_token ON users (email_change_token);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP INDEX idx_users_email_change_token;
+
+ALTER TABLE users DROP COLUMN email_change_token;
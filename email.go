@@ -10,6 +10,7 @@ import (
 	"path"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type message struct {
@@ -141,10 +142,38 @@ func (m *mailer) sendResetPasswordMail(user *user, recoveryCode string, r *http.
 		&struct {
 			Name         string
 			RecoveryCode string
+			ExpiresIn    int
 			URL          string
 		}{
 			user.Name,
 			recoveryCode,
+			m.cfg.RecoveryCodeExpiry,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendPasswordChangedMail(user *user, tokensRevoked int64, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Your password has been changed",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"password_changed",
+		&struct {
+			Name          string
+			TokensRevoked int64
+			IPAddress     string
+			ChangedAt     string
+			URL           string
+		}{
+			user.Name,
+			tokensRevoked,
+			getRemoteIP(r),
+			time.Now().UTC().Format("2006-01-02 15:04 MST"),
 			getBaseURL(r),
 		},
 	)
@@ -167,3 +196,124 @@ func (m *mailer) sendWelcomeMail(user *user) error {
 	}
 	return m.send(msg)
 }
+
+func (m *mailer) sendAccountLockedMail(user *user, until time.Time, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Your account has been locked",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"account_locked",
+		&struct {
+			Name      string
+			IPAddress string
+			Until     string
+			URL       string
+		}{
+			user.Name,
+			getRemoteIP(r),
+			until.UTC().Format("2006-01-02 15:04 MST"),
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendVerificationMail(user *user, token string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Please verify your email address",
+		[]string{user.addressToVerify()},
+		m.defaultFromAddress,
+		"verify_email",
+		&struct {
+			Name      string
+			Email     string
+			Token     string
+			ExpiresIn int
+			URL       string
+		}{
+			user.Name,
+			user.addressToVerify(),
+			token,
+			verificationExpiry,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+// asks the user at their current address to confirm or cancel a change to another one
+func (m *mailer) sendEmailChangeMail(user *user, token string, r *http.Request) error {
+	msg, err := m.messageFromTemplate(
+		"Your email address is being changed",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"email_change",
+		&struct {
+			Name      string
+			NewEmail  string
+			Token     string
+			ExpiresIn int
+			URL       string
+		}{
+			user.Name,
+			user.PendingEmail.String,
+			token,
+			verificationExpiry,
+			getBaseURL(r),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendAccountDeletedMail(name, email string, photosRemoved bool) error {
+	msg, err := m.messageFromTemplate(
+		"Your account has been deleted",
+		[]string{email},
+		m.defaultFromAddress,
+		"account_deleted",
+		&struct {
+			Name          string
+			PhotosRemoved bool
+		}{
+			name,
+			photosRemoved,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
+
+func (m *mailer) sendExportReadyMail(user *user, baseURL, token string) error {
+	msg, err := m.messageFromTemplate(
+		"Your data archive is ready",
+		[]string{user.Email},
+		m.defaultFromAddress,
+		"export_ready",
+		&struct {
+			Name      string
+			Token     string
+			ExpiresIn int
+			URL       string
+		}{
+			user.Name,
+			token,
+			exportExpiry,
+			baseURL,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return m.send(msg)
+}
@@ -0,0 +1,381 @@
+package photoshare
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// minimal EXIF reader for JPEG files: we only need a handful of tags
+
+const (
+	exifTagMake        = 0x010f
+	exifTagModel       = 0x0110
+	exifTagGPSPointer  = 0x8825
+	exifTagExifPointer = 0x8769
+
+	// tags in the Exif IFD
+	exifTagDateTimeOriginal = 0x9003
+
+	// tags in the GPS IFD
+	gpsTagLatitudeRef  = 0x0001
+	gpsTagLatitude     = 0x0002
+	gpsTagLongitudeRef = 0x0003
+	gpsTagLongitude    = 0x0004
+
+	exifTypeASCII    = 2
+	exifTypeLong     = 4
+	exifTypeRational = 5
+)
+
+var errNoExif = errors.New("no EXIF data found")
+
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+type exifData struct {
+	Camera string
+
+	// local time the photo was taken, zero if unknown
+	TakenAt time.Time
+
+	// GPS position in decimal degrees, if HasLocation
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+}
+
+type exifEntry struct {
+	typ    uint16
+	count  uint32
+	offset uint32 // value is stored inline if it fits into 4 bytes
+	inline []byte
+}
+
+// a TIFF structure found in the APP1 segment
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// reads EXIF data from a JPEG image, returns errNoExif if none present
+func readExif(r io.Reader) (*exifData, error) {
+	tiff, err := findExifSegment(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	x := &exifReader{data: tiff}
+
+	switch string(tiff[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return nil, errNoExif
+	}
+
+	ifd0, err := x.readIFD(x.order.Uint32(tiff[4:8]))
+	if err != nil {
+		return nil, err
+	}
+
+	maker := x.getString(ifd0, exifTagMake)
+	model := x.getString(ifd0, exifTagModel)
+
+	info := &exifData{}
+
+	// most models already start with the maker, e.g. "Canon EOS 5D"
+	if maker != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		info.Camera = strings.TrimSpace(maker + " " + model)
+	} else {
+		info.Camera = model
+	}
+
+	// a broken sub-IFD should not lose the rest of the data
+	if offset, ok := x.getLong(ifd0, exifTagExifPointer); ok {
+		if exif, err := x.readIFD(offset); err == nil {
+			// no time zone is recorded, so keep the camera's wall clock time as UTC
+			if t, err := time.Parse("2006:01:02 15:04:05", x.getString(exif, exifTagDateTimeOriginal)); err == nil {
+				info.TakenAt = t
+			}
+		}
+	}
+
+	if offset, ok := x.getLong(ifd0, exifTagGPSPointer); ok {
+		if gps, err := x.readIFD(offset); err == nil {
+			x.readLocation(gps, info)
+		}
+	}
+
+	return info, nil
+}
+
+func (x *exifReader) readLocation(gps map[uint16]exifEntry, info *exifData) {
+	lat, ok := x.getDegrees(gps, gpsTagLatitude)
+	if !ok {
+		return
+	}
+	lng, ok := x.getDegrees(gps, gpsTagLongitude)
+	if !ok {
+		return
+	}
+	if x.getString(gps, gpsTagLatitudeRef) == "S" {
+		lat = -lat
+	}
+	if x.getString(gps, gpsTagLongitudeRef) == "W" {
+		lng = -lng
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return
+	}
+	info.HasLocation = true
+	info.Latitude = lat
+	info.Longitude = lng
+}
+
+// scans the JPEG markers for the APP1 Exif segment and returns its TIFF data
+func findExifSegment(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, errNoExif
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, errNoExif
+		}
+		if hdr[0] != 0xff {
+			return nil, errNoExif
+		}
+		marker := hdr[1]
+
+		// start of scan: image data follows, no more metadata
+		if marker == 0xda || marker == 0xd9 {
+			return nil, errNoExif
+		}
+
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if size < 0 {
+			return nil, errNoExif
+		}
+
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			tiff := segment[6:]
+			if len(tiff) < 8 {
+				return nil, errNoExif
+			}
+			return tiff, nil
+		}
+	}
+}
+
+func (x *exifReader) readIFD(offset uint32) (map[uint16]exifEntry, error) {
+	if int(offset)+2 > len(x.data) {
+		return nil, errNoExif
+	}
+
+	num := int(x.order.Uint16(x.data[offset:]))
+	entries := make(map[uint16]exifEntry, num)
+
+	pos := int(offset) + 2
+	for i := 0; i < num; i++ {
+		if pos+12 > len(x.data) {
+			return nil, errNoExif
+		}
+		b := x.data[pos : pos+12]
+		entries[x.order.Uint16(b[0:])] = exifEntry{
+			typ:    x.order.Uint16(b[2:]),
+			count:  x.order.Uint32(b[4:]),
+			offset: x.order.Uint32(b[8:]),
+			inline: b[8:12],
+		}
+		pos += 12
+	}
+	return entries, nil
+}
+
+// returns the raw bytes of an entry value
+func (x *exifReader) value(e exifEntry) []byte {
+	size, ok := exifTypeSizes[e.typ]
+	if !ok {
+		return nil
+	}
+	length := size * e.count
+	if length <= 4 {
+		return e.inline[:length]
+	}
+	if uint64(e.offset)+uint64(length) > uint64(len(x.data)) {
+		return nil
+	}
+	return x.data[e.offset : e.offset+length]
+}
+
+func (x *exifReader) getString(ifd map[uint16]exifEntry, tag uint16) string {
+	e, ok := ifd[tag]
+	if !ok || e.typ != exifTypeASCII {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(x.value(e)), "\x00"))
+}
+
+func (x *exifReader) getLong(ifd map[uint16]exifEntry, tag uint16) (uint32, bool) {
+	e, ok := ifd[tag]
+	if !ok || e.typ != exifTypeLong || e.count != 1 {
+		return 0, false
+	}
+	return x.order.Uint32(e.inline), true
+}
+
+// converts degrees, minutes and seconds, stored as three rationals, to decimal degrees
+func (x *exifReader) getDegrees(ifd map[uint16]exifEntry, tag uint16) (float64, bool) {
+	e, ok := ifd[tag]
+	if !ok || e.typ != exifTypeRational || e.count != 3 {
+		return 0, false
+	}
+	b := x.value(e)
+	if len(b) != 24 {
+		return 0, false
+	}
+	var degrees float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num := x.order.Uint32(b[i*8:])
+		denom := x.order.Uint32(b[i*8+4:])
+		if denom == 0 {
+			if num != 0 {
+				return 0, false
+			}
+			continue
+		}
+		degrees += float64(num) / float64(denom) / unit
+	}
+	return degrees, true
+}
+
+// copies an image without the metadata that may give away where it was taken
+// or by whom: the APP1 (EXIF, XMP) and APP13 (IPTC) segments of a JPEG, and
+// the eXIf and text chunks of a PNG. The image data itself is left untouched.
+// Note that this also drops the EXIF orientation.
+func stripMetadata(dst io.Writer, src io.Reader, contentType string) error {
+	switch contentType {
+	case "image/jpeg", "image/jpg":
+		return stripJPEGMetadata(dst, bufio.NewReader(src))
+	case "image/png":
+		return stripPNGMetadata(dst, bufio.NewReader(src))
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+var errInvalidImage = errors.New("invalid image")
+
+func stripJPEGMetadata(dst io.Writer, r *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errInvalidImage
+	}
+	if _, err := dst.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b != 0xff {
+			return errInvalidImage
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return errInvalidImage
+		}
+		// fill bytes before a marker
+		for marker == 0xff {
+			if marker, err = r.ReadByte(); err != nil {
+				return errInvalidImage
+			}
+		}
+
+		// start of scan: the rest is image data
+		if marker == 0xda || marker == 0xd9 {
+			if _, err := dst.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(dst, r)
+			return err
+		}
+
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return errInvalidImage
+		}
+		length := int64(binary.BigEndian.Uint16(size[:])) - 2
+		if length < 0 {
+			return errInvalidImage
+		}
+
+		if marker == 0xe1 || marker == 0xed {
+			if _, err := r.Discard(int(length)); err != nil {
+				return errInvalidImage
+			}
+			continue
+		}
+
+		if _, err := dst.Write([]byte{0xff, marker, size[0], size[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, r, length); err != nil {
+			return errInvalidImage
+		}
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG chunks that can carry EXIF or XMP metadata
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true}
+
+func stripPNGMetadata(dst io.Writer, r *bufio.Reader) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return errInvalidImage
+	}
+	if _, err := dst.Write(sig); err != nil {
+		return err
+	}
+
+	for {
+		var hdr [8]byte // length and type
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errInvalidImage
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4])) + 4 // and the CRC
+
+		if pngMetadataChunks[string(hdr[4:])] {
+			if _, err := r.Discard(int(length)); err != nil {
+				return errInvalidImage
+			}
+			continue
+		}
+
+		if _, err := dst.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, r, length); err != nil {
+			return errInvalidImage
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+type testIFDEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    uint32
+}
+
+func writeTestIFD(buf *bytes.Buffer, entries []testIFDEntry) {
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+}
+
+// builds a JPEG header with an EXIF segment containing only a GPS position
+func makeTestGPSJpeg(latRef, lngRef string, lat, lng [3]uint32) []byte {
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, binary.LittleEndian, uint16(42))
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+
+	// IFD0 at 8 (18 bytes), GPS IFD at 26 (54 bytes), rationals at 80 and 104
+	writeTestIFD(tiff, []testIFDEntry{{exifTagGPSPointer, exifTypeLong, 1, 26}})
+	writeTestIFD(tiff, []testIFDEntry{
+		{gpsTagLatitudeRef, exifTypeASCII, 2, uint32(latRef[0])},
+		{gpsTagLatitude, exifTypeRational, 3, 80},
+		{gpsTagLongitudeRef, exifTypeASCII, 2, uint32(lngRef[0])},
+		{gpsTagLongitude, exifTypeRational, 3, 104},
+	})
+	for _, values := range [][3]uint32{lat, lng} {
+		for _, v := range values {
+			binary.Write(tiff, binary.LittleEndian, [2]uint32{v, 1})
+		}
+	}
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	jpeg := &bytes.Buffer{}
+	jpeg.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+	binary.Write(jpeg, binary.BigEndian, uint16(len(segment)+2))
+	jpeg.Write(segment)
+	jpeg.Write([]byte{0xff, 0xda})
+	return jpeg.Bytes()
+}
+
+func TestReadExifLocation(t *testing.T) {
+	data := makeTestGPSJpeg("N", "W", [3]uint32{35, 0, 36}, [3]uint32{135, 45, 36})
+
+	info, err := readExif(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HasLocation {
+		t.Fatal("Location should be found")
+	}
+	if math.Abs(info.Latitude-35.01) > 1e-9 || math.Abs(info.Longitude+135.76) > 1e-9 {
+		t.Error("Unexpected location:", info.Latitude, info.Longitude)
+	}
+}
+
+func TestReadExifInvalidLocation(t *testing.T) {
+	data := makeTestGPSJpeg("N", "E", [3]uint32{95, 0, 0}, [3]uint32{10, 0, 0})
+
+	info, err := readExif(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.HasLocation {
+		t.Error("Latitude out of range should be ignored")
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	img := &bytes.Buffer{}
+	jpeg.Encode(img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	// the GPS segment followed by the encoded image, less its SOI marker
+	data := makeTestGPSJpeg("N", "W", [3]uint32{35, 0, 36}, [3]uint32{135, 45, 36})
+	data = append(data[:len(data)-2], img.Bytes()[2:]...)
+
+	stripped := &bytes.Buffer{}
+	if err := stripMetadata(stripped, bytes.NewReader(data), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readExif(bytes.NewReader(stripped.Bytes())); err != errNoExif {
+		t.Error("EXIF data should be removed")
+	}
+	if !bytes.Equal(stripped.Bytes(), img.Bytes()) {
+		t.Error("Image data should be unchanged")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	img := &bytes.Buffer{}
+	png.Encode(img, image.NewGray(image.Rect(0, 0, 8, 8)))
+	original := img.Bytes()
+
+	// an eXIf chunk before the IEND chunk
+	chunk := &bytes.Buffer{}
+	binary.Write(chunk, binary.BigEndian, uint32(4))
+	chunk.WriteString("eXIf")
+	chunk.WriteString("II*\x00")
+	binary.Write(chunk, binary.BigEndian, uint32(0))
+	end := len(original) - 12
+	data := append(append(append([]byte{}, original[:end]...), chunk.Bytes()...), original[end:]...)
+
+	stripped := &bytes.Buffer{}
+	if err := stripMetadata(stripped, bytes.NewReader(data), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped.Bytes(), original) {
+		t.Error("eXIf chunk should be removed")
+	}
+}
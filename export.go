@@ -0,0 +1,302 @@
+package photoshare
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/juju/errgo"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// Users can download an archive of their data: a ZIP with their original
+// photos and a manifest.json describing their profile, photos, tags, votes
+// and comments. Archives are built by a background job, which emails a
+// download link once the archive is ready.
+
+const (
+	exportPending    = "pending"
+	exportProcessing = "processing"
+	exportReady      = "ready"
+	exportFailed     = "failed"
+
+	exportInterval        = time.Minute
+	exportCleanupInterval = time.Hour
+	exportExpiry          = 7  // days an archive can be downloaded for
+	exportRequestInterval = 24 // hours between requests
+)
+
+type dataExport struct {
+	ID          int64          `db:"id" json:"id"`
+	UserID      int64          `db:"user_id" json:"-"`
+	Status      string         `db:"status" json:"status"`
+	BaseURL     string         `db:"base_url" json:"-"` // for the link in the email
+	Filename    string         `db:"filename" json:"-"`
+	TokenHash   sql.NullString `db:"token_hash" json:"-"`
+	CreatedAt   time.Time      `db:"created_at" json:"createdAt"`
+	CompletedAt sql.NullTime   `db:"completed_at" json:"-"`
+	ExpiresAt   sql.NullTime   `db:"expires_at" json:"-"`
+	Expires     *time.Time     `db:"-" json:"expiresAt,omitempty"`
+}
+
+// the data in the manifest that isn't in the user's profile
+type userData struct {
+	Photos   []exportPhoto `json:"photos"`
+	Votes    []exportVote  `json:"votes"`
+	Comments []comment     `json:"comments"`
+}
+
+// a photo with the details that are only shown to its owner
+type exportPhoto struct {
+	photo
+	File      string     `json:"file"` // path in the archive
+	Latitude  *float64   `json:"latitude,omitempty"`
+	Longitude *float64   `json:"longitude,omitempty"`
+	TakenAt   *time.Time `json:"takenAt,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+func newExportPhoto(p photo) exportPhoto {
+	e := exportPhoto{photo: p, File: path.Join("photos", p.Filename)}
+	if p.Latitude.Valid && p.Longitude.Valid {
+		e.Latitude, e.Longitude = &p.Latitude.Float64, &p.Longitude.Float64
+	}
+	if p.TakenAt.Valid {
+		e.TakenAt = &p.TakenAt.Time
+	}
+	if p.DeletedAt.Valid {
+		e.DeletedAt = &p.DeletedAt.Time
+	}
+	return e
+}
+
+type exportVote struct {
+	PhotoID   int64      `db:"photo_id" json:"photoId"`
+	Direction int64      `db:"direction" json:"direction"`
+	CreatedAt *time.Time `db:"created_at" json:"createdAt,omitempty"`
+}
+
+type exportManifest struct {
+	ExportedAt time.Time `json:"exportedAt"`
+	Profile    *profile  `json:"profile"`
+	*userData
+}
+
+// writes the archive of the user's data to the exports directory, returning its filename
+func (app *app) writeExport(user *user) (string, error) {
+
+	data, err := app.datamapper.getUserData(user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(app.cfg.ExportsDir, 0700); err != nil {
+		return "", errgo.Mask(err)
+	}
+	filename := fmt.Sprintf("photoshare-%d-%s.zip", user.ID, uniuri.New())
+	archivePath := path.Join(app.cfg.ExportsDir, filename)
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+
+	if err := app.writeArchive(f, user, data); err != nil {
+		f.Close()
+		os.Remove(archivePath)
+		return "", err
+	}
+	return filename, errgo.Mask(f.Close())
+}
+
+func (app *app) writeArchive(dst io.Writer, user *user, data *userData) error {
+
+	zw := zip.NewWriter(dst)
+
+	for i := range data.Photos {
+		if err := app.addExportFile(zw, &data.Photos[i]); err != nil {
+			return err
+		}
+	}
+
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	manifest := &exportManifest{time.Now(), newProfile(user, true), data}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(zw.Close())
+}
+
+// copies the original of the photo into the archive; a missing file is left
+// out rather than failing the whole export
+func (app *app) addExportFile(zw *zip.Writer, photo *exportPhoto) error {
+	src, err := app.filestore.open(photo.Filename)
+	if err != nil {
+		logError(err)
+		photo.File = ""
+		return nil
+	}
+	defer src.Close()
+
+	w, err := zw.Create(photo.File)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = io.Copy(w, src)
+	return errgo.Mask(err)
+}
+
+// builds the archive of a requested export and emails the user a link to it
+func (app *app) processExport(export *dataExport) error {
+
+	export.Status = exportProcessing
+	if err := app.datamapper.updateExport(export); err != nil {
+		return err
+	}
+
+	user, err := app.datamapper.getActiveUser(export.UserID)
+	if err == nil {
+		export.Filename, err = app.writeExport(user)
+	}
+	if err != nil {
+		export.Status = exportFailed
+		if err := app.datamapper.updateExport(export); err != nil {
+			logError(err)
+		}
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	export.Status = exportReady
+	export.TokenHash = sql.NullString{String: hashToken(token), Valid: true}
+	export.CompletedAt = sql.NullTime{Time: now, Valid: true}
+	export.ExpiresAt = sql.NullTime{Time: now.AddDate(0, 0, exportExpiry), Valid: true}
+
+	if err := app.datamapper.updateExport(export); err != nil {
+		// the user may have deleted their account meanwhile
+		app.removeExportFile(export.Filename)
+		return err
+	}
+	return app.mailer.sendExportReadyMail(user, export.BaseURL, token)
+}
+
+// builds the archives users have asked for
+func (app *app) processExports() error {
+	exports, err := app.datamapper.getPendingExports()
+	if err != nil {
+		return err
+	}
+	for i := range exports {
+		if err := app.processExport(&exports[i]); err != nil {
+			logError(err)
+		}
+	}
+	return nil
+}
+
+// deletes archives whose download links have expired, and exports that
+// failed or never finished, so they can be asked for again
+func (app *app) removeExpiredExports() error {
+	exports, err := app.datamapper.getExpiredExports(time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range exports {
+		app.removeExportFile(exports[i].Filename)
+		if err := app.datamapper.removeExport(&exports[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *app) removeExportFile(filename string) {
+	if filename == "" {
+		return
+	}
+	if err := os.Remove(path.Join(app.cfg.ExportsDir, filename)); err != nil && !os.IsNotExist(err) {
+		logError(err)
+	}
+}
+
+func getExports(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	exports, err := ctx.datamapper.getExports(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	for i := range exports {
+		if exports[i].ExpiresAt.Valid {
+			exports[i].Expires = &exports[i].ExpiresAt.Time
+		}
+	}
+	return renderJSON(w, exports, http.StatusOK)
+}
+
+// asks for an archive of the current user's data, which is emailed when ready
+func requestExport(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	exports, err := ctx.datamapper.getExports(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	since := time.Now().Add(-time.Hour * exportRequestInterval)
+	for _, export := range exports {
+		if export.Status == exportPending || export.Status == exportProcessing {
+			return httpError{http.StatusConflict, "Your archive is already being prepared"}
+		}
+		if export.CreatedAt.After(since) {
+			return httpError{http.StatusTooManyRequests,
+				fmt.Sprintf("You can only ask for an archive once every %d hours", exportRequestInterval)}
+		}
+	}
+
+	export := &dataExport{
+		UserID:    ctx.user.ID,
+		Status:    exportPending,
+		BaseURL:   getBaseURL(r),
+		CreatedAt: time.Now(),
+	}
+	if err := ctx.datamapper.createExport(export); err != nil {
+		return err
+	}
+	return renderJSON(w, export, http.StatusAccepted)
+}
+
+// the link in the email; the token is enough, as the user may not be logged in
+func downloadExport(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	token := r.FormValue("token")
+	if token == "" {
+		return httpError{http.StatusNotFound, "Invalid or expired download link"}
+	}
+
+	export, err := ctx.datamapper.getExportByToken(hashToken(token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return httpError{http.StatusNotFound, "Invalid or expired download link"}
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="photoshare-export.zip"`)
+	http.ServeFile(w, r, path.Join(ctx.cfg.ExportsDir, export.Filename))
+	return nil
+}
@@ -56,13 +56,18 @@ func latestFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 func popularFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	photos, err := ctx.datamapper.getPhotos(newPage(1), "votes")
+	orderBy := r.FormValue("orderBy")
+	if orderBy == "" {
+		orderBy = "hot"
+	}
+
+	photos, err := ctx.datamapper.getPhotos(newPage(1), orderBy)
 
 	if err != nil {
 		return err
 	}
 
-	return photoFeed(w, r, "Popular photos", "Most upvoted photos", "/popular", photos)
+	return photoFeed(w, r, "Popular photos", "Most popular photos", "/popular", photos)
 }
 
 func ownerFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
@@ -76,7 +81,23 @@ func ownerFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	description := "List of feeds for " + owner.Name
 	link := fmt.Sprintf("/owner/%d/%s", ownerID, owner.Name)
 
-	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID)
+	photos, err := ctx.datamapper.getPhotosByOwnerID(newPage(1), ownerID, "")
+
+	if err != nil {
+		return err
+	}
+	return photoFeed(w, r, title, description, link, photos)
+}
+
+// the current user's timeline; feed readers send a read-only API token as ?token=
+func timelineFeed(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	user := ctx.user
+
+	title := "Timeline for " + user.Name
+	description := "Photos from users and tags followed by " + user.Name
+	link := "/timeline"
+
+	photos, err := ctx.datamapper.getTimeline(newPage(1), user.ID)
 
 	if err != nil {
 		return err
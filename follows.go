@@ -0,0 +1,101 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+)
+
+func getUserToFollow(ctx *context) (*user, error) {
+
+	followee, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return followee, err
+	}
+
+	if followee.ID == ctx.user.ID {
+		return followee, httpError{http.StatusBadRequest, "You can't follow yourself"}
+	}
+	return followee, nil
+}
+
+func followUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	followee, err := getUserToFollow(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.followUser(ctx.user.ID, followee.ID); err != nil {
+		return err
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, followee.Name, 0, "user_followed"})
+	return renderString(w, http.StatusOK, "Following "+followee.Name)
+}
+
+func unfollowUser(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	followee, err := getUserToFollow(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.unfollowUser(ctx.user.ID, followee.ID); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "No longer following "+followee.Name)
+}
+
+func getFollowers(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	users, err := ctx.datamapper.getFollowers(getPage(r), ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, users, http.StatusOK)
+}
+
+func getFollowing(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	users, err := ctx.datamapper.getFollowing(getPage(r), ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, users, http.StatusOK)
+}
+
+func followTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	name := strings.TrimSpace(ctx.params.get("name"))
+	if name == "" {
+		return httpError{http.StatusBadRequest, "Missing tag"}
+	}
+
+	if err := ctx.datamapper.followTag(ctx.user.ID, name); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Following #"+name)
+}
+
+func unfollowTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	name := strings.TrimSpace(ctx.params.get("name"))
+	if name == "" {
+		return httpError{http.StatusBadRequest, "Missing tag"}
+	}
+
+	if err := ctx.datamapper.unfollowTag(ctx.user.ID, name); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "No longer following #"+name)
+}
+
+func getTimeline(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photos, err := ctx.datamapper.getTimeline(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
+}
@@ -0,0 +1,124 @@
+package photoshare
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxMapZoom     = 20
+	maxMapClusters = 500
+	// clusters per 256 pixel map tile in each direction, i.e. about 64 pixels apart
+	mapClustersPerTile = 4
+
+	defaultNearRadius = 10.0 // km
+	maxNearRadius     = 1000.0
+	kmPerDegree       = 111.2 // km per degree of latitude
+)
+
+type geoPoint struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lng"`
+}
+
+type boundingBox struct {
+	minLat, minLng, maxLat, maxLng float64
+}
+
+// parses minLng,minLat,maxLng,maxLat as used by most map libraries
+func parseBoundingBox(s string) (*boundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(value) {
+			return nil, fmt.Errorf("Invalid coordinate %q", part)
+		}
+		values[i] = value
+	}
+	box := &boundingBox{minLng: values[0], minLat: values[1], maxLng: values[2], maxLat: values[3]}
+	if !isValidLocation(box.minLat, box.minLng) || !isValidLocation(box.maxLat, box.maxLng) {
+		return nil, fmt.Errorf("Coordinates out of range")
+	}
+	if box.minLat > box.maxLat {
+		return nil, fmt.Errorf("minLat must be less than maxLat")
+	}
+	return box, nil
+}
+
+func isValidLocation(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// grid cell size in degrees for a web map zoom level
+func clusterCellSize(zoom int64) float64 {
+	return 360 / math.Pow(2, float64(zoom)) / mapClustersPerTile
+}
+
+type mapCluster struct {
+	Latitude  float64 `db:"latitude" json:"lat"`
+	Longitude float64 `db:"longitude" json:"lng"`
+	NumPhotos int64   `db:"num_photos" json:"numPhotos"`
+	PhotoID   int64   `db:"photo_id" json:"photoId"` // most popular photo in the cluster
+	Title     string  `db:"title" json:"title"`
+	Filename  string  `db:"photo" json:"photo"`
+}
+
+func getPhotoMap(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	box, err := parseBoundingBox(r.FormValue("bbox"))
+	if err != nil {
+		return httpError{http.StatusBadRequest, err.Error()}
+	}
+
+	zoom, err := strconv.ParseInt(r.FormValue("zoom"), 10, 64)
+	if err != nil || zoom < 0 || zoom > maxMapZoom {
+		return httpError{http.StatusBadRequest, fmt.Sprintf("zoom must be between 0 and %d", maxMapZoom)}
+	}
+
+	cacheKey := fmt.Sprintf("photos:map:%v:%d", *box, zoom)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		clusters, err := ctx.datamapper.getPhotoMap(box, clusterCellSize(zoom))
+		if err != nil {
+			return clusters, err
+		}
+		return clusters, nil
+	})
+}
+
+// lets the owner show or hide the location of the photo
+func editPhotoLocation(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getPhotoToEdit(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Visible bool `json:"visible"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	photo.ShowLocation = s.Visible
+
+	if err := ctx.datamapper.updatePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_updated"})
+	return renderString(w, http.StatusOK, "Photo updated")
+}
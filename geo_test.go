@@ -0,0 +1,39 @@
+package photoshare
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestParseBoundingBox(t *testing.T) {
+	box, err := parseBoundingBox("170,-10,-170,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if box.minLng != 170 || box.maxLng != -170 || box.minLat != -10 {
+		t.Error("Unexpected box:", box)
+	}
+	for _, s := range []string{"", "1,2,3", "0,91,10,92", "0,10,10,0"} {
+		if _, err := parseBoundingBox(s); err == nil {
+			t.Error("Should be invalid:", s)
+		}
+	}
+}
+
+func TestPhotoLocation(t *testing.T) {
+	p := &photo{
+		OwnerID:   1,
+		Latitude:  sql.NullFloat64{Float64: 35.01, Valid: true},
+		Longitude: sql.NullFloat64{Float64: 135.76, Valid: true},
+	}
+	if p.location(&user{ID: 2}) != nil {
+		t.Error("Hidden location should not be shown to others")
+	}
+	if p.location(&user{ID: 1}) == nil {
+		t.Error("Owner should see the location")
+	}
+	p.ShowLocation = true
+	if p.location(nil) == nil {
+		t.Error("Visible location should be shown")
+	}
+}
@@ -0,0 +1,136 @@
+package photoshare
+
+import (
+	"net/http"
+	"strings"
+)
+
+// creates an account for an external login that isn't linked to a user yet,
+// with the name the user picked
+func oauthSignup(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+		Email string `json:"email"` // if the provider didn't give one
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	info, err := ctx.session.readIdentityToken(s.Token)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ctx.datamapper.getUserByIdentity(info.provider, info.id); err == nil {
+		return httpError{http.StatusConflict, "This login is already linked to an account"}
+	} else if !isErrSqlNoRows(err) {
+		return err
+	}
+
+	user := &user{
+		Name:        strings.TrimSpace(s.Name),
+		Email:       info.email,
+		HasIdentity: true,
+	}
+	if user.Email == "" {
+		user.Email = strings.ToLower(strings.TrimSpace(s.Email))
+	}
+
+	if err := ctx.validate(user, r); err != nil {
+		return err
+	}
+
+	// addresses the provider hasn't verified, or typed in by the user, need verifying
+	var token string
+	if info.emailVerified && user.Email == info.email {
+		user.markVerified()
+	} else if token, err = user.generateVerifyToken(); err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.createUserWithIdentity(user, newUserIdentity(0, info)); err != nil {
+		return err
+	}
+	if err := ctx.startSession(w, r, user.ID); err != nil {
+		return err
+	}
+
+	user.IsAuthenticated = true
+
+	go func() {
+		if err := ctx.mailer.sendWelcomeMail(user); err != nil {
+			logError(err)
+		}
+	}()
+	if token != "" {
+		ctx.sendVerificationMail(user, token, r)
+	}
+
+	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
+}
+
+func getIdentities(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	identities, err := ctx.datamapper.getIdentities(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, identities, http.StatusOK)
+}
+
+// links the external login in the identity token to the current user
+func linkIdentity(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	info, err := ctx.session.readIdentityToken(s.Token)
+	if err != nil {
+		return err
+	}
+
+	owner, err := ctx.datamapper.getUserByIdentity(info.provider, info.id)
+	if err == nil {
+		if owner.ID != ctx.user.ID {
+			return httpError{http.StatusConflict, "This login is linked to another account"}
+		}
+		return renderString(w, http.StatusOK, "Login already linked")
+	} else if !isErrSqlNoRows(err) {
+		return err
+	}
+
+	identity := newUserIdentity(ctx.user.ID, info)
+	if err := ctx.datamapper.addIdentity(identity); err != nil {
+		return err
+	}
+	return renderJSON(w, identity, http.StatusCreated)
+}
+
+// removes an external login, unless the user would have no way left to log in
+func unlinkIdentity(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	identities, err := ctx.datamapper.getIdentities(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	if ctx.user.Password == "" && len(identities) <= 1 {
+		return httpError{http.StatusBadRequest, "Set a password before removing your only external login"}
+	}
+
+	ok, err := ctx.datamapper.removeIdentity(ctx.user.ID, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusNotFound, "Login not found"}
+	}
+	return renderString(w, http.StatusOK, "Login removed")
+}
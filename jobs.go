@@ -0,0 +1,59 @@
+package photoshare
+
+import (
+	"time"
+)
+
+// runs fn in the background every interval, logging any errors
+func schedule(interval time.Duration, fn func() error) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := fn(); err != nil {
+				logError(err)
+			}
+		}
+	}()
+}
+
+const (
+	trashPurgeInterval      = time.Hour
+	sessionCleanupInterval  = time.Hour
+	throttleCleanupInterval = time.Hour
+)
+
+// starts periodic maintenance tasks for the server
+func (app *app) startJobs() {
+	schedule(time.Minute*time.Duration(app.cfg.TrendingInterval), app.datamapper.refreshTrendingScores)
+	schedule(trashPurgeInterval, app.purgeTrash)
+	schedule(sessionCleanupInterval, app.removeExpiredSessions)
+	schedule(throttleCleanupInterval, app.removeExpiredThrottles)
+	schedule(exportInterval, app.processExports)
+	schedule(exportCleanupInterval, app.removeExpiredExports)
+}
+
+// deletes photos that have been in the trash longer than the retention period, with their files
+func (app *app) purgeTrash() error {
+	photos, err := app.datamapper.getExpiredTrash(time.Now().AddDate(0, 0, -app.cfg.TrashRetention))
+	if err != nil {
+		return err
+	}
+	for i := range photos {
+		if err := app.datamapper.removePhoto(&photos[i]); err != nil {
+			return err
+		}
+		if err := app.filestore.clean(photos[i].Filename); err != nil {
+			logError(err)
+		}
+	}
+	return nil
+}
+
+// deletes old sessions; revoked ones are kept a day so reuse of their refresh tokens is still detected
+func (app *app) removeExpiredSessions() error {
+	return app.datamapper.removeExpiredSessions(time.Now().AddDate(0, 0, -1))
+}
+
+// forgets failed logins older than the throttle window
+func (app *app) removeExpiredThrottles() error {
+	return app.datamapper.removeExpiredThrottles(time.Now().Add(-throttleWindow))
+}
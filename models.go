@@ -5,14 +5,20 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"crypto/rand"
 	"database/sql"
+	"fmt"
 	"github.com/coopernurse/gorp"
 	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
 const (
 	pageSize               = 20
+	upVote                 = 1
+	downVote               = -1
+	maxTitleLength         = 200
+	maxCommentLength       = 2000
 	recoveryCodeLength     = 30
 	recoveryCodeCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
 )
@@ -22,30 +28,189 @@ type photoList struct {
 	Total       int64   `json:"total"`
 	CurrentPage int64   `json:"currentPage"`
 	NumPages    int64   `json:"numPages"`
+	NextCursor  string  `json:"nextCursor,omitempty"`
 }
 
-func newPhotoList(photos []photo, total int64, page int64) *photoList {
-	numPages := int64(math.Ceil(float64(total) / float64(pageSize)))
-
+func newPhotoList(photos []photo, total int64, page *page) *photoList {
 	return &photoList{
 		Items:       photos,
 		Total:       total,
-		CurrentPage: page,
-		NumPages:    numPages,
+		CurrentPage: page.index,
+		NumPages:    page.numPages(total),
 	}
 }
 
-type tag struct {
+type trashedPhoto struct {
+	photo
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"` // when the photo will be deleted for good
+}
+
+type trashList struct {
+	Items       []trashedPhoto `json:"photos"`
+	Total       int64          `json:"total"`
+	CurrentPage int64          `json:"currentPage"`
+	NumPages    int64          `json:"numPages"`
+}
+
+func newTrashList(photos []photo, total int64, page *page) *trashList {
+	items := make([]trashedPhoto, 0, len(photos))
+	for _, photo := range photos {
+		items = append(items, trashedPhoto{photo: photo, DeletedAt: photo.DeletedAt.Time})
+	}
+	return &trashList{
+		Items:       items,
+		Total:       total,
+		CurrentPage: page.index,
+		NumPages:    page.numPages(total),
+	}
+}
+
+type searchResult struct {
+	photo     `db:"-"`
+	Rank      float64 `db:"rank" json:"rank"`
+	Highlight string  `db:"highlight" json:"highlight"`
+}
+
+type searchResultList struct {
+	Items       []searchResult `json:"photos"`
+	Total       int64          `json:"total"`
+	CurrentPage int64          `json:"currentPage"`
+	NumPages    int64          `json:"numPages"`
+	NextCursor  string         `json:"nextCursor,omitempty"`
+}
+
+func newSearchResultList(results []searchResult, total int64, page *page) *searchResultList {
+	return &searchResultList{
+		Items:       results,
+		Total:       total,
+		CurrentPage: page.index,
+		NumPages:    page.numPages(total),
+	}
+}
+
+type userSummary struct {
 	ID   int64  `db:"id" json:"id"`
 	Name string `db:"name" json:"name"`
 }
 
+type userList struct {
+	Items       []userSummary `json:"users"`
+	Total       int64         `json:"total"`
+	CurrentPage int64         `json:"currentPage"`
+	NumPages    int64         `json:"numPages"`
+}
+
+func newUserList(users []userSummary, total int64, page *page) *userList {
+	return &userList{
+		Items:       users,
+		Total:       total,
+		CurrentPage: page.index,
+		NumPages:    page.numPages(total),
+	}
+}
+
+type commentList struct {
+	Items       []commentDetail `json:"comments"`
+	Total       int64           `json:"total"`
+	CurrentPage int64           `json:"currentPage"`
+	NumPages    int64           `json:"numPages"`
+}
+
+func newCommentList(comments []commentDetail, total int64, page *page) *commentList {
+	return &commentList{
+		Items:       comments,
+		Total:       total,
+		CurrentPage: page.index,
+		NumPages:    page.numPages(total),
+	}
+}
+
+func (p *page) numPages(total int64) int64 {
+	return int64(math.Ceil(float64(total) / float64(p.size)))
+}
+
+type tag struct {
+	ID       int64         `db:"id" json:"id"`
+	ParentID sql.NullInt64 `db:"parent_id" json:"-"`
+	Name     string        `db:"name" json:"name"`
+}
+
+// tag names are paths, e.g. travel/japan/kyoto
+const tagPathSeparator = "/"
+
+// lower-cases the name and removes empty path levels
+func cleanTagName(name string) string {
+	var levels []string
+	for _, level := range strings.Split(strings.ToLower(name), tagPathSeparator) {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, tagPathSeparator)
+}
+
+// returns the name of the parent tag, or an empty string for a top-level tag
+func parentTagName(name string) string {
+	if i := strings.LastIndex(name, tagPathSeparator); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+type tagNode struct {
+	ID        int64         `db:"id" json:"-"`
+	ParentID  sql.NullInt64 `db:"parent_id" json:"-"`
+	Name      string        `db:"name" json:"name"`
+	Label     string        `db:"-" json:"label"`
+	NumPhotos int64         `db:"num_photos" json:"numPhotos"`
+	Children  []*tagNode    `db:"-" json:"children,omitempty"`
+}
+
+// arranges tags sorted by name into trees: tags whose parent is missing become roots
+func buildTagTree(tags []*tagNode) []*tagNode {
+	var (
+		roots []*tagNode
+		nodes = make(map[int64]*tagNode)
+	)
+	for _, node := range tags {
+		node.Label = node.Name[strings.LastIndex(node.Name, tagPathSeparator)+1:]
+		nodes[node.ID] = node
+	}
+	for _, node := range tags {
+		if parent, ok := nodes[node.ParentID.Int64]; ok && node.ParentID.Valid {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	if roots == nil {
+		roots = []*tagNode{}
+	}
+	return roots
+}
+
 type tagCount struct {
 	Name      string `db:"name" json:"name"`
 	Photo     string `db:"photo" json:"photo"`
 	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
 }
 
+type tagSynonym struct {
+	Name string `db:"name" json:"name"`
+	Tag  string `db:"tag" json:"tag"`
+}
+
+type blockedTag struct {
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type tagSuggestion struct {
+	Name      string `db:"name" json:"name"`
+	NumPhotos int64  `db:"num_photos" json:"numPhotos"`
+}
+
 type photo struct {
 	ID        int64     `db:"id" json:"id"`
 	OwnerID   int64     `db:"owner_id" json:"ownerId"`
@@ -55,13 +220,72 @@ type photo struct {
 	Tags      []string  `db:"-" json:"tags,omitempty"`
 	UpVotes   int64     `db:"up_votes" json:"upVotes"`
 	DownVotes int64     `db:"down_votes" json:"downVotes"`
+	Camera    string    `db:"camera" json:"camera,omitempty"`
+
+	CommentsEnabled bool `db:"comments_enabled" json:"commentsEnabled"`
+
+	// GPS position from the image, only shown to others if ShowLocation is set
+	Latitude     sql.NullFloat64 `db:"latitude" json:"-"`
+	Longitude    sql.NullFloat64 `db:"longitude" json:"-"`
+	ShowLocation bool            `db:"show_location" json:"showLocation"`
+
+	// when the photo was taken according to the camera, if known
+	TakenAt sql.NullTime `db:"taken_at" json:"-"`
+
+	// set while the photo is in the trash
+	DeletedAt sql.NullTime `db:"deleted_at" json:"-"`
+
+	// the owner's album the photo is in, if any
+	AlbumID sql.NullInt64 `db:"album_id" json:"-"`
+
+	// ranking scores, maintained by the database
+	HotScore         float64 `db:"hot_score" json:"-"`
+	WilsonScore      float64 `db:"wilson_score" json:"-"`
+	ControversyScore float64 `db:"controversy_score" json:"-"`
+	TrendingScore    float64 `db:"trending_score" json:"-"`
 }
 
 func (photo *photo) PreInsert(s gorp.SqlExecutor) error {
 	photo.CreatedAt = time.Now()
+	photo.CommentsEnabled = true
 	return nil
 }
 
+// sets any details we can find in the image metadata, then rewinds the image
+func (photo *photo) readMetadata(src readable) error {
+	if info, err := readExif(src); err == nil {
+		photo.Camera = info.Camera
+		if !info.TakenAt.IsZero() {
+			photo.TakenAt = sql.NullTime{Time: info.TakenAt, Valid: true}
+		}
+		if info.HasLocation {
+			photo.Latitude = sql.NullFloat64{Float64: info.Latitude, Valid: true}
+			photo.Longitude = sql.NullFloat64{Float64: info.Longitude, Valid: true}
+		}
+	}
+	_, err := src.Seek(0, 0)
+	return err
+}
+
+// returns when the photo was taken, or uploaded if not known, as used for the calendar
+func (photo *photo) captureDate() time.Time {
+	if photo.TakenAt.Valid {
+		return photo.TakenAt.Time
+	}
+	return photo.CreatedAt.UTC()
+}
+
+// returns the position if the user is allowed to see it
+func (photo *photo) location(user *user) *geoPoint {
+	if !photo.Latitude.Valid || !photo.Longitude.Valid {
+		return nil
+	}
+	if !photo.ShowLocation && (user == nil || user.ID != photo.OwnerID) {
+		return nil
+	}
+	return &geoPoint{photo.Latitude.Float64, photo.Longitude.Float64}
+}
+
 func (photo *photo) validate(ctx *context, r *http.Request, errors map[string]string) error {
 	if photo.OwnerID == 0 {
 		errors["ownerID"] = "Owner ID is missing"
@@ -69,7 +293,7 @@ func (photo *photo) validate(ctx *context, r *http.Request, errors map[string]st
 	if photo.Title == "" {
 		errors["title"] = "Title is missing"
 	}
-	if len(photo.Title) > 200 {
+	if len(photo.Title) > maxTitleLength {
 		errors["title"] = "Title is too long"
 	}
 	if photo.Filename == "" {
@@ -89,27 +313,114 @@ func (photo *photo) canDelete(user *user) bool {
 	return photo.canEdit(user)
 }
 
+// users can vote once per photo, but can switch or retract their vote
 func (photo *photo) canVote(user *user) bool {
 	if user == nil || !user.IsAuthenticated {
 		return false
 	}
-	if photo.OwnerID == user.ID {
+	return photo.OwnerID != user.ID
+}
+
+func (photo *photo) canComment(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
 		return false
 	}
+	return photo.CommentsEnabled
+}
 
-	return !user.hasVoted(photo.ID)
+func (photo *photo) canFavorite(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return photo.OwnerID != user.ID
 }
 
 type permissions struct {
+	Edit     bool `json:"edit"`
+	Delete   bool `json:"delete"`
+	Vote     bool `json:"vote"`
+	Comment  bool `json:"comment"`
+	Favorite bool `json:"favorite"`
+}
+
+type photoDetail struct {
+	photo        `db:"-"`
+	OwnerName    string       `db:"owner_name" json:"ownerName"`
+	NumFavorites int64        `db:"num_favorites" json:"numFavorites"`
+	IsFavorite   bool         `db:"is_favorite" json:"isFavorite"`
+	Vote         int64        `db:"vote" json:"vote"` // current user's vote: 1, -1 or 0 if none
+	CaptureDate  time.Time    `db:"-" json:"captureDate"`
+	Location     *geoPoint    `db:"-" json:"location,omitempty"`
+	Permissions  *permissions `db:"-" json:"perms"`
+	Comments     *commentList `db:"-" json:"comments"`
+}
+
+type comment struct {
+	ID        int64         `db:"id" json:"id"`
+	PhotoID   int64         `db:"photo_id" json:"photoId"`
+	OwnerID   int64         `db:"owner_id" json:"ownerId"`
+	ParentID  sql.NullInt64 `db:"parent_id" json:"-"`
+	CreatedAt time.Time     `db:"created_at" json:"createdAt"`
+	UpdatedAt time.Time     `db:"updated_at" json:"updatedAt"`
+	Body      string        `db:"body" json:"body"`
+}
+
+func (comment *comment) PreInsert(s gorp.SqlExecutor) error {
+	comment.CreatedAt = time.Now()
+	comment.UpdatedAt = comment.CreatedAt
+	return nil
+}
+
+func (comment *comment) PreUpdate(s gorp.SqlExecutor) error {
+	comment.UpdatedAt = time.Now()
+	return nil
+}
+
+func (comment *comment) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if comment.PhotoID == 0 {
+		errors["photoID"] = "Photo ID is missing"
+	}
+	if comment.OwnerID == 0 {
+		errors["ownerID"] = "Owner ID is missing"
+	}
+	if strings.TrimSpace(comment.Body) == "" {
+		errors["body"] = "Comment is missing"
+	}
+	if len(comment.Body) > maxCommentLength {
+		errors["body"] = "Comment is too long"
+	}
+	return nil
+}
+
+func (comment *comment) canEdit(user *user) bool {
+	if user == nil || !user.IsAuthenticated {
+		return false
+	}
+	return user.IsAdmin || comment.OwnerID == user.ID
+}
+
+// photo owners can moderate comments on their own photos
+func (comment *comment) canDelete(user *user, photo *photo) bool {
+	return comment.canEdit(user) || photo.canEdit(user)
+}
+
+type commentPermissions struct {
 	Edit   bool `json:"edit"`
 	Delete bool `json:"delete"`
-	Vote   bool `json:"vote"`
 }
 
-type photoDetail struct {
-	photo       `db:"-"`
-	OwnerName   string       `db:"owner_name" json:"ownerName"`
-	Permissions *permissions `db:"-" json:"perms"`
+func newCommentPermissions(comment *comment, photo *photo, user *user) *commentPermissions {
+	return &commentPermissions{
+		comment.canEdit(user),
+		comment.canDelete(user, photo),
+	}
+}
+
+type commentDetail struct {
+	comment     `db:"-"`
+	OwnerName   string              `db:"owner_name" json:"ownerName"`
+	Replies     []*commentDetail    `db:"-" json:"replies,omitempty"`
+	Permissions *commentPermissions `db:"-" json:"perms"`
 }
 
 // User represents users in database
@@ -119,18 +430,31 @@ type user struct {
 	Name            string         `db:"name" json:"name"`
 	Password        string         `db:"password" json:""`
 	Email           string         `db:"email" json:"email"`
-	Votes           string         `db:"votes" json:""`
 	IsAdmin         bool           `db:"admin" json:"isAdmin"`
 	IsActive        bool           `db:"active" json:"isActive"`
-	RecoveryCode    sql.NullString `db:"recovery_code" json:""`
+	RecoveryCode    sql.NullString `db:"recovery_code" json:"-"` // hashed
+	RecoveryCodeAt  sql.NullTime   `db:"recovery_code_created_at" json:"-"`
+	EmailVerified   bool           `db:"email_verified" json:"emailVerified"`
+	VerifyToken     sql.NullString `db:"verification_token" json:"-"`
+	VerifySentAt    sql.NullTime   `db:"verification_sent_at" json:"-"`
+	PendingEmail    sql.NullString `db:"pending_email" json:"-"`      // waiting to be verified
+	ChangeToken     sql.NullString `db:"email_change_token" json:"-"` // hashed, sent to the current address
+	DisplayName     string         `db:"display_name" json:"displayName"`
+	Bio             string         `db:"bio" json:"bio"`
+	Website         string         `db:"website" json:"website"`
+	Avatar          string         `db:"avatar" json:"avatar"`
+	TOTPSecret      sql.NullString `db:"totp_secret" json:"-"`
+	TOTPEnabled     bool           `db:"totp_enabled" json:"-"`
+	TOTPLastStep    int64          `db:"totp_last_step" json:"-"`
 	IsAuthenticated bool           `db:"-" json:"isAuthenticated"`
+	SessionID       int64          `db:"-" json:"-"`
+	HasIdentity     bool           `db:"-" json:"-"` // logs in with an external provider
 }
 
 // PreInsert hook
 func (user *user) PreInsert(s gorp.SqlExecutor) error {
 	user.IsActive = true
 	user.CreatedAt = time.Now()
-	user.Votes = "{}"
 	user.encryptPassword()
 	return nil
 }
@@ -164,8 +488,8 @@ func (user *user) validate(ctx *context, r *http.Request, errors map[string]stri
 
 	}
 
-	// tbd: we need flag user is third-party
-	if user.Password == "" {
+	// users signing up with an external identity may not have a password
+	if user.Password == "" && !user.HasIdentity {
 		errors["password"] = "Password is missing"
 	}
 
@@ -190,12 +514,19 @@ func (user *user) generateRecoveryCode() (string, error) {
 	}
 
 	code := buf.String()
-	user.RecoveryCode = sql.NullString{String: code, Valid: true}
+	user.RecoveryCode = sql.NullString{String: hashToken(code), Valid: true}
+	user.RecoveryCodeAt = sql.NullTime{Time: time.Now(), Valid: true}
 	return code, nil
 }
 
+// returns true if the recovery code was created more than the given minutes ago
+func (user *user) recoveryCodeExpired(now time.Time, expiry int) bool {
+	return !user.RecoveryCodeAt.Valid || now.After(user.RecoveryCodeAt.Time.Add(time.Minute*time.Duration(expiry)))
+}
+
 func (user *user) resetRecoveryCode() {
 	user.RecoveryCode = sql.NullString{String: "", Valid: false}
+	user.RecoveryCodeAt = sql.NullTime{}
 }
 
 func (user *user) changePassword(password string) error {
@@ -223,37 +554,33 @@ func (user *user) checkPassword(password string) bool {
 	return err == nil
 }
 
-func (user *user) registerVote(photoID int64) {
-	user.setVotes(append(user.getVotes(), photoID))
-}
-
-func (user *user) hasVoted(photoID int64) bool {
-	for _, value := range user.getVotes() {
-		if value == photoID {
-			return true
-		}
-	}
-	return false
-}
-
-func (user *user) getVotes() []int64 {
-	return pgArrToIntSlice(user.Votes)
+type page struct {
+	index     int64
+	offset    int64
+	size      int64
+	cursor    string // keyset cursor, replaces the offset if set
+	skipCount bool
 }
 
-func (user *user) setVotes(votes []int64) {
-	user.Votes = intSliceToPgArr(votes)
+func newPage(index int64) *page {
+	p := &page{index: index}
+	p.setSize(pageSize)
+	return p
 }
 
-type page struct {
-	index  int64
-	offset int64
-	size   int64
+func (p *page) setSize(size int64) {
+	if size < minPageSize {
+		size = minPageSize
+	} else if size > maxPageSize {
+		size = maxPageSize
+	}
+	p.size = size
+	p.offset = (p.index - 1) * size
+	if p.offset < 0 {
+		p.offset = 0
+	}
 }
 
-func newPage(index int64) *page {
-	offset := (index - 1) * pageSize
-	if offset < 0 {
-		offset = 0
-	}
-	return &page{index, offset, pageSize}
+func (p *page) cacheKey() string {
+	return fmt.Sprintf("page:%d:size:%d:cursor:%s:count:%t", p.index, p.size, p.cursor, !p.skipCount)
 }
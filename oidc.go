@@ -0,0 +1,270 @@
+package photoshare
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errgo"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A generic OpenID Connect provider, for identity servers gomniauth doesn't
+// know about. Endpoints are discovered from the issuer; user details come from
+// the userinfo endpoint using the access token. The ID token is only used to
+// check the nonce and that the login was issued to us.
+
+const (
+	oidcProviderName = "oidc"
+	oidcStateExpiry  = 10 // minutes
+	oidcStateCookie  = "oidcState"
+)
+
+type oidcEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+}
+
+type oidcProvider struct {
+	issuer, clientID, secret, scopes string
+	client                           *http.Client
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+func newOIDCProvider(cfg *config) *oidcProvider {
+	return &oidcProvider{
+		issuer:   strings.TrimRight(cfg.OIDCIssuer, "/"),
+		clientID: cfg.OIDCClientID,
+		secret:   cfg.OIDCSecret,
+		scopes:   cfg.OIDCScopes,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// fetches the issuer's endpoints the first time they are needed
+func (p *oidcProvider) discover() (*oidcEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	endpoints := &oidcEndpoints{}
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", "", endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.Authorization == "" || endpoints.Token == "" || endpoints.UserInfo == "" {
+		return nil, errgo.New("OpenID Connect discovery is missing endpoints")
+	}
+	p.endpoints = endpoints
+	return endpoints, nil
+}
+
+func (p *oidcProvider) getJSON(endpoint, accessToken string, value interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errgo.Newf("%s returned %s", endpoint, resp.Status)
+	}
+	return errgo.Mask(json.NewDecoder(resp.Body).Decode(value))
+}
+
+// The state and nonce are random values kept in a short-lived cookie in the
+// user's browser. The callback must come back with the same state, and the ID
+// token with the same nonce, so a login started by someone else, or a token
+// issued for another login, is rejected. The cookie is cleared on callback so
+// each login request can only be completed once.
+
+func setStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/auth/oauth2/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// returns the state and nonce stored for the login, clearing them
+func takeStateCookie(w http.ResponseWriter, r *http.Request) (string, string) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return "", ""
+	}
+	setStateCookie(w, "", -1)
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+func equalSecrets(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (p *oidcProvider) getRedirectURL(w http.ResponseWriter, redirectURI string) (string, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	state, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	setStateCookie(w, state+"."+nonce, oidcStateExpiry*60)
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {p.scopes},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	return endpoints.Authorization + "?" + q.Encode(), nil
+}
+
+// reads the claims of the ID token. It comes straight from the token endpoint
+// over TLS, so its signature doesn't need checking (OpenID Connect Core 3.1.3.7).
+func (p *oidcProvider) parseIDToken(idToken string) (*oidcIDToken, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errgo.New("OpenID Connect ID token is malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	claims := &oidcIDToken{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return claims, nil
+}
+
+type oidcIDToken struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"` // a string or a list of strings
+	Nonce    string          `json:"nonce"`
+	Expires  int64           `json:"exp"`
+}
+
+func (t *oidcIDToken) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(t.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(t.Audience, &many) == nil {
+		for _, aud := range many {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// completes the login with the parameters the provider redirected back with
+func (p *oidcProvider) getUserInfo(w http.ResponseWriter, r *http.Request, redirectURI string) (*authInfo, error) {
+	state, nonce := takeStateCookie(w, r)
+	if msg := r.FormValue("error"); msg != "" {
+		return nil, httpError{http.StatusBadRequest, "Login failed: " + msg}
+	}
+	if !equalSecrets(state, r.FormValue("state")) {
+		return nil, httpError{http.StatusBadRequest, "Invalid or expired login request"}
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, httpError{http.StatusBadRequest, "Missing authorization code"}
+	}
+
+	endpoints, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.PostForm(endpoints.Token, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.clientID},
+		"client_secret": {p.secret},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpError{http.StatusBadRequest, fmt.Sprintf("Login failed: token request returned %s", resp.Status)}
+	}
+
+	token := &struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil || token.AccessToken == "" {
+		return nil, errgo.New("OpenID Connect token response has no access token")
+	}
+
+	idToken, err := p.parseIDToken(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Issuer != p.issuer || !idToken.hasAudience(p.clientID) || time.Now().Unix() >= idToken.Expires {
+		return nil, httpError{http.StatusBadRequest, "Login failed: invalid ID token"}
+	}
+	if !equalSecrets(nonce, idToken.Nonce) {
+		return nil, httpError{http.StatusBadRequest, "Invalid or expired login request"}
+	}
+
+	claims := &struct {
+		Subject           string `json:"sub"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}{}
+	if err := p.getJSON(endpoints.UserInfo, token.AccessToken, claims); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.Subject != idToken.Subject {
+		return nil, errgo.New("OpenID Connect userinfo subject doesn't match the ID token")
+	}
+
+	info := &authInfo{
+		provider:      oidcProviderName,
+		id:            claims.Subject,
+		name:          claims.PreferredUsername,
+		email:         strings.ToLower(claims.Email),
+		emailVerified: claims.EmailVerified,
+	}
+	if info.name == "" {
+		info.name = claims.Name
+	}
+	return info, nil
+}
@@ -0,0 +1,146 @@
+package photoshare
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lists can be paged with ?page=N (LIMIT/OFFSET), or with the opaque cursor
+// returned as nextCursor: ?cursor=... continues after the last item of the
+// previous page, so pages stay stable while new photos arrive. Only lists of
+// photos in one of the photoOrderings have cursors.
+//
+//	size=50       page size, between minPageSize and maxPageSize
+//	count=false   skip counting the total number of items
+
+const (
+	minPageSize = 1
+	maxPageSize = 100
+)
+
+// a column or expression in an ORDER BY clause, always descending
+type sortKey struct {
+	expr  string
+	cast  string // SQL type of the cursor value: float8, bigint, timestamp or timestamptz
+	value func(*photo) interface{}
+}
+
+var (
+	sortByID        = sortKey{"id", "bigint", func(p *photo) interface{} { return p.ID }}
+	sortByCreatedAt = sortKey{"created_at", "timestamptz", func(p *photo) interface{} { return p.CreatedAt }}
+
+	sortByCaptureDate = sortKey{captureDateSQL, "timestamp", func(p *photo) interface{} { return p.captureDate() }}
+)
+
+func sortByScore(expr string, value func(*photo) float64) sortKey {
+	return sortKey{expr, "float8", func(p *photo) interface{} { return value(p) }}
+}
+
+// sort keys, the last of which must be unique so keyset pages never overlap
+type photoOrdering []sortKey
+
+func (o photoOrdering) clause() string {
+	var exprs []string
+	for _, key := range o {
+		exprs = append(exprs, key.expr+" DESC")
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// returns the condition for rows after the cursor values, adding them as query params
+func (o photoOrdering) after(values []interface{}, param func(interface{}) string) string {
+	var exprs, params []string
+	for i, key := range o {
+		exprs = append(exprs, key.expr)
+		params = append(params, param(values[i])+"::"+key.cast)
+	}
+	return "(" + strings.Join(exprs, ", ") + ") < (" + strings.Join(params, ", ") + ")"
+}
+
+func (o photoOrdering) values(p *photo) []interface{} {
+	values := make([]interface{}, len(o))
+	for i, key := range o {
+		if key.value != nil {
+			values[i] = key.value(p)
+		}
+	}
+	return values
+}
+
+// returns an error if the page asks for a cursor, for lists without one
+func (p *page) offsetOnly() error {
+	if p.cursor != "" {
+		return validationFailure{map[string]string{"cursor": "This list cannot be paged with a cursor"}}
+	}
+	return nil
+}
+
+type pageCursor struct {
+	Order  string        `json:"o"`
+	Values []interface{} `json:"v"`
+}
+
+func encodeCursor(order string, values []interface{}) (string, error) {
+	b, err := json.Marshal(&pageCursor{order, values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodes the cursor values, which must have been encoded for the same ordering
+func (o photoOrdering) decodeCursor(order, s string) ([]interface{}, error) {
+
+	invalid := validationFailure{map[string]string{"cursor": "Invalid cursor"}}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalid
+	}
+
+	c := &pageCursor{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(c); err != nil || c.Order != order || len(c.Values) != len(o) {
+		return nil, invalid
+	}
+
+	values := make([]interface{}, len(o))
+
+	for i, key := range o {
+		switch v := c.Values[i].(type) {
+		case json.Number:
+			if key.cast == "bigint" {
+				values[i], err = v.Int64()
+			} else if key.cast == "float8" {
+				values[i], err = v.Float64()
+			} else {
+				err = fmt.Errorf("unexpected number")
+			}
+		case string:
+			if key.cast == "timestamp" || key.cast == "timestamptz" {
+				values[i], err = time.Parse(time.RFC3339Nano, v)
+			} else {
+				err = fmt.Errorf("unexpected string")
+			}
+		default:
+			err = fmt.Errorf("unexpected value")
+		}
+		if err != nil {
+			return nil, invalid
+		}
+	}
+	return values, nil
+}
+
+// positional query parameters for queries built up from several parts
+type queryParams []interface{}
+
+func (q *queryParams) add(value interface{}) string {
+	*q = append(*q, value)
+	return fmt.Sprintf("$%d", len(*q))
+}
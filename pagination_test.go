@@ -0,0 +1,60 @@
+package photoshare
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOrderPhotosBy(t *testing.T) {
+	if name, ordering := orderPhotosBy("hot", "latest"); name != "hot" || ordering.clause() != "hot_score DESC, created_at DESC, id DESC" {
+		t.Error("Should order by hot score:", name, ordering.clause())
+	}
+	if name, _ := orderPhotosBy("id; DROP TABLE photos", "latest"); name != "latest" {
+		t.Error("Unknown orderings should use the default")
+	}
+}
+
+func TestPhotoCursor(t *testing.T) {
+	_, ordering := orderPhotosBy("votes", "latest")
+	p := &photo{ID: 42, UpVotes: 10, DownVotes: 3, CreatedAt: time.Date(2014, 6, 1, 12, 30, 0, 123456000, time.UTC)}
+
+	cursor, err := encodeCursor("votes", ordering.values(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := ordering.decodeCursor("votes", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != int64(7) || !values[1].(time.Time).Equal(p.CreatedAt) || values[2] != int64(42) {
+		t.Error("Cursor values should round-trip:", values)
+	}
+
+	var params []interface{}
+	where := ordering.after(values, func(v interface{}) string {
+		params = append(params, v)
+		return fmt.Sprintf("$%d", len(params))
+	})
+	if where != "((up_votes - down_votes), created_at, id) < ($1::bigint, $2::timestamptz, $3::bigint)" {
+		t.Error("Unexpected condition:", where)
+	}
+
+	if _, err := ordering.decodeCursor("latest", cursor); err == nil {
+		t.Error("Cursor should only be valid for the same ordering")
+	}
+	if _, err := ordering.decodeCursor("votes", "not-a-cursor"); err == nil {
+		t.Error("Invalid cursor should fail")
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	page := newPage(3)
+	page.setSize(1000)
+	if page.size != maxPageSize || page.offset != 2*maxPageSize {
+		t.Error("Page size should be limited:", page.size, page.offset)
+	}
+	if page.numPages(201) != 3 {
+		t.Error("There should be 3 pages")
+	}
+}
@@ -2,7 +2,6 @@ package photoshare
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 )
@@ -17,22 +16,18 @@ func deletePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	if !photo.canDelete(ctx.user) {
 		return httpError{http.StatusForbidden, "You're not allowed to delete this photo"}
 	}
-	if err := ctx.datamapper.removePhoto(photo); err != nil {
+
+	// the photo is purged after the retention period, see jobs.go
+	if err := ctx.datamapper.trashPhoto(photo); err != nil {
 		return err
 	}
 
-	go func() {
-		if err := ctx.filestore.clean(photo.Filename); err != nil {
-			log.Println(err)
-		}
-	}()
-
 	if err := ctx.cache.clear(); err != nil {
 		return err
 	}
 
 	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_deleted"})
-	return renderString(w, http.StatusOK, "Photo deleted")
+	return renderString(w, http.StatusOK, "Photo moved to trash")
 }
 
 func getPhotoDetail(ctx *context, w http.ResponseWriter, r *http.Request) error {
@@ -116,6 +111,10 @@ func editPhotoTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
+	if err := ctx.checkVerified(restrictUpload); err != nil {
+		return err
+	}
+
 	title := r.FormValue("title")
 	taglist := r.FormValue("taglist")
 	tags := strings.Split(taglist, " ")
@@ -138,9 +137,14 @@ func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 	filename := generateRandomFilename(contentType)
 
 	photo := &photo{Title: title,
-		OwnerID:  ctx.user.ID,
-		Filename: filename,
-		Tags:     tags,
+		OwnerID:      ctx.user.ID,
+		Filename:     filename,
+		Tags:         tags,
+		ShowLocation: r.FormValue("showLocation") == "true",
+	}
+
+	if err := photo.readMetadata(src); err != nil {
+		return err
 	}
 
 	if err := ctx.filestore.store(src, photo.Filename, contentType); err != nil {
@@ -151,6 +155,10 @@ func upload(ctx *context, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	if err := ctx.datamapper.createPhoto(photo); err != nil {
+		// e.g. a blocked tag: the stored file is not needed
+		if err := ctx.filestore.clean(photo.Filename); err != nil {
+			logError(err)
+		}
 		return err
 	}
 	if err := ctx.cache.clear(); err != nil {
@@ -165,10 +173,11 @@ func searchPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	page := getPage(r)
 	q := r.FormValue("q")
-	cacheKey := fmt.Sprintf("photos:search:%s:page:%d", q, page.index)
+	orderBy := r.FormValue("orderBy")
+	cacheKey := fmt.Sprintf("photos:search:%s:%s:%s", q, orderBy, page.cacheKey())
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.searchPhotos(page, q)
+		photos, err := ctx.datamapper.searchPhotos(page, q, orderBy)
 		if err != nil {
 			return photos, err
 		}
@@ -181,10 +190,11 @@ func photosByOwnerID(ctx *context, w http.ResponseWriter, r *http.Request) error
 
 	page := getPage(r)
 	ownerID := ctx.params.getInt("ownerID")
-	cacheKey := fmt.Sprintf("photos:ownerID:%d:page:%d", ownerID, page.index)
+	orderBy := r.FormValue("orderBy")
+	cacheKey := fmt.Sprintf("photos:ownerID:%d:%s:%s", ownerID, orderBy, page.cacheKey())
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
-		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID)
+		photos, err := ctx.datamapper.getPhotosByOwnerID(page, ownerID, orderBy)
 		if err != nil {
 			return photos, err
 		}
@@ -196,7 +206,7 @@ func getPhotos(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
 	page := getPage(r)
 	orderBy := r.FormValue("orderBy")
-	cacheKey := fmt.Sprintf("photos:%s:page:%d", orderBy, page.index)
+	cacheKey := fmt.Sprintf("photos:%s:%s", orderBy, page.cacheKey())
 
 	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
 		photos, err := ctx.datamapper.getPhotos(page, orderBy)
@@ -219,14 +229,18 @@ func getTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
 }
 
 func voteDown(ctx *context, w http.ResponseWriter, r *http.Request) error {
-	return vote(ctx, w, r, func(photo *photo) { photo.DownVotes++ })
+	return vote(ctx, w, r, downVote)
 }
 
 func voteUp(ctx *context, w http.ResponseWriter, r *http.Request) error {
-	return vote(ctx, w, r, func(photo *photo) { photo.UpVotes++ })
+	return vote(ctx, w, r, upVote)
 }
 
-func vote(ctx *context, w http.ResponseWriter, r *http.Request, fn func(photo *photo)) error {
+func vote(ctx *context, w http.ResponseWriter, r *http.Request, direction int64) error {
+
+	if err := ctx.checkVerified(restrictVote); err != nil {
+		return err
+	}
 
 	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
 	if err != nil {
@@ -237,13 +251,72 @@ func vote(ctx *context, w http.ResponseWriter, r *http.Request, fn func(photo *p
 		return httpError{http.StatusForbidden, "You're not allowed to vote on this photo"}
 	}
 
-	fn(photo)
+	ok, err := ctx.datamapper.registerVote(photo, ctx.user, direction)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusForbidden, "You have already voted on this photo"}
+	}
+
+	return renderString(w, http.StatusOK, "Voting successful")
+}
 
-	ctx.user.registerVote(photo.ID)
+func retractVote(ctx *context, w http.ResponseWriter, r *http.Request) error {
 
-	if err := ctx.datamapper.updateMany(photo, ctx.user); err != nil {
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
 		return err
 	}
 
-	return renderString(w, http.StatusOK, "Voting successful")
+	ok, err := ctx.datamapper.removeVote(photo, ctx.user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusBadRequest, "You have not voted on this photo"}
+	}
+
+	return renderString(w, http.StatusOK, "Vote removed")
+}
+
+func addFavorite(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if !photo.canFavorite(ctx.user) {
+		return httpError{http.StatusForbidden, "You're not allowed to favorite this photo"}
+	}
+
+	if err := ctx.datamapper.addFavorite(photo, ctx.user); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Photo added to favorites")
+}
+
+func removeFavorite(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := ctx.datamapper.getPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.removeFavorite(photo, ctx.user); err != nil {
+		return err
+	}
+
+	return renderString(w, http.StatusOK, "Photo removed from favorites")
+}
+
+func getFavorites(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photos, err := ctx.datamapper.getFavorites(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, photos, http.StatusOK)
 }
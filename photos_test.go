@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type mockCache struct{}
@@ -38,18 +39,34 @@ func (m *mockCache) render(w http.ResponseWriter, status int, key string, fn fun
 type mockSessionManager struct {
 }
 
-func (m *mockSessionManager) readToken(r *http.Request) (int64, error) {
-	return 0, nil
+func (m *mockSessionManager) readToken(r *http.Request) (*accessToken, error) {
+	return &accessToken{}, nil
 }
 
-func (m *mockSessionManager) createToken(userID int64) (string, error) {
+func (m *mockSessionManager) createToken(userID, sessionID int64) (string, error) {
 	return strconv.FormatInt(userID, 10), nil
 }
 
-func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
+func (m *mockSessionManager) writeToken(w http.ResponseWriter, userID, sessionID int64) error {
 	return nil
 }
 
+func (m *mockSessionManager) createIdentityToken(info *authInfo) (string, error) {
+	return info.provider + ":" + info.id, nil
+}
+
+func (m *mockSessionManager) readIdentityToken(token string) (*authInfo, error) {
+	return nil, httpError{http.StatusBadRequest, "Invalid or expired identity token"}
+}
+
+func (m *mockSessionManager) createTwoFactorToken(userID int64) (string, error) {
+	return strconv.FormatInt(userID, 10), nil
+}
+
+func (m *mockSessionManager) readTwoFactorToken(token string) (int64, error) {
+	return 0, httpError{http.StatusBadRequest, "Invalid or expired two-factor token"}
+}
+
 type mockDataMapper struct {
 }
 
@@ -80,21 +97,276 @@ func (m *mockDataMapper) getPhotos(page *page, orderBy string) (*photoList, erro
 		OwnerID: 1,
 	}
 	photos := []photo{*item}
-	return newPhotoList(photos, 1, 1), nil
+	return newPhotoList(photos, 1, page), nil
+}
+
+func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64, orderBy string) (*photoList, error) {
+	return &photoList{}, nil
 }
 
-func (m *mockDataMapper) getPhotosByOwnerID(page *page, ownerID int64) (*photoList, error) {
+func (m *mockDataMapper) getFavorites(page *page, userID int64) (*photoList, error) {
 	return &photoList{}, nil
 }
 
-func (m *mockDataMapper) searchPhotos(page *page, q string) (*photoList, error) {
+func (m *mockDataMapper) getTimeline(page *page, userID int64) (*photoList, error) {
 	return &photoList{}, nil
 }
 
+func (m *mockDataMapper) getFollowers(page *page, userID int64) (*userList, error) {
+	return &userList{}, nil
+}
+
+func (m *mockDataMapper) getFollowing(page *page, userID int64) (*userList, error) {
+	return &userList{}, nil
+}
+
+func (m *mockDataMapper) searchPhotos(page *page, q string, orderBy string) (*searchResultList, error) {
+	return &searchResultList{}, nil
+}
+
+func (m *mockDataMapper) refreshTrendingScores() error {
+	return nil
+}
+
 func (m *mockDataMapper) getTagCounts() ([]tagCount, error) {
 	return []tagCount{}, nil
 }
 
+func (m *mockDataMapper) getTagsByPrefix(prefix string, limit int64) ([]tagSuggestion, error) {
+	return []tagSuggestion{{"travel", 2}}, nil
+}
+
+func (m *mockDataMapper) getRelatedTags(names []string, limit int64) ([]tagSuggestion, error) {
+	return []tagSuggestion{}, nil
+}
+
+func (m *mockDataMapper) getTag(name string) (*tag, error) {
+	return &tag{Name: name}, nil
+}
+
+func (m *mockDataMapper) getTagTree() ([]*tagNode, error) {
+	return []*tagNode{}, nil
+}
+
+func (m *mockDataMapper) renameTag(tag *tag, name string) error {
+	return nil
+}
+
+func (m *mockDataMapper) mergeTags(source, target *tag) error {
+	return nil
+}
+
+func (m *mockDataMapper) getTagSynonyms() ([]tagSynonym, error) {
+	return []tagSynonym{}, nil
+}
+
+func (m *mockDataMapper) addTagSynonym(tag *tag, name string) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeTagSynonym(name string) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getBlockedTags() ([]blockedTag, error) {
+	return []blockedTag{}, nil
+}
+
+func (m *mockDataMapper) blockTag(name string) error {
+	return nil
+}
+
+func (m *mockDataMapper) unblockTag(name string) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getPhotoMap(box *boundingBox, cellSize float64) ([]mapCluster, error) {
+	return []mapCluster{}, nil
+}
+
+func (m *mockDataMapper) getPhotoCalendar(scope *photoScope, group string) ([]dateCount, error) {
+	return []dateCount{}, nil
+}
+
+func (m *mockDataMapper) getPhotosByDate(page *page, scope *photoScope, from, to time.Time) (*photoList, error) {
+	return newPhotoList([]photo{}, 0, page), nil
+}
+
+func (m *mockDataMapper) getTrashedPhoto(photoID int64) (*photo, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) trashPhoto(photo *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) restorePhoto(photo *photo) error {
+	return nil
+}
+
+func (m *mockDataMapper) getTrash(page *page, ownerID int64) (*trashList, error) {
+	return newTrashList([]photo{}, 0, page), nil
+}
+
+func (m *mockDataMapper) getExpiredTrash(deletedBefore time.Time) ([]photo, error) {
+	return []photo{}, nil
+}
+
+func (m *mockDataMapper) getPhotosByIDs(ids []int64) ([]photo, error) {
+	var photos []photo
+	for _, id := range ids {
+		if id < 10 {
+			photos = append(photos, photo{ID: id, Title: "test", OwnerID: id % 2})
+		}
+	}
+	return photos, nil
+}
+
+func (m *mockDataMapper) getPhotosBySearch(q string, ownerID int64, limit int64) ([]photo, error) {
+	return []photo{}, nil
+}
+
+func (m *mockDataMapper) bulkEditPhotos(photos []*photo, edit *bulkEdit) error {
+	return nil
+}
+
+func (m *mockDataMapper) createAlbum(album *album) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeAlbum(album *album) error {
+	return nil
+}
+
+// albums are owned by the user with the same ID
+func (m *mockDataMapper) getAlbum(albumID int64) (*album, error) {
+	return &album{ID: albumID, OwnerID: albumID, Name: "test"}, nil
+}
+
+func (m *mockDataMapper) getAlbums(ownerID int64) ([]album, error) {
+	return []album{}, nil
+}
+
+func (m *mockDataMapper) getPhotosByAlbum(page *page, albumID int64, orderBy string) (*photoList, error) {
+	return newPhotoList([]photo{}, 0, page), nil
+}
+
+func (m *mockDataMapper) createSession(s *userSession) error {
+	return nil
+}
+
+func (m *mockDataMapper) rotateSession(s *userSession) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) getSessionByToken(hash string) (*userSession, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getSessions(userID int64) ([]userSession, error) {
+	return []userSession{}, nil
+}
+
+func (m *mockDataMapper) isSessionActive(sessionID, userID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) revokeSession(userID, sessionID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) revokeSessions(userID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeExpiredSessions(before time.Time) error {
+	return nil
+}
+
+func (m *mockDataMapper) createAPIToken(t *apiToken) error {
+	return nil
+}
+
+func (m *mockDataMapper) getAPIToken(hash string) (*apiToken, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getAPITokens(userID int64) ([]apiToken, error) {
+	return []apiToken{}, nil
+}
+
+func (m *mockDataMapper) touchAPIToken(tokenID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeAPIToken(userID, tokenID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) removeAPITokens(userID int64) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) getUserByIdentity(provider, providerUserID string) (*user, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) createUserWithIdentity(user *user, identity *userIdentity) error {
+	return nil
+}
+
+func (m *mockDataMapper) addIdentity(identity *userIdentity) error {
+	return nil
+}
+
+func (m *mockDataMapper) getIdentities(userID int64) ([]userIdentity, error) {
+	return []userIdentity{}, nil
+}
+
+func (m *mockDataMapper) removeIdentity(userID, identityID int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) setBackupCodes(userID int64, hashes []string) error {
+	return nil
+}
+
+func (m *mockDataMapper) useTOTPStep(userID, step int64) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) useBackupCode(userID int64, hash string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockDataMapper) getBackupCodeCount(userID int64) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockDataMapper) resetTwoFactor(userID int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) getThrottle(key string) (*throttle, error) {
+	return &throttle{Key: key}, nil
+}
+
+func (m *mockDataMapper) addThrottleFailure(key string, now, window time.Time) (int64, error) {
+	return 1, nil
+}
+
+func (m *mockDataMapper) blockThrottle(key string, until time.Time) error {
+	return nil
+}
+
+func (m *mockDataMapper) clearThrottle(key string) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeExpiredThrottles(before time.Time) error {
+	return nil
+}
+
 func (m *mockDataMapper) getActiveUser(userID int64) (*user, error) {
 	return &user{}, nil
 }
@@ -115,10 +387,54 @@ func (m *mockDataMapper) getUserByNameOrEmail(identifier string) (*user, error)
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) deleteUser(userID int64, removePhotos bool) ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *mockDataMapper) createExport(export *dataExport) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateExport(export *dataExport) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeExport(export *dataExport) error {
+	return nil
+}
+
+func (m *mockDataMapper) getExports(userID int64) ([]dataExport, error) {
+	return []dataExport{}, nil
+}
+
+func (m *mockDataMapper) getPendingExports() ([]dataExport, error) {
+	return []dataExport{}, nil
+}
+
+func (m *mockDataMapper) getExpiredExports(before time.Time) ([]dataExport, error) {
+	return []dataExport{}, nil
+}
+
+func (m *mockDataMapper) getExportByToken(tokenHash string) (*dataExport, error) {
+	return &dataExport{}, nil
+}
+
+func (m *mockDataMapper) getUserData(userID int64) (*userData, error) {
+	return &userData{}, nil
+}
+
 func (m *mockDataMapper) getUserByRecoveryCode(code string) (*user, error) {
 	return &user{}, nil
 }
 
+func (m *mockDataMapper) getUserByVerifyToken(tokenHash string) (*user, error) {
+	return &user{}, nil
+}
+
+func (m *mockDataMapper) getUserByEmailChangeToken(tokenHash string) (*user, error) {
+	return &user{}, nil
+}
+
 func (m *mockDataMapper) createPhoto(_ *photo) error {
 	return nil
 }
@@ -147,13 +463,65 @@ func (m *mockDataMapper) updateMany(items ...interface{}) error {
 	return nil
 }
 
+func (m *mockDataMapper) createComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) updateComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeComment(_ *comment) error {
+	return nil
+}
+
+func (m *mockDataMapper) addFavorite(_ *photo, _ *user) error {
+	return nil
+}
+
+func (m *mockDataMapper) removeFavorite(_ *photo, _ *user) error {
+	return nil
+}
+
+func (m *mockDataMapper) registerVote(_ *photo, _ *user, _ int64) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) removeVote(_ *photo, _ *user) (bool, error) {
+	return true, nil
+}
+
+func (m *mockDataMapper) followUser(_, _ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) unfollowUser(_, _ int64) error {
+	return nil
+}
+
+func (m *mockDataMapper) followTag(_ int64, _ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) unfollowTag(_ int64, _ string) error {
+	return nil
+}
+
+func (m *mockDataMapper) getComment(commentID int64) (*comment, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *mockDataMapper) getComments(page *page, photo *photo, user *user) (*commentList, error) {
+	return &commentList{}, nil
+}
+
 type emptyDataStore struct {
 	mockDataMapper
 }
 
 func (m *emptyDataStore) getPhotos(page *page, orderBy string) (*photoList, error) {
 	var photos []photo
-	return &photoList{photos, 0, 1, 0}, nil
+	return newPhotoList(photos, 0, page), nil
 }
 
 func (m *emptyDataStore) getPhotoDetail(photoID int64, user *user) (*photoDetail, error) {
@@ -213,6 +581,29 @@ func TestGetPhotoDetail(t *testing.T) {
 	}
 }
 
+func TestCanDeleteComment(t *testing.T) {
+	photo := &photo{ID: 1, OwnerID: 1}
+	comment := &comment{ID: 1, PhotoID: 1, OwnerID: 2}
+
+	user := &user{ID: 3, IsAuthenticated: true}
+	if comment.canDelete(user, photo) {
+		t.Error("Other users should not be able to delete the comment")
+	}
+
+	user.ID = 2
+	if !comment.canDelete(user, photo) {
+		t.Error("Comment owner should be able to delete the comment")
+	}
+
+	user.ID = 1
+	if comment.canEdit(user) {
+		t.Error("Photo owner should not be able to edit the comment")
+	}
+	if !comment.canDelete(user, photo) {
+		t.Error("Photo owner should be able to delete the comment")
+	}
+}
+
 func TestGetPhotos(t *testing.T) {
 
 	req := &http.Request{}
@@ -236,3 +627,31 @@ func TestGetPhotos(t *testing.T) {
 	}
 
 }
+
+func TestAutocompleteTags(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/tags/autocomplete?q=tr&limit=500", nil)
+	res := httptest.NewRecorder()
+
+	app := &app{
+		datamapper: &mockDataMapper{},
+		cache:      &mockCache{},
+	}
+
+	c := &context{
+		app:    app,
+		params: &params{},
+	}
+
+	if err := autocompleteTags(c, res, req); err != nil {
+		t.Fatal(err)
+	}
+	var value []tagSuggestion
+	parseJSONBody(res, &value)
+	if len(value) != 1 || value[0].Name != "travel" {
+		t.Error("Should suggest travel")
+	}
+	if getSuggestionLimit(req) != maxTagSuggestions {
+		t.Error("Limit should be capped")
+	}
+}
@@ -0,0 +1,296 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxWebsiteLength     = 200
+)
+
+// what to do with a deleted user's photos
+const (
+	photosAnonymize = "anonymize" // keep them, no longer under the user's name
+	photosRemove    = "remove"
+)
+
+// the name left on a deleted user's comments and anonymized photos
+func deletedUserName(userID int64) string {
+	return fmt.Sprintf("deleted-%d", userID)
+}
+
+type profile struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+	Bio         string    `json:"bio"`
+	Website     string    `json:"website"`
+	Avatar      string    `json:"avatar"` // filename, the thumbnail is the avatar
+	CreatedAt   time.Time `json:"createdAt"`
+
+	// only shown to the user themselves
+	Email         string `json:"email,omitempty"`
+	PendingEmail  string `json:"pendingEmail,omitempty"`
+	EmailVerified bool   `json:"emailVerified,omitempty"`
+}
+
+func newProfile(user *user, private bool) *profile {
+	p := &profile{
+		ID:          user.ID,
+		Name:        user.Name,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		Website:     user.Website,
+		Avatar:      user.Avatar,
+		CreatedAt:   user.CreatedAt,
+	}
+	if private {
+		p.Email = user.Email
+		p.PendingEmail = user.PendingEmail.String
+		p.EmailVerified = user.EmailVerified
+	}
+	return p
+}
+
+// changes to the current user's profile; missing fields are left as they are
+type profileUpdate struct {
+	Name        *string `json:"name"`
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	Website     *string `json:"website"`
+}
+
+func (p *profileUpdate) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	if p.Name != nil {
+		*p.Name = strings.TrimSpace(*p.Name)
+		if *p.Name == "" {
+			errors["name"] = "Name is missing"
+		} else {
+			ok, err := ctx.datamapper.isUserNameAvailable(&user{ID: ctx.user.ID, Name: *p.Name})
+			if err != nil {
+				return err
+			}
+			if !ok {
+				errors["name"] = "Name already taken"
+			}
+		}
+	}
+	if p.DisplayName != nil {
+		*p.DisplayName = strings.TrimSpace(*p.DisplayName)
+		if len(*p.DisplayName) > maxDisplayNameLength {
+			errors["displayName"] = fmt.Sprintf("Display name must be no more than %d characters", maxDisplayNameLength)
+		}
+	}
+	if p.Bio != nil {
+		*p.Bio = strings.TrimSpace(*p.Bio)
+		if len(*p.Bio) > maxBioLength {
+			errors["bio"] = fmt.Sprintf("Bio must be no more than %d characters", maxBioLength)
+		}
+	}
+	if p.Website != nil {
+		*p.Website = strings.TrimSpace(*p.Website)
+		if len(*p.Website) > maxWebsiteLength {
+			errors["website"] = fmt.Sprintf("Website must be no more than %d characters", maxWebsiteLength)
+		} else if *p.Website != "" && !validateWebsite(*p.Website) {
+			errors["website"] = "Website must be an http or https address"
+		}
+	}
+	return nil
+}
+
+func (p *profileUpdate) apply(user *user) {
+	if p.Name != nil {
+		user.Name = *p.Name
+	}
+	if p.DisplayName != nil {
+		user.DisplayName = *p.DisplayName
+	}
+	if p.Bio != nil {
+		user.Bio = *p.Bio
+	}
+	if p.Website != nil {
+		user.Website = *p.Website
+	}
+}
+
+func validateWebsite(website string) bool {
+	u, err := url.Parse(website)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func getProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	user, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, newProfile(user, false), http.StatusOK)
+}
+
+func getOwnProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+}
+
+func updateProfile(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &profileUpdate{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+	if err := ctx.validate(s, r); err != nil {
+		return err
+	}
+
+	s.apply(ctx.user)
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+	return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+}
+
+// stores the avatar like a photo upload, so its thumbnail can be shown
+func updateAvatar(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if err := ctx.checkVerified(restrictUpload); err != nil {
+		return err
+	}
+
+	src, hdr, err := r.FormFile("avatar")
+	if err != nil {
+		if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+			return httpError{http.StatusBadRequest, "Invalid image"}
+		}
+		return err
+	}
+	defer src.Close()
+
+	contentType := hdr.Header.Get("Content-Type")
+
+	if !isAllowedContentType(contentType) {
+		return httpError{http.StatusBadRequest, "Only JPEG, PNG or GIF files allowed"}
+	}
+
+	filename := generateRandomFilename(contentType)
+
+	if err := ctx.filestore.store(src, filename, contentType); err != nil {
+		return err
+	}
+
+	previous := ctx.user.Avatar
+	ctx.user.Avatar = filename
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		if err := ctx.filestore.clean(filename); err != nil {
+			logError(err)
+		}
+		return err
+	}
+	ctx.removeAvatarFile(previous)
+
+	return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+}
+
+func removeAvatar(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	previous := ctx.user.Avatar
+	ctx.user.Avatar = ""
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+	ctx.removeAvatarFile(previous)
+
+	return renderJSON(w, newProfile(ctx.user, true), http.StatusOK)
+}
+
+func (ctx *context) removeAvatarFile(filename string) {
+	if filename == "" {
+		return
+	}
+	if err := ctx.filestore.clean(filename); err != nil {
+		logError(err)
+	}
+}
+
+// deletes the current user's account. Their photos are removed or kept
+// anonymously as they choose; their comments stay under a placeholder name.
+func deleteAccount(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Password string `json:"password"`
+		Code     string `json:"code"` // two-factor code, if enabled
+		Photos   string `json:"photos"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.Photos != photosAnonymize && s.Photos != photosRemove {
+		return validationFailure{map[string]string{
+			"photos": fmt.Sprintf("Photos must be %s or %s", photosAnonymize, photosRemove),
+		}}
+	}
+
+	// users who only log in with an external provider have no password to confirm
+	if ctx.user.Password != "" && !ctx.user.checkPassword(s.Password) {
+		return validationFailure{map[string]string{"password": "Password is incorrect"}}
+	}
+
+	if ctx.user.TOTPEnabled {
+		ok, err := ctx.checkTwoFactorCode(ctx.user, s.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidTwoFactorCode
+		}
+	}
+
+	user := *ctx.user
+	removePhotos := s.Photos == photosRemove
+
+	// the archives of the user's data go with the account
+	exports, err := ctx.datamapper.getExports(user.ID)
+	if err != nil {
+		return err
+	}
+
+	filenames, err := ctx.datamapper.deleteUser(user.ID, removePhotos)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		if err := ctx.filestore.clean(filename); err != nil {
+			logError(err)
+		}
+	}
+	ctx.removeAvatarFile(user.Avatar)
+	for _, export := range exports {
+		ctx.removeExportFile(export.Filename)
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	if err := ctx.session.writeToken(w, 0, 0); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.mailer.sendAccountDeletedMail(user.Name, user.Email, removePhotos); err != nil {
+			logError(err)
+		}
+	}()
+
+	sendMessage(&socketMessage{user.Name, "", 0, "logout"})
+	return renderString(w, http.StatusOK, "Account deleted")
+}
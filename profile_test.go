@@ -0,0 +1,38 @@
+package photoshare
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpdateAvatarUnverified(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://localhost/api/auth/profile/avatar", nil)
+	c := &context{
+		app: &app{
+			cfg:        &config{UnverifiedRestrictions: "upload"},
+			datamapper: &mockDataMapper{},
+			cache:      &mockCache{},
+		},
+		params: &params{make(map[string]string)},
+		user:   &user{ID: 1, IsAuthenticated: true},
+	}
+	err := updateAvatar(c, httptest.NewRecorder(), req)
+	if e, ok := err.(httpError); !ok || e.Status != http.StatusForbidden {
+		t.Error("Unverified user should not upload an avatar:", err)
+	}
+}
+
+func TestValidateWebsite(t *testing.T) {
+	for website, valid := range map[string]bool{
+		"https://example.com":      true,
+		"http://example.com/me":    true,
+		"example.com":              false,
+		"javascript:alert('hi')":   false,
+		"ftp://example.com/photos": false,
+	} {
+		if validateWebsite(website) != valid {
+			t.Errorf("%s should be valid: %v", website, valid)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package photoshare
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search query language:
+//
+//	cats "new york"      photos matching all terms; quotes for phrases
+//	cats OR dogs         either term
+//	-cats                exclude term
+//	tag:travel #travel   tag, including descendants such as travel/japan
+//	user:bob @bob        owner name
+//	before:2014-06-01    uploaded before date (YYYY, YYYY-MM or YYYY-MM-DD)
+//	after:2014-06        uploaded after date
+//	votes:>10            net votes, with >, >=, <, <= or =
+//	camera:canon         camera model
+//	near:35.01,135.76,5  within 5 km (default 10) of a latitude and longitude
+//	sort:hot             sort order, see photoOrderings
+
+const maxSearchTerms = 20
+
+var (
+	votesFilterRegex = regexp.MustCompile(`^(>=|<=|>|<|=)?(-?\d+)$`)
+	searchFields     = map[string]bool{
+		"tag":    true,
+		"user":   true,
+		"before": true,
+		"after":  true,
+		"votes":  true,
+		"camera": true,
+		"near":   true,
+		"sort":   true,
+	}
+)
+
+type searchToken struct {
+	field   string // empty for plain text
+	value   string
+	quoted  bool
+	negated bool
+	isOr    bool
+}
+
+type searchQuery struct {
+	root     searchNode    // nil if query has no terms
+	keywords []*searchText // non-negated text terms, used for ranking
+	sort     string
+}
+
+// returns the FROM and WHERE clauses for photos p matching the query, excluding the trash
+func (query *searchQuery) toSQL(b *searchBuilder) (string, string) {
+	from := "photos p"
+	where := " WHERE p.deleted_at IS NULL AND " + query.root.toSQL(b)
+	if b.useDocument {
+		from += " JOIN photo_search ps ON ps.photo_id = p.id"
+	}
+	return from, where
+}
+
+type searchNode interface {
+	toSQL(b *searchBuilder) string
+}
+
+// collects query parameters and the tables the query needs
+type searchBuilder struct {
+	params      []interface{}
+	useDocument bool
+}
+
+func (b *searchBuilder) param(value interface{}) string {
+	b.params = append(b.params, value)
+	return fmt.Sprintf("$%d", len(b.params))
+}
+
+type searchAnd []searchNode
+
+func (n searchAnd) toSQL(b *searchBuilder) string {
+	return joinSearchNodes(b, n, " AND ")
+}
+
+type searchOr []searchNode
+
+func (n searchOr) toSQL(b *searchBuilder) string {
+	return joinSearchNodes(b, n, " OR ")
+}
+
+func joinSearchNodes(b *searchBuilder, nodes []searchNode, sep string) string {
+	var clauses []string
+	for _, node := range nodes {
+		clauses = append(clauses, node.toSQL(b))
+	}
+	return "(" + strings.Join(clauses, sep) + ")"
+}
+
+type searchNot struct {
+	node searchNode
+}
+
+func (n *searchNot) toSQL(b *searchBuilder) string {
+	// a text term with only stop words matches nothing, so excludes nothing
+	if text, ok := n.node.(*searchText); ok {
+		return "NOT (" + text.match(b, b.param(text.text)) + ")"
+	}
+	return "NOT " + n.node.toSQL(b)
+}
+
+type searchText struct {
+	text   string
+	phrase bool
+}
+
+func (n *searchText) tsquery(param string) string {
+	if n.phrase {
+		return "phraseto_tsquery('english', " + param + ")"
+	}
+	return "plainto_tsquery('english', " + param + ")"
+}
+
+func (n *searchText) match(b *searchBuilder, param string) string {
+	b.useDocument = true
+	return "ps.document @@ " + n.tsquery(param)
+}
+
+func (n *searchText) toSQL(b *searchBuilder) string {
+	// stop words such as "the" are ignored rather than matching nothing
+	param := b.param(n.text)
+	return "(" + n.match(b, param) + " OR numnode(" + n.tsquery(param) + ") = 0)"
+}
+
+type searchTag struct {
+	name string
+}
+
+// also matches descendants, e.g. tag:travel matches travel/japan
+func (n *searchTag) toSQL(b *searchBuilder) string {
+	return "p.id IN (SELECT pt.photo_id FROM photo_tags pt JOIN tags t ON t.id = pt.tag_id " +
+		"WHERE t.name = " + b.param(n.name) + " OR t.name LIKE " +
+		b.param(escapeLike(n.name)+tagPathSeparator+"%") + ")"
+}
+
+type searchUser struct {
+	name string
+}
+
+func (n *searchUser) toSQL(b *searchBuilder) string {
+	return "p.owner_id IN (SELECT id FROM users WHERE UPPER(name::text) = UPPER(" + b.param(n.name) + "))"
+}
+
+type searchDate struct {
+	op   string
+	date time.Time
+}
+
+func (n *searchDate) toSQL(b *searchBuilder) string {
+	return "p.created_at " + n.op + " " + b.param(n.date)
+}
+
+type searchVotes struct {
+	op    string
+	votes int64
+}
+
+func (n *searchVotes) toSQL(b *searchBuilder) string {
+	return "(p.up_votes - p.down_votes) " + n.op + " " + b.param(n.votes)
+}
+
+type searchCamera struct {
+	name string
+}
+
+func (n *searchCamera) toSQL(b *searchBuilder) string {
+	return "p.camera ILIKE " + b.param("%"+escapeLike(n.name)+"%")
+}
+
+type searchNear struct {
+	lat, lng, radius float64
+}
+
+// the latitude range lets the location index narrow down the rows first
+func (n *searchNear) toSQL(b *searchBuilder) string {
+	delta := n.radius / kmPerDegree
+	return "(p.show_location AND p.latitude BETWEEN " + b.param(n.lat-delta) + " AND " + b.param(n.lat+delta) +
+		" AND distance_km(p.latitude, p.longitude, " + b.param(n.lat) + ", " + b.param(n.lng) + ") <= " +
+		b.param(n.radius) + ")"
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func searchError(format string, args ...interface{}) error {
+	return validationFailure{map[string]string{"q": fmt.Sprintf(format, args...)}}
+}
+
+// splits the query into tokens, handling quotes, negation and field prefixes
+func tokenizeSearchQuery(q string) ([]searchToken, error) {
+	var (
+		tokens []searchToken
+		runes  = []rune(q)
+		pos    = 0
+	)
+
+	var readQuoted = func() (string, error) {
+		start := pos
+		pos++
+		for pos < len(runes) && runes[pos] != '"' {
+			pos++
+		}
+		if pos == len(runes) {
+			return "", searchError("Missing closing quote after %s", string(runes[start:]))
+		}
+		pos++
+		return strings.TrimSpace(string(runes[start+1 : pos-1])), nil
+	}
+
+	var readWord = func() string {
+		start := pos
+		for pos < len(runes) && !unicode.IsSpace(runes[pos]) {
+			pos++
+		}
+		return string(runes[start:pos])
+	}
+
+	for {
+		for pos < len(runes) && unicode.IsSpace(runes[pos]) {
+			pos++
+		}
+		if pos == len(runes) {
+			return tokens, nil
+		}
+
+		token := searchToken{}
+
+		if runes[pos] == '-' && pos+1 < len(runes) && !unicode.IsSpace(runes[pos+1]) {
+			token.negated = true
+			pos++
+		}
+
+		if runes[pos] == '"' {
+			value, err := readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			if value == "" {
+				continue
+			}
+			token.value = value
+			token.quoted = true
+			tokens = append(tokens, token)
+			continue
+		}
+
+		start := pos
+		word := readWord()
+
+		if word == "OR" && !token.negated {
+			tokens = append(tokens, searchToken{isOr: true})
+			continue
+		}
+
+		if strings.HasPrefix(word, "@") && len(word) > 1 {
+			token.field, token.value = "user", word[1:]
+			tokens = append(tokens, token)
+			continue
+		}
+
+		if strings.HasPrefix(word, "#") && len(word) > 1 {
+			token.field, token.value = "tag", word[1:]
+			tokens = append(tokens, token)
+			continue
+		}
+
+		if i := strings.Index(word, ":"); i > 0 && searchFields[strings.ToLower(word[:i])] {
+			token.field = strings.ToLower(word[:i])
+			// field value may be quoted, e.g. camera:"canon eos"
+			pos = start + len([]rune(word[:i+1]))
+			if pos < len(runes) && runes[pos] == '"' {
+				value, err := readQuoted()
+				if err != nil {
+					return nil, err
+				}
+				token.value = value
+				token.quoted = true
+			} else {
+				token.value = readWord()
+			}
+			if token.value == "" {
+				return nil, searchError("Missing value for %s:", token.field)
+			}
+			tokens = append(tokens, token)
+			continue
+		}
+
+		token.value = word
+		tokens = append(tokens, token)
+	}
+}
+
+// parses the query into a tree of AND-ed terms, each of which may be a group of OR-ed terms
+func parseSearchQuery(q string) (*searchQuery, error) {
+
+	tokens, err := tokenizeSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &searchQuery{}
+
+	var (
+		groups   searchAnd
+		current  searchOr
+		numTerms int
+		afterOr  bool
+	)
+
+	for i, token := range tokens {
+		if token.isOr {
+			if current == nil || afterOr || i == len(tokens)-1 {
+				return nil, searchError("OR must be placed between two search terms")
+			}
+			afterOr = true
+			continue
+		}
+
+		if token.field == "sort" {
+			if token.negated || afterOr || (i+1 < len(tokens) && tokens[i+1].isOr) {
+				return nil, searchError("sort: cannot be negated or combined with OR")
+			}
+			if err := validateSearchSort(token.value); err != nil {
+				return nil, err
+			}
+			query.sort = strings.ToLower(token.value)
+			continue
+		}
+
+		numTerms++
+		if numTerms > maxSearchTerms {
+			return nil, searchError("Too many search terms (maximum is %d)", maxSearchTerms)
+		}
+
+		node, err := newSearchNode(token)
+		if err != nil {
+			return nil, err
+		}
+		if text, ok := node.(*searchText); ok && !token.negated {
+			query.keywords = append(query.keywords, text)
+		}
+		if token.negated {
+			node = &searchNot{node}
+		}
+
+		if afterOr {
+			current = append(current, node)
+			afterOr = false
+			continue
+		}
+
+		if current != nil {
+			groups = append(groups, groupSearchNodes(current))
+		}
+		current = searchOr{node}
+	}
+
+	if current != nil {
+		groups = append(groups, groupSearchNodes(current))
+	}
+
+	switch len(groups) {
+	case 0:
+	case 1:
+		query.root = groups[0]
+	default:
+		query.root = groups
+	}
+
+	return query, nil
+}
+
+func groupSearchNodes(nodes searchOr) searchNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return nodes
+}
+
+func newSearchNode(token searchToken) (searchNode, error) {
+	switch token.field {
+	case "":
+		return &searchText{token.value, token.quoted}, nil
+	case "tag":
+		return &searchTag{cleanTagName(token.value)}, nil
+	case "user":
+		return &searchUser{token.value}, nil
+	case "camera":
+		return &searchCamera{token.value}, nil
+	case "before", "after":
+		return newSearchDate(token.field, token.value)
+	case "near":
+		return newSearchNear(token.value)
+	case "votes":
+		match := votesFilterRegex.FindStringSubmatch(token.value)
+		if match == nil {
+			return nil, searchError("Invalid votes filter %q: use a number with an optional >, >=, <, <= or =, e.g. votes:>10", token.value)
+		}
+		op := match[1]
+		if op == "" {
+			op = "="
+		}
+		votes, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, searchError("Invalid number of votes %q", match[2])
+		}
+		return &searchVotes{op, votes}, nil
+	}
+	return nil, searchError("Unknown search field %s:", token.field)
+}
+
+// dates can be a year, month or day: before: is the start of the period, after: the end
+func newSearchDate(field, value string) (searchNode, error) {
+	start, end, ok := parseDatePeriod(value)
+	if !ok {
+		return nil, searchError("Invalid date %q for %s: use YYYY-MM-DD, YYYY-MM or YYYY", value, field)
+	}
+	if field == "before" {
+		return &searchDate{"<", start}, nil
+	}
+	return &searchDate{">=", end}, nil
+}
+
+// returns the start and end of a year (YYYY), month (YYYY-MM) or day (YYYY-MM-DD)
+func parseDatePeriod(value string) (time.Time, time.Time, bool) {
+	var layouts = []struct {
+		layout              string
+		years, months, days int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	}
+	for _, l := range layouts {
+		start, err := time.Parse(l.layout, value)
+		if err == nil {
+			return start, start.AddDate(l.years, l.months, l.days), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func newSearchNear(value string) (searchNode, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, searchError("Invalid location %q: use latitude,longitude,radius in km, e.g. near:35.01,135.76,5", value)
+	}
+	var numbers []float64
+	for _, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, searchError("Invalid number %q in near:", part)
+		}
+		numbers = append(numbers, number)
+	}
+	node := &searchNear{numbers[0], numbers[1], defaultNearRadius}
+	if len(numbers) == 3 {
+		node.radius = numbers[2]
+	}
+	if !isValidLocation(node.lat, node.lng) {
+		return nil, searchError("Invalid location %q: latitude must be between -90 and 90, longitude between -180 and 180", value)
+	}
+	if math.IsNaN(node.radius) || node.radius <= 0 || node.radius > maxNearRadius {
+		return nil, searchError("Invalid radius: must be more than 0 and at most %.0f km", maxNearRadius)
+	}
+	return node, nil
+}
+
+func validateSearchSort(value string) error {
+	value = strings.ToLower(value)
+	if value == "relevance" {
+		return nil
+	}
+	if _, ok := photoOrderings[value]; ok {
+		return nil
+	}
+	options := []string{"relevance"}
+	for name := range photoOrderings {
+		options = append(options, name)
+	}
+	sort.Strings(options)
+	return searchError("Unknown sort order %q: use one of %s", value, strings.Join(options, ", "))
+}
@@ -0,0 +1,141 @@
+package photoshare
+
+import (
+	"strings"
+	"testing"
+)
+
+func searchErrorMessage(err error) string {
+	if err, ok := err.(validationFailure); ok {
+		return err.Errors["q"]
+	}
+	return ""
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	query, err := parseSearchQuery(`"new york" cats OR dogs -tag:winter votes:>=10 sort:hot`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query.sort != "hot" {
+		t.Error("Sort should be hot")
+	}
+
+	if len(query.keywords) != 3 {
+		t.Error("There should be 3 keywords")
+	}
+
+	b := &searchBuilder{}
+	sql := query.root.toSQL(b)
+
+	if !strings.Contains(sql, "phraseto_tsquery('english', $1)") {
+		t.Error("Quoted phrase should be a phrase query:", sql)
+	}
+	if !strings.Contains(sql, " OR (ps.document @@ plainto_tsquery('english', $3)") {
+		t.Error("Terms should be combined with OR:", sql)
+	}
+	if !strings.Contains(sql, "NOT p.id IN") {
+		t.Error("Tag should be excluded:", sql)
+	}
+	if !strings.Contains(sql, "(p.up_votes - p.down_votes) >= $6") {
+		t.Error("Votes filter missing:", sql)
+	}
+	if len(b.params) != 6 || b.params[0] != "new york" || b.params[3] != "winter" {
+		t.Error("Unexpected params:", b.params)
+	}
+	if !b.useDocument {
+		t.Error("Text search should use the search document")
+	}
+}
+
+func TestParseSearchQueryShortcuts(t *testing.T) {
+	query, err := parseSearchQuery("@tester #Travel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &searchBuilder{}
+	sql := query.root.toSQL(b)
+	if !strings.Contains(sql, "p.owner_id IN") || !strings.Contains(sql, "t.name = $2") {
+		t.Error("Should filter by owner and tag:", sql)
+	}
+	if b.params[1] != "travel" {
+		t.Error("Tags should be lower case")
+	}
+	if b.params[2] != "travel/%" {
+		t.Error("Tags should match descendants:", b.params[2])
+	}
+	if b.useDocument || len(query.keywords) != 0 {
+		t.Error("Filters alone should not need the search document")
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	for q, msg := range map[string]string{
+		`"new york`:        "Missing closing quote",
+		"cats OR":          "OR must be placed between two search terms",
+		"OR cats":          "OR must be placed between two search terms",
+		"before:yesterday": "Invalid date",
+		"votes:lots":       "Invalid votes filter",
+		"sort:random":      "Unknown sort order",
+		"tag:":             "Missing value for tag:",
+		"-sort:hot":        "sort: cannot be negated",
+	} {
+		_, err := parseSearchQuery(q)
+		if !strings.HasPrefix(searchErrorMessage(err), msg) {
+			t.Errorf("%s: expected error %q, got %v", q, msg, err)
+		}
+	}
+}
+
+func TestParseSearchQueryDates(t *testing.T) {
+	query, err := parseSearchQuery("after:2014-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := query.root.(*searchDate)
+	if date.op != ">=" || date.date.Format("2006-01-02") != "2014-07-01" {
+		t.Error("after: should start at the end of the month:", date.date)
+	}
+}
+
+func TestParseSearchQueryNear(t *testing.T) {
+	query, err := parseSearchQuery("near:35.01,135.76,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &searchBuilder{}
+	sql := query.root.toSQL(b)
+	if !strings.Contains(sql, "distance_km(p.latitude, p.longitude, $3, $4) <= $5") || !strings.Contains(sql, "p.show_location") {
+		t.Error("Should filter by distance from visible locations:", sql)
+	}
+	if b.params[4] != 5.0 {
+		t.Error("Radius should be 5 km")
+	}
+
+	for _, q := range []string{"near:35.01", "near:95,10", "near:35,135,0", "near:35,135,NaN", "near:NaN,135", "near:a,b"} {
+		if _, err := parseSearchQuery(q); err == nil {
+			t.Error("Should be invalid:", q)
+		}
+	}
+}
+
+func TestParseDatePeriod(t *testing.T) {
+	start, end, ok := parseDatePeriod("2014-02")
+	if !ok {
+		t.Fatal("Month should be valid")
+	}
+	if start.Format("2006-01-02") != "2014-02-01" || end.Format("2006-01-02") != "2014-03-01" {
+		t.Error("Unexpected period:", start, end)
+	}
+	if _, _, ok := parseDatePeriod("February"); ok {
+		t.Error("Only numeric dates should be valid")
+	}
+}
+
+func TestFormatHighlight(t *testing.T) {
+	s := formatHighlight("<b>" + highlightStart + "cats" + highlightStop + " & dogs")
+	if s != "&lt;b&gt;<mark>cats</mark> &amp; dogs" {
+		t.Error("Highlight should be escaped and marked:", s)
+	}
+}
@@ -1,6 +1,11 @@
 package photoshare
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/juju/errgo"
 	"io/ioutil"
@@ -10,14 +15,34 @@ import (
 )
 
 const (
-	tokenHeader = "X-Auth-Token"
-	expiry      = 60 // minutes
+	tokenHeader        = "X-Auth-Token"
+	refreshTokenHeader = "X-Refresh-Token"
+	expiry             = 15 // minutes
+	identityExpiry     = 15 // minutes to finish signing up after an external login
+	tokenLength        = 32 // random bytes in refresh and API tokens
+	maxUserAgentLength = 500
 )
 
+// Access tokens are short-lived JWTs carrying the user and session IDs. When one
+// expires the client exchanges its refresh token for a new pair at /api/auth/refresh.
+// Refresh tokens are stored hashed with the session, rotate on every use, and stop
+// working when the session is revoked; access tokens of a revoked session are
+// rejected by readToken.
+
 type sessionManager interface {
-	readToken(*http.Request) (int64, error)
-	createToken(int64) (string, error)
-	writeToken(http.ResponseWriter, int64) error
+	readToken(*http.Request) (*accessToken, error)
+	createToken(int64, int64) (string, error)
+	writeToken(http.ResponseWriter, int64, int64) error
+	createIdentityToken(*authInfo) (string, error)
+	readIdentityToken(string) (*authInfo, error)
+	createTwoFactorToken(int64) (string, error)
+	readTwoFactorToken(string) (int64, error)
+}
+
+// the claims of a valid access token
+type accessToken struct {
+	userID    int64
+	sessionID int64
 }
 
 // Basic user session info
@@ -27,6 +52,7 @@ type sessionInfo struct {
 	Email    string `json:"email"`
 	IsAdmin  bool   `json:"isAdmin"`
 	LoggedIn bool   `json:"loggedIn"`
+	Verified bool   `json:"emailVerified"`
 }
 
 func newSessionInfo(user *user) *sessionInfo {
@@ -34,11 +60,75 @@ func newSessionInfo(user *user) *sessionInfo {
 		return &sessionInfo{}
 	}
 
-	return &sessionInfo{user.ID, user.Name, user.Email, user.IsAdmin, true}
+	return &sessionInfo{user.ID, user.Name, user.Email, user.IsAdmin, true, user.EmailVerified}
+}
+
+// a login on one device, kept until it expires or is revoked
+type userSession struct {
+	ID                int64          `db:"id" json:"id"`
+	UserID            int64          `db:"user_id" json:"-"`
+	TokenHash         string         `db:"token_hash" json:"-"`
+	PreviousTokenHash sql.NullString `db:"previous_token_hash" json:"-"`
+	UserAgent         string         `db:"user_agent" json:"userAgent"`
+	IPAddress         string         `db:"ip_address" json:"ipAddress"`
+	CreatedAt         time.Time      `db:"created_at" json:"createdAt"`
+	LastUsedAt        time.Time      `db:"last_used_at" json:"lastUsedAt"`
+	ExpiresAt         time.Time      `db:"expires_at" json:"expiresAt"`
+	RevokedAt         sql.NullTime   `db:"revoked_at" json:"-"`
+	IsCurrent         bool           `db:"-" json:"isCurrent"`
+}
+
+func newUserSession(userID int64, r *http.Request, lifetime time.Duration) *userSession {
+	now := time.Now()
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return &userSession{
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IPAddress:  getRemoteIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+}
+
+func (s *userSession) isActive() bool {
+	return !s.RevokedAt.Valid && s.ExpiresAt.After(time.Now())
+}
+
+// replaces the refresh token, returning the new one; the old hash is kept to detect reuse
+func (s *userSession) rotateToken(lifetime time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return token, err
+	}
+	if s.TokenHash != "" {
+		s.PreviousTokenHash = sql.NullString{String: s.TokenHash, Valid: true}
+	}
+	s.TokenHash = hashToken(token)
+	s.LastUsedAt = time.Now()
+	s.ExpiresAt = s.LastUsedAt.Add(lifetime)
+	return token, nil
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, tokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func newSessionManager(cfg *config) (sessionManager, error) {
-	mgr := &defaultSessionManager{}
+// tokens are stored as SHA-256 hashes; they are random so don't need a slow hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionManager(cfg *config, datamapper dataMapper) (sessionManager, error) {
+	mgr := &defaultSessionManager{datamapper: datamapper}
 	var err error
 	mgr.signKey, err = ioutil.ReadFile(cfg.PrivateKey)
 	if err != nil {
@@ -53,12 +143,14 @@ func newSessionManager(cfg *config) (sessionManager, error) {
 
 type defaultSessionManager struct {
 	verifyKey, signKey []byte
+	datamapper         dataMapper
 }
 
-func (m *defaultSessionManager) readToken(r *http.Request) (int64, error) {
+func (m *defaultSessionManager) readToken(r *http.Request) (*accessToken, error) {
+	anon := &accessToken{}
 	tokenString := r.Header.Get(tokenHeader)
 	if tokenString == "" {
-		return 0, nil
+		return anon, nil
 	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return m.verifyKey, nil
@@ -66,24 +158,37 @@ func (m *defaultSessionManager) readToken(r *http.Request) (int64, error) {
 	switch err.(type) {
 	case nil:
 		if !token.Valid {
-			return 0, nil
+			return anon, nil
+		}
+		var claim = func(name string) int64 {
+			value, _ := token.Claims[name].(string)
+			id, _ := strconv.ParseInt(value, 10, 0)
+			return id
 		}
-		token := token.Claims["uid"].(string)
-		userID, err := strconv.ParseInt(token, 10, 0)
+		t := &accessToken{claim("uid"), claim("sid")}
+		if t.userID == 0 || t.sessionID == 0 {
+			return anon, nil
+		}
+		// check the session has not been revoked since the token was issued
+		ok, err := m.datamapper.isSessionActive(t.sessionID, t.userID)
 		if err != nil {
-			return 0, nil
+			return anon, err
+		}
+		if !ok {
+			return anon, nil
 		}
-		return userID, nil
+		return t, nil
 	case *jwt.ValidationError:
-		return 0, nil
+		return anon, nil
 	default:
-		return 0, errgo.Mask(err)
+		return anon, errgo.Mask(err)
 	}
 }
 
-func (m *defaultSessionManager) createToken(userID int64) (string, error) {
+func (m *defaultSessionManager) createToken(userID, sessionID int64) (string, error) {
 	token := jwt.New(jwt.GetSigningMethod("RS256"))
 	token.Claims["uid"] = strconv.FormatInt(userID, 10)
+	token.Claims["sid"] = strconv.FormatInt(sessionID, 10)
 	token.Claims["exp"] = time.Now().Add(time.Minute * expiry).Unix()
 	tokenString, err := token.SignedString(m.signKey)
 	if err != nil {
@@ -92,11 +197,224 @@ func (m *defaultSessionManager) createToken(userID int64) (string, error) {
 	return tokenString, nil
 }
 
-func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID int64) error {
-	tokenString, err := m.createToken(userID)
+func (m *defaultSessionManager) writeToken(w http.ResponseWriter, userID, sessionID int64) error {
+	tokenString, err := m.createToken(userID, sessionID)
 	if err != nil {
 		return err
 	}
 	w.Header().Set(tokenHeader, tokenString)
 	return nil
 }
+
+// signs the details of an external login not yet linked to a user,
+// so they can be used to sign up or link the identity to an account
+func (m *defaultSessionManager) createIdentityToken(info *authInfo) (string, error) {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims["typ"] = "identity"
+	token.Claims["idp"] = info.provider
+	token.Claims["sub"] = info.id
+	token.Claims["name"] = info.name
+	token.Claims["email"] = info.email
+	token.Claims["email_verified"] = info.emailVerified
+	token.Claims["exp"] = time.Now().Add(time.Minute * identityExpiry).Unix()
+	tokenString, err := token.SignedString(m.signKey)
+	if err != nil {
+		return tokenString, errgo.Mask(err)
+	}
+	return tokenString, nil
+}
+
+func (m *defaultSessionManager) readIdentityToken(tokenString string) (*authInfo, error) {
+	var errInvalidToken = httpError{http.StatusBadRequest, "Invalid or expired identity token"}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return m.verifyKey, nil
+	})
+	switch err.(type) {
+	case nil:
+	case *jwt.ValidationError:
+		return nil, errInvalidToken
+	default:
+		return nil, errgo.Mask(err)
+	}
+	var claim = func(name string) string {
+		value, _ := token.Claims[name].(string)
+		return value
+	}
+	if !token.Valid || claim("typ") != "identity" || claim("idp") == "" || claim("sub") == "" {
+		return nil, errInvalidToken
+	}
+	verified, _ := token.Claims["email_verified"].(bool)
+	return &authInfo{
+		provider:      claim("idp"),
+		id:            claim("sub"),
+		name:          claim("name"),
+		email:         claim("email"),
+		emailVerified: verified,
+	}, nil
+}
+
+// signs a token for a user who has entered their password but not yet their two-factor code
+func (m *defaultSessionManager) createTwoFactorToken(userID int64) (string, error) {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims["typ"] = "2fa"
+	token.Claims["sub"] = strconv.FormatInt(userID, 10)
+	token.Claims["exp"] = time.Now().Add(time.Minute * twoFactorExpiry).Unix()
+	tokenString, err := token.SignedString(m.signKey)
+	if err != nil {
+		return tokenString, errgo.Mask(err)
+	}
+	return tokenString, nil
+}
+
+func (m *defaultSessionManager) readTwoFactorToken(tokenString string) (int64, error) {
+	var errInvalidToken = httpError{http.StatusBadRequest, "Invalid or expired two-factor token"}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return m.verifyKey, nil
+	})
+	switch err.(type) {
+	case nil:
+	case *jwt.ValidationError:
+		return 0, errInvalidToken
+	default:
+		return 0, errgo.Mask(err)
+	}
+	typ, _ := token.Claims["typ"].(string)
+	sub, _ := token.Claims["sub"].(string)
+	userID, err := strconv.ParseInt(sub, 10, 0)
+	if !token.Valid || typ != "2fa" || err != nil || userID == 0 {
+		return 0, errInvalidToken
+	}
+	return userID, nil
+}
+
+func (ctx *context) sessionLifetime() time.Duration {
+	return time.Hour * 24 * time.Duration(ctx.cfg.SessionExpiry)
+}
+
+// creates a session for the user, returning it with its refresh token
+func (ctx *context) createSession(r *http.Request, userID int64) (*userSession, string, error) {
+	s := newUserSession(userID, r, ctx.sessionLifetime())
+	token, err := s.rotateToken(ctx.sessionLifetime())
+	if err != nil {
+		return nil, token, err
+	}
+	if err := ctx.datamapper.createSession(s); err != nil {
+		return nil, token, err
+	}
+	return s, token, nil
+}
+
+// starts a new session and writes its access and refresh tokens to the response
+func (ctx *context) startSession(w http.ResponseWriter, r *http.Request, userID int64) error {
+	s, token, err := ctx.createSession(r, userID)
+	if err != nil {
+		return err
+	}
+	if err := ctx.session.writeToken(w, userID, s.ID); err != nil {
+		return err
+	}
+	w.Header().Set(refreshTokenHeader, token)
+	return nil
+}
+
+// exchanges a refresh token for a new access token and refresh token
+func refreshSession(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	var errInvalidToken = httpError{http.StatusUnauthorized, "Invalid or expired refresh token"}
+
+	token := r.Header.Get(refreshTokenHeader)
+	if token == "" {
+		return errInvalidToken
+	}
+
+	s, err := ctx.datamapper.getSessionByToken(hashToken(token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return errInvalidToken
+		}
+		return err
+	}
+
+	if !s.isActive() {
+		return errInvalidToken
+	}
+
+	// a refresh token that has already been rotated out has probably been stolen,
+	// so revoke the session for both the thief and the owner
+	revoke := func() error {
+		if _, err := ctx.datamapper.revokeSession(s.UserID, s.ID); err != nil {
+			return err
+		}
+		return errInvalidToken
+	}
+
+	if s.TokenHash != hashToken(token) {
+		return revoke()
+	}
+
+	user, err := ctx.datamapper.getActiveUser(s.UserID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return errInvalidToken
+		}
+		return err
+	}
+
+	if token, err = s.rotateToken(ctx.sessionLifetime()); err != nil {
+		return err
+	}
+	s.IPAddress = getRemoteIP(r)
+
+	// another refresh with the same token got there first
+	ok, err := ctx.datamapper.rotateSession(s)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return revoke()
+	}
+	if err := ctx.session.writeToken(w, user.ID, s.ID); err != nil {
+		return err
+	}
+	w.Header().Set(refreshTokenHeader, token)
+
+	user.IsAuthenticated = true
+	return renderJSON(w, newSessionInfo(user), http.StatusOK)
+}
+
+// lists the active sessions of the current user, marking the one making the request
+func getSessions(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	sessions, err := ctx.datamapper.getSessions(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	for i := range sessions {
+		sessions[i].IsCurrent = sessions[i].ID == ctx.user.SessionID
+	}
+	return renderJSON(w, sessions, http.StatusOK)
+}
+
+func revokeSession(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	ok, err := ctx.datamapper.revokeSession(ctx.user.ID, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusNotFound, "Session not found"}
+	}
+	return renderString(w, http.StatusOK, "Session revoked")
+}
+
+// revokes all the sessions of the current user, including this one
+func logoutEverywhere(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.datamapper.revokeSessions(ctx.user.ID); err != nil {
+		return err
+	}
+	if err := ctx.session.writeToken(w, 0, 0); err != nil {
+		return err
+	}
+	sendMessage(&socketMessage{ctx.user.Name, "", 0, "logout"})
+	return renderJSON(w, newSessionInfo(&user{}), http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionRotateToken(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/api/auth/", nil)
+	s := newUserSession(1, r, time.Hour)
+
+	first, err := s.rotateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.TokenHash != hashToken(first) || s.PreviousTokenHash.Valid {
+		t.Error("Only the hash of the new token should be stored")
+	}
+
+	second, err := s.rotateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || s.TokenHash != hashToken(second) || s.PreviousTokenHash.String != hashToken(first) {
+		t.Error("Token should be replaced, keeping the previous hash")
+	}
+	if !s.isActive() {
+		t.Error("Session should be active")
+	}
+}
+
+// keeps one session, rotating and revoking it like the sessions table
+type sessionStore struct {
+	mockDataMapper
+	session      userSession
+	beforeRotate func() // e.g. a concurrent refresh
+}
+
+func (m *sessionStore) getSessionByToken(hash string) (*userSession, error) {
+	if hash != m.session.TokenHash && hash != m.session.PreviousTokenHash.String {
+		return nil, sql.ErrNoRows
+	}
+	s := m.session
+	return &s, nil
+}
+
+func (m *sessionStore) rotateSession(s *userSession) (bool, error) {
+	if m.beforeRotate != nil {
+		m.beforeRotate()
+	}
+	if m.session.TokenHash != s.PreviousTokenHash.String || m.session.RevokedAt.Valid {
+		return false, nil
+	}
+	m.session = *s
+	return true, nil
+}
+
+func (m *sessionStore) revokeSession(userID, sessionID int64) (bool, error) {
+	m.session.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return true, nil
+}
+
+func newSessionStore(t *testing.T) (*sessionStore, string) {
+	r, _ := http.NewRequest("POST", "/api/auth/", nil)
+	s := newUserSession(1, r, time.Hour)
+	s.ID = 1
+	token, err := s.rotateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sessionStore{session: *s}, token
+}
+
+func refreshWithToken(store *sessionStore, token string) (string, error) {
+	r, _ := http.NewRequest("POST", "/api/auth/refresh", nil)
+	r.Header.Set(refreshTokenHeader, token)
+	w := httptest.NewRecorder()
+	c := &context{
+		app: &app{
+			cfg:        &config{SessionExpiry: 30},
+			datamapper: store,
+			session:    &mockSessionManager{},
+		},
+		params: &params{make(map[string]string)},
+	}
+	if err := refreshSession(c, w, r); err != nil {
+		return "", err
+	}
+	return w.Header().Get(refreshTokenHeader), nil
+}
+
+func TestRefreshSessionReuse(t *testing.T) {
+	store, first := newSessionStore(t)
+
+	second, err := refreshWithToken(store, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == "" || second == first {
+		t.Fatal("Refresh token should be rotated")
+	}
+
+	if _, err := refreshWithToken(store, first); err == nil {
+		t.Error("Rotated token should be rejected")
+	}
+	if !store.session.RevokedAt.Valid {
+		t.Error("Reusing a rotated token should revoke the session")
+	}
+	if _, err := refreshWithToken(store, second); err == nil {
+		t.Error("Revoked session should not be refreshed")
+	}
+}
+
+func TestRefreshSessionConcurrent(t *testing.T) {
+	store, token := newSessionStore(t)
+
+	// another refresh with the same token rotates it first
+	store.beforeRotate = func() {
+		store.beforeRotate = nil
+		if _, err := refreshWithToken(store, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := refreshWithToken(store, token); err == nil {
+		t.Error("Only one refresh with the same token should succeed")
+	}
+	if !store.session.RevokedAt.Valid {
+		t.Error("Session should be revoked")
+	}
+}
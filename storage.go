@@ -61,6 +61,7 @@ func generateRandomFilename(contentType string) string {
 type fileStorage interface {
 	clean(string) error
 	store(readable, string, string) error
+	open(string) (io.ReadCloser, error)
 }
 
 func newFileStorage(cfg *config) fileStorage {
@@ -88,6 +89,15 @@ func (f *defaultFileStorage) clean(name string) error {
 	return nil
 }
 
+// opens the original of the file
+func (f *defaultFileStorage) open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(f.uploadsDir, name))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return file, nil
+}
+
 func (f *defaultFileStorage) store(src readable, filename, contentType string) error {
 	if err := os.MkdirAll(f.uploadsDir, 0777); err != nil && !os.IsExist(err) {
 		return errgo.Mask(err)
@@ -169,8 +179,8 @@ func (f *defaultFileStorage) store(src readable, filename, contentType string) e
 
 	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
-	if err != nil {
+	// the original is public, so it mustn't give away where the photo was taken
+	if err := stripMetadata(dst, src, contentType); err != nil {
 		return errgo.Mask(err)
 	}
 
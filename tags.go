@@ -0,0 +1,259 @@
+package photoshare
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
+	maxTagPrefixLength    = 50
+)
+
+func getSuggestionLimit(r *http.Request) int64 {
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil || limit < 1 {
+		return defaultTagSuggestions
+	}
+	if limit > maxTagSuggestions {
+		return maxTagSuggestions
+	}
+	return limit
+}
+
+func autocompleteTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	prefix := strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if prefix == "" {
+		return renderJSON(w, []tagSuggestion{}, http.StatusOK)
+	}
+	if len(prefix) > maxTagPrefixLength {
+		return httpError{http.StatusBadRequest, "Search term is too long"}
+	}
+
+	limit := getSuggestionLimit(r)
+	cacheKey := fmt.Sprintf("tags:autocomplete:%s:%d", prefix, limit)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		tags, err := ctx.datamapper.getTagsByPrefix(prefix, limit)
+		if err != nil {
+			return tags, err
+		}
+		return tags, nil
+	})
+}
+
+func getRelatedTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	var names []string
+	for _, name := range strings.Split(r.FormValue("tags"), ",") {
+		if name = cleanTagName(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return httpError{http.StatusBadRequest, "Missing tags"}
+	}
+
+	limit := getSuggestionLimit(r)
+	cacheKey := fmt.Sprintf("tags:related:%s:%d", strings.Join(names, ","), limit)
+
+	return ctx.cache.render(w, http.StatusOK, cacheKey, func() (interface{}, error) {
+		tags, err := ctx.datamapper.getRelatedTags(names, limit)
+		if err != nil {
+			return tags, err
+		}
+		return tags, nil
+	})
+}
+
+func getTagTree(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	return ctx.cache.render(w, http.StatusOK, "tags:tree", func() (interface{}, error) {
+		tags, err := ctx.datamapper.getTagTree()
+		if err != nil {
+			return tags, err
+		}
+		return tags, nil
+	})
+}
+
+// admin tag management
+
+func getTagToManage(ctx *context, name string) (*tag, error) {
+	tag, err := ctx.datamapper.getTag(strings.TrimSpace(name))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return tag, httpError{http.StatusNotFound, "Tag not found"}
+		}
+		return tag, err
+	}
+	return tag, nil
+}
+
+func renameTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	tag, err := getTagToManage(ctx, ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	name := cleanTagName(s.Name)
+	if name == "" {
+		return validationFailure{map[string]string{"name": "Missing tag"}}
+	}
+
+	if strings.HasPrefix(name+tagPathSeparator, tag.Name+tagPathSeparator) {
+		return validationFailure{map[string]string{"name": "A tag cannot be moved below itself"}}
+	}
+
+	if _, err := ctx.datamapper.getTag(name); err == nil {
+		return validationFailure{map[string]string{"name": "Tag already exists: merge the tags instead"}}
+	} else if !isErrSqlNoRows(err) {
+		return err
+	}
+
+	if err := ctx.datamapper.renameTag(tag, name); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderJSON(w, tag, http.StatusOK)
+}
+
+func mergeTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	source, err := getTagToManage(ctx, ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+
+	s := &struct {
+		Into string `json:"into"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	target, err := ctx.datamapper.getTag(strings.TrimSpace(s.Into))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return validationFailure{map[string]string{"into": "Tag not found"}}
+		}
+		return err
+	}
+
+	if target.ID == source.ID {
+		return validationFailure{map[string]string{"into": "Cannot merge a tag into itself"}}
+	}
+
+	if err := ctx.datamapper.mergeTags(source, target); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderJSON(w, target, http.StatusOK)
+}
+
+func getTagSynonyms(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	synonyms, err := ctx.datamapper.getTagSynonyms()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, synonyms, http.StatusOK)
+}
+
+// the synonym is in the path, the tag it stands for in the body
+func addTagSynonym(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Tag string `json:"tag"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	tag, err := getTagToManage(ctx, s.Tag)
+	if err != nil {
+		return err
+	}
+
+	synonym := cleanTagName(ctx.params.get("synonym"))
+	if synonym == "" || synonym == tag.Name {
+		return httpError{http.StatusBadRequest, "Invalid synonym"}
+	}
+
+	if err := ctx.datamapper.addTagSynonym(tag, synonym); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderJSON(w, &tagSynonym{synonym, tag.Name}, http.StatusOK)
+}
+
+func removeTagSynonym(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	removed, err := ctx.datamapper.removeTagSynonym(ctx.params.get("synonym"))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return httpError{http.StatusNotFound, "Synonym not found"}
+	}
+	return renderString(w, http.StatusOK, "Synonym removed")
+}
+
+func getBlockedTags(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	tags, err := ctx.datamapper.getBlockedTags()
+	if err != nil {
+		return err
+	}
+	return renderJSON(w, tags, http.StatusOK)
+}
+
+func blockTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	name := cleanTagName(ctx.params.get("name"))
+	if name == "" {
+		return httpError{http.StatusBadRequest, "Missing tag"}
+	}
+
+	if err := ctx.datamapper.blockTag(name); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+	return renderString(w, http.StatusOK, "Tag blocked")
+}
+
+func unblockTag(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	unblocked, err := ctx.datamapper.unblockTag(ctx.params.get("name"))
+	if err != nil {
+		return err
+	}
+	if !unblocked {
+		return httpError{http.StatusNotFound, "Tag not blocked"}
+	}
+	return renderString(w, http.StatusOK, "Tag unblocked")
+}
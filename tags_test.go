@@ -0,0 +1,34 @@
+package photoshare
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestCleanTagName(t *testing.T) {
+	if name := cleanTagName(" Travel// Japan /kyoto/"); name != "travel/japan/kyoto" {
+		t.Error("Empty levels should be removed:", name)
+	}
+	if parent := parentTagName("travel/japan/kyoto"); parent != "travel/japan" {
+		t.Error("Parent should be travel/japan:", parent)
+	}
+	if parent := parentTagName("travel"); parent != "" {
+		t.Error("Top-level tag should have no parent:", parent)
+	}
+}
+
+func TestBuildTagTree(t *testing.T) {
+	tags := []*tagNode{
+		{ID: 1, Name: "travel"},
+		{ID: 2, Name: "travel/japan", ParentID: sql.NullInt64{Int64: 1, Valid: true}},
+		{ID: 3, Name: "travel/japan/kyoto", ParentID: sql.NullInt64{Int64: 2, Valid: true}},
+		{ID: 4, Name: "winter"},
+	}
+	roots := buildTagTree(tags)
+	if len(roots) != 2 {
+		t.Fatal("There should be 2 top-level tags")
+	}
+	if len(roots[0].Children) != 1 || roots[0].Children[0].Children[0].Label != "kyoto" {
+		t.Error("Kyoto should be below travel/japan")
+	}
+}
@@ -20,7 +20,7 @@ type testDB struct {
 }
 
 func (tdb *testDB) clean() {
-	var tables = []string{"photo_tags", "tags", "photos", "users"}
+	var tables = []string{"votes", "follows", "tag_follows", "favorites", "comments", "photo_search", "photo_tags", "tag_synonyms", "tag_blocklist", "tags", "photos", "albums", "sessions", "api_tokens", "user_identities", "backup_codes", "login_throttles", "data_exports", "users"}
 	for _, table := range tables {
 		if _, err := tdb.dbMap.Exec("DELETE FROM " + table); err != nil {
 			panic(err)
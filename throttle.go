@@ -0,0 +1,143 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per account and per IP address. After a few free
+// attempts each further failure blocks the key for twice as long as the last,
+// and an account reaching the lockout threshold is locked and its owner emailed.
+// Blocked requests get the same response whether or not the account exists.
+// Reset emails and the signup form's address checks are throttled the same way,
+// so they can't be used to find out which addresses have accounts.
+
+const (
+	throttleWindow    = time.Hour // failures older than this are forgotten
+	throttleBaseDelay = time.Second
+	throttleMaxDelay  = 15 * time.Minute
+
+	accountFreeAttempts = 3
+	loginIPFreeAttempts = 20
+	recoverFreeAttempts = 3 // reset emails per address
+	recoverIPAttempts   = 10
+	emailCheckAttempts  = 20 // signup form checks per IP address
+)
+
+type throttle struct {
+	Key           string       `db:"key"`
+	Failures      int64        `db:"failures"`
+	LastFailureAt time.Time    `db:"last_failure_at"`
+	BlockedUntil  sql.NullTime `db:"blocked_until"`
+}
+
+func accountThrottleKey(userID int64) string {
+	return fmt.Sprintf("account:%d", userID)
+}
+
+// for identifiers that match no account, so they are throttled like real ones
+func identifierThrottleKey(identifier string) string {
+	return "login:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+func ipThrottleKey(scope string, r *http.Request) string {
+	return scope + "-ip:" + getRemoteIP(r)
+}
+
+// how long to block after the number of failures
+func backoffDelay(failures, free int64) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	delay := throttleBaseDelay
+	for i := free + 1; i < failures && delay < throttleMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > throttleMaxDelay {
+		delay = throttleMaxDelay
+	}
+	return delay
+}
+
+func errTooManyAttempts(wait time.Duration) error {
+	msg := "Too many attempts, please try again "
+	if wait < time.Minute {
+		msg += fmt.Sprintf("in %d seconds", int(wait.Seconds())+1)
+	} else {
+		msg += fmt.Sprintf("in %d minutes", int(wait.Minutes())+1)
+	}
+	return httpError{http.StatusTooManyRequests, msg}
+}
+
+// returns an error if any of the keys is blocked
+func (ctx *context) checkThrottles(keys ...string) error {
+	now := time.Now()
+	for _, key := range keys {
+		t, err := ctx.datamapper.getThrottle(key)
+		if err != nil {
+			return err
+		}
+		if t.BlockedUntil.Valid && t.BlockedUntil.Time.After(now) {
+			return errTooManyAttempts(t.BlockedUntil.Time.Sub(now))
+		}
+	}
+	return nil
+}
+
+// counts a failed attempt, blocking the key once past the free attempts;
+// returns the number of recent failures
+func (ctx *context) recordFailure(key string, free int64) (int64, error) {
+	now := time.Now()
+	failures, err := ctx.datamapper.addThrottleFailure(key, now, now.Add(-throttleWindow))
+	if err != nil {
+		return failures, err
+	}
+	if delay := backoffDelay(failures, free); delay > 0 {
+		err = ctx.datamapper.blockThrottle(key, now.Add(delay))
+	}
+	return failures, err
+}
+
+// records a failed password or two-factor code; user is nil if the identifier matched no account
+func (ctx *context) loginFailed(r *http.Request, user *user, accountKey string) error {
+	if _, err := ctx.recordFailure(ipThrottleKey("login", r), loginIPFreeAttempts); err != nil {
+		return err
+	}
+	failures, err := ctx.recordFailure(accountKey, accountFreeAttempts)
+	if err != nil {
+		return err
+	}
+	if user == nil || failures != int64(ctx.cfg.LockoutThreshold) {
+		return nil
+	}
+
+	until := time.Now().Add(time.Minute * time.Duration(ctx.cfg.LockoutDuration))
+	if err := ctx.datamapper.blockThrottle(accountKey, until); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.mailer.sendAccountLockedMail(user, until, r); err != nil {
+			logError(err)
+		}
+	}()
+	return nil
+}
+
+var (
+	dummyPasswordHash []byte
+	dummyPasswordOnce sync.Once
+)
+
+// takes as long as checking a real password, so unknown accounts can't be told apart by timing
+func checkDummyPassword(password string) {
+	dummyPasswordOnce.Do(func() {
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
@@ -0,0 +1,67 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// keeps throttles in memory like the throttles table
+type throttleStore struct {
+	mockDataMapper
+	throttles map[string]*throttle
+}
+
+func (m *throttleStore) getThrottle(key string) (*throttle, error) {
+	if t, ok := m.throttles[key]; ok {
+		return t, nil
+	}
+	return &throttle{Key: key}, nil
+}
+
+func (m *throttleStore) addThrottleFailure(key string, now, window time.Time) (int64, error) {
+	t, _ := m.getThrottle(key)
+	t.Failures++
+	t.LastFailureAt = now
+	m.throttles[key] = t
+	return t.Failures, nil
+}
+
+func (m *throttleStore) blockThrottle(key string, until time.Time) error {
+	m.throttles[key].BlockedUntil = sql.NullTime{Time: until, Valid: true}
+	return nil
+}
+
+func TestBackoffDelay(t *testing.T) {
+	if backoffDelay(3, 3) != 0 {
+		t.Error("Free attempts should not be delayed")
+	}
+	if backoffDelay(4, 3) != throttleBaseDelay || backoffDelay(6, 3) != 4*throttleBaseDelay {
+		t.Error("Delay should double after each failure")
+	}
+	if backoffDelay(100, 3) != throttleMaxDelay {
+		t.Error("Delay should be capped")
+	}
+}
+
+func TestEmailExistsThrottled(t *testing.T) {
+	c := &context{
+		app:    &app{datamapper: &throttleStore{throttles: make(map[string]*throttle)}},
+		params: &params{make(map[string]string)},
+	}
+	for i := 1; i <= emailCheckAttempts+2; i++ {
+		r, _ := http.NewRequest("GET", "/api/auth/emailExists?email=tester@example.com", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		err := emailExists(c, httptest.NewRecorder(), r)
+		if i <= emailCheckAttempts+1 && err != nil {
+			t.Fatal("Check should be allowed:", i, err)
+		}
+		if i > emailCheckAttempts+1 {
+			if e, ok := err.(httpError); !ok || e.Status != http.StatusTooManyRequests {
+				t.Error("Checks should be throttled by IP:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Personal API tokens are sent as "Authorization: Bearer pat_..." instead of
+// X-Auth-Token, or as ?token=pat_... for private feeds, as feed readers can't
+// send headers. Each has one scope, and each scope includes the ones before it:
+//
+//	read     GET requests only
+//	upload   read, and uploading photos
+//	admin    everything the owner can do, including admin requests if the owner is an admin
+//
+// except managing the account under /api/auth/, e.g. its password or tokens,
+// which needs a login session.
+
+const (
+	apiTokenPrefix      = "pat_"
+	maxAPITokenNameLen  = 100
+	defaultAPITokenDays = 30
+	maxAPITokenDays     = 365
+)
+
+const (
+	scopeRead   = "read"
+	scopeUpload = "upload"
+	scopeAdmin  = "admin"
+)
+
+var apiTokenScopes = []string{scopeRead, scopeUpload, scopeAdmin}
+
+// returns the position of the scope in apiTokenScopes, or -1 if it isn't one
+func scopeRank(scope string) int {
+	for i, value := range apiTokenScopes {
+		if value == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns true if a token with the scope can be used where the other scope is required
+func scopeIncludes(scope, required string) bool {
+	return scopeRank(scope) >= 0 && scopeRank(scope) >= scopeRank(required)
+}
+
+// the scope an API token needs for the request
+func requiredScope(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return scopeRead
+	}
+	if route := mux.CurrentRoute(r); route != nil && r.Method == "POST" && route.GetName() == "photos" {
+		return scopeUpload
+	}
+	return scopeAdmin
+}
+
+// routes an API token can be given in the query string for
+var tokenInQueryRoutes = []string{"timelineFeed"}
+
+// returns the token from an Authorization: Bearer header, if it is an API token
+func getAPIToken(r *http.Request) string {
+	value := r.Header.Get("Authorization")
+	if strings.HasPrefix(value, "Bearer "+apiTokenPrefix) {
+		return strings.TrimPrefix(value, "Bearer ")
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		for _, name := range tokenInQueryRoutes {
+			if route.GetName() == name && strings.HasPrefix(r.URL.Query().Get("token"), apiTokenPrefix) {
+				return r.URL.Query().Get("token")
+			}
+		}
+	}
+	return ""
+}
+
+type apiToken struct {
+	ID         int64        `db:"id" json:"id"`
+	UserID     int64        `db:"user_id" json:"-"`
+	Name       string       `db:"name" json:"name"`
+	Scope      string       `db:"scope" json:"scope"`
+	TokenHash  string       `db:"token_hash" json:"-"`
+	CreatedAt  time.Time    `db:"created_at" json:"createdAt"`
+	ExpiresAt  time.Time    `db:"expires_at" json:"expiresAt"`
+	LastUsedAt sql.NullTime `db:"last_used_at" json:"-"`
+	LastUsed   *time.Time   `db:"-" json:"lastUsedAt,omitempty"`
+	Token      string       `db:"-" json:"token,omitempty"` // only set when the token is created
+}
+
+func (t *apiToken) validate(ctx *context, r *http.Request, errors map[string]string) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		errors["name"] = "Name is missing"
+	} else if len(t.Name) > maxAPITokenNameLen {
+		errors["name"] = fmt.Sprintf("Name must be no more than %d characters", maxAPITokenNameLen)
+	}
+	if scopeRank(t.Scope) < 0 {
+		errors["scope"] = "Scope must be one of " + strings.Join(apiTokenScopes, ", ")
+	}
+	return nil
+}
+
+// checks the API token for the request, returning the ID of its owner
+func (app *app) readAPIToken(r *http.Request, token string) (int64, error) {
+	t, err := app.datamapper.getAPIToken(hashToken(token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return 0, httpError{http.StatusUnauthorized, "Invalid or expired API token"}
+		}
+		return 0, err
+	}
+	if !scopeIncludes(t.Scope, requiredScope(r)) {
+		return 0, httpError{http.StatusForbidden, "This API token does not allow this request"}
+	}
+	if err := app.datamapper.touchAPIToken(t.ID); err != nil {
+		logError(err)
+	}
+	return t.UserID, nil
+}
+
+func getAPITokens(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	tokens, err := ctx.datamapper.getAPITokens(ctx.user.ID)
+	if err != nil {
+		return err
+	}
+	for i := range tokens {
+		if tokens[i].LastUsedAt.Valid {
+			tokens[i].LastUsed = &tokens[i].LastUsedAt.Time
+		}
+	}
+	return renderJSON(w, tokens, http.StatusOK)
+}
+
+// creates a token, which is returned only in this response
+func createAPIToken(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Name      string `json:"name"`
+		Scope     string `json:"scope"`
+		ExpiresIn int    `json:"expiresIn"` // days
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	if s.ExpiresIn == 0 {
+		s.ExpiresIn = defaultAPITokenDays
+	}
+	if s.ExpiresIn < 0 || s.ExpiresIn > maxAPITokenDays {
+		return validationFailure{map[string]string{
+			"expiresIn": fmt.Sprintf("Tokens must expire within %d days", maxAPITokenDays),
+		}}
+	}
+
+	t := &apiToken{
+		UserID:    ctx.user.ID,
+		Name:      s.Name,
+		Scope:     s.Scope,
+		CreatedAt: time.Now(),
+	}
+	t.ExpiresAt = t.CreatedAt.AddDate(0, 0, s.ExpiresIn)
+
+	if err := ctx.validate(t, r); err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	t.Token = apiTokenPrefix + token
+	t.TokenHash = hashToken(t.Token)
+
+	if err := ctx.datamapper.createAPIToken(t); err != nil {
+		return err
+	}
+	return renderJSON(w, t, http.StatusCreated)
+}
+
+func removeAPIToken(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	ok, err := ctx.datamapper.removeAPIToken(ctx.user.ID, ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusNotFound, "API token not found"}
+	}
+	return renderString(w, http.StatusOK, "API token deleted")
+}
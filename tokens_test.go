@@ -0,0 +1,102 @@
+package photoshare
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPITokenInQuery(t *testing.T) {
+	var token string
+	router := mux.NewRouter()
+	handler := func(w http.ResponseWriter, r *http.Request) { token = getAPIToken(r) }
+	router.HandleFunc("/feeds/timeline/", handler).Name("timelineFeed")
+	router.HandleFunc("/api/photos/", handler).Name("photos")
+
+	r, _ := http.NewRequest("GET", "/feeds/timeline/?token=pat_1234", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	if token != "pat_1234" {
+		t.Error("Feed should accept a token in the query:", token)
+	}
+
+	r, _ = http.NewRequest("GET", "/api/photos/?token=pat_1234", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	if token != "" {
+		t.Error("Other routes should not accept a token in the query:", token)
+	}
+}
+
+func TestAPITokenScope(t *testing.T) {
+	if !scopeIncludes(scopeAdmin, scopeUpload) || !scopeIncludes(scopeUpload, scopeRead) {
+		t.Error("Scopes should include the ones before them")
+	}
+	if scopeIncludes(scopeRead, scopeUpload) || scopeIncludes("write", scopeRead) {
+		t.Error("Scope should not allow more than it includes")
+	}
+
+	r, _ := http.NewRequest("GET", "/api/photos/", nil)
+	if scope := requiredScope(r); scope != scopeRead {
+		t.Error("GET should need read scope, not", scope)
+	}
+	r, _ = http.NewRequest("DELETE", "/api/photos/1", nil)
+	if scope := requiredScope(r); scope != scopeAdmin {
+		t.Error("DELETE should need admin scope, not", scope)
+	}
+}
+
+// an admin-scoped API token for user 1, counting the tokens created
+type apiTokenStore struct {
+	mockDataMapper
+	created int
+}
+
+func (m *apiTokenStore) getAPIToken(hash string) (*apiToken, error) {
+	return &apiToken{ID: 1, UserID: 1, Scope: scopeAdmin}, nil
+}
+
+func (m *apiTokenStore) getActiveUser(userID int64) (*user, error) {
+	return &user{ID: userID}, nil
+}
+
+func (m *apiTokenStore) createAPIToken(t *apiToken) error {
+	m.created++
+	return nil
+}
+
+// a session of user 1
+type loggedInSessionManager struct {
+	mockSessionManager
+}
+
+func (m *loggedInSessionManager) readToken(r *http.Request) (*accessToken, error) {
+	return &accessToken{userID: 1, sessionID: 1}, nil
+}
+
+func TestAPITokenAccountRoutes(t *testing.T) {
+	store := &apiTokenStore{}
+	app := &app{
+		cfg:        &config{},
+		datamapper: store,
+		session:    &loggedInSessionManager{},
+		cache:      &mockCache{},
+	}
+	handler := app.handler(createAPIToken, authLevelSession)
+	body := `{"name": "script", "scope": "admin"}`
+
+	r, _ := http.NewRequest("POST", "/api/auth/tokens", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+apiTokenPrefix+"1234")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusForbidden || store.created != 0 {
+		t.Error("API token should not create tokens:", w.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "/api/auth/tokens", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusCreated || store.created != 1 {
+		t.Error("Logged in user should create tokens:", w.Code, w.Body.String())
+	}
+}
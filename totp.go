@@ -0,0 +1,371 @@
+package photoshare
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errgo"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238),
+// using the defaults authenticator apps expect: SHA-1, 6 digits, 30 seconds.
+//
+// Users enroll to get a secret, then enable 2FA by confirming a code, which
+// also returns their backup codes. Once enabled, login returns a short-lived
+// two-factor token instead of a session, exchanged at /api/auth/2fa/verify
+// together with a TOTP or backup code.
+
+const (
+	totpIssuer       = "Photoshare"
+	totpDigits       = 6
+	totpPeriod       = 30 // seconds
+	totpSkew         = 1  // steps either side of now accepted for clock drift
+	totpSecretLength = 20 // bytes
+	twoFactorExpiry  = 5  // minutes to enter a code after the password
+	numBackupCodes   = 10
+	backupCodeLength = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// returns the code for the time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits))), nil
+}
+
+// checks the code against the steps around now, returning the matching step;
+// steps up to lastStep have been used already and are rejected
+func checkTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// the otpauth:// URI authenticator apps read from a QR code
+func totpProvisioningURI(account, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// returns new backup codes, formatted xxxxx-xxxxx, and their hashes
+func generateBackupCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	b := make([]byte, backupCodeLength)
+	for i := 0; i < numBackupCodes; i++ {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		code := make([]byte, backupCodeLength)
+		for j := range b {
+			code[j] = recoveryCodeCharacters[int(b[j])%len(recoveryCodeCharacters)]
+		}
+		half := backupCodeLength / 2
+		codes = append(codes, string(code[:half])+"-"+string(code[half:]))
+		hashes = append(hashes, hashBackupCode(string(code)))
+	}
+	return codes, hashes, nil
+}
+
+// codes may be entered in any case, with or without the dash
+func hashBackupCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return hashToken(code)
+}
+
+// checks a TOTP code, or failing that a backup code, which is used up
+func (ctx *context) checkTwoFactorCode(user *user, code string) (bool, error) {
+	if step, ok := checkTOTP(user.TOTPSecret.String, code, time.Now(), user.TOTPLastStep); ok {
+		// the same code may have been sent twice at once
+		used, err := ctx.datamapper.useTOTPStep(user.ID, step)
+		if err != nil || !used {
+			return false, err
+		}
+		user.TOTPLastStep = step
+		return true, nil
+	}
+	if len(code) < backupCodeLength {
+		return false, nil
+	}
+	return ctx.datamapper.useBackupCode(user.ID, hashBackupCode(code))
+}
+
+// returned by login instead of the session info when a code is needed
+type twoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	Token             string `json:"token"`
+}
+
+func newTwoFactorChallenge(token string) *twoFactorChallenge {
+	return &twoFactorChallenge{true, token}
+}
+
+var errInvalidTwoFactorCode = httpError{http.StatusBadRequest, "Invalid code"}
+
+func decodeTwoFactorCode(r *http.Request) (string, error) {
+	s := &struct {
+		Code string `json:"code"`
+	}{}
+	if err := decodeJSON(r, s); err != nil {
+		return "", err
+	}
+	if s.Code == "" {
+		return "", httpError{http.StatusBadRequest, "Code is missing"}
+	}
+	return s.Code, nil
+}
+
+func getTwoFactorStatus(ctx *context, w http.ResponseWriter, r *http.Request) error {
+	s := &struct {
+		Enabled         bool  `json:"enabled"`
+		BackupCodesLeft int64 `json:"backupCodesLeft"`
+	}{Enabled: ctx.user.TOTPEnabled}
+
+	if s.Enabled {
+		var err error
+		if s.BackupCodesLeft, err = ctx.datamapper.getBackupCodeCount(ctx.user.ID); err != nil {
+			return err
+		}
+	}
+	return renderJSON(w, s, http.StatusOK)
+}
+
+// creates a new secret; 2FA isn't enabled until a code for it has been confirmed
+func enrollTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is already enabled"}
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	ctx.user.TOTPSecret = sql.NullString{String: secret, Valid: true}
+	ctx.user.TOTPLastStep = 0
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	s := &struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, totpProvisioningURI(ctx.user.Email, secret)}
+
+	return renderJSON(w, s, http.StatusOK)
+}
+
+func renderBackupCodes(ctx *context, w http.ResponseWriter, status int) error {
+	codes, hashes, err := generateBackupCodes()
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.setBackupCodes(ctx.user.ID, hashes); err != nil {
+		return err
+	}
+	s := &struct {
+		BackupCodes []string `json:"backupCodes"`
+	}{codes}
+	return renderJSON(w, s, status)
+}
+
+// enables 2FA once the user confirms a code from their app, returning their backup codes
+func enableTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	code, err := decodeTwoFactorCode(r)
+	if err != nil {
+		return err
+	}
+
+	if ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is already enabled"}
+	}
+	if !ctx.user.TOTPSecret.Valid {
+		return httpError{http.StatusBadRequest, "Enroll before enabling two-factor authentication"}
+	}
+
+	step, ok := checkTOTP(ctx.user.TOTPSecret.String, code, time.Now(), ctx.user.TOTPLastStep)
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+
+	ctx.user.TOTPEnabled = true
+	ctx.user.TOTPLastStep = step
+
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+	return renderBackupCodes(ctx, w, http.StatusOK)
+}
+
+// replaces the backup codes; needs a current code
+func regenerateBackupCodes(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	code, err := decodeTwoFactorCode(r)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is not enabled"}
+	}
+
+	ok, err := ctx.checkTwoFactorCode(ctx.user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+	return renderBackupCodes(ctx, w, http.StatusOK)
+}
+
+// turns off 2FA; needs a current code
+func disableTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	code, err := decodeTwoFactorCode(r)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.user.TOTPEnabled {
+		return httpError{http.StatusBadRequest, "Two-factor authentication is not enabled"}
+	}
+
+	ok, err := ctx.checkTwoFactorCode(ctx.user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidTwoFactorCode
+	}
+
+	if err := ctx.datamapper.resetTwoFactor(ctx.user.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+// completes a login with the two-factor token and a TOTP or backup code
+func verifyTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Token string `json:"token"`
+		Code  string `json:"code"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	userID, err := ctx.session.readTwoFactorToken(s.Token)
+	if err != nil {
+		return err
+	}
+
+	user, err := ctx.datamapper.getActiveUser(userID)
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return httpError{http.StatusBadRequest, "Invalid or expired two-factor token"}
+		}
+		return err
+	}
+
+	// wrong codes count towards locking the account, like wrong passwords
+	accountKey := accountThrottleKey(user.ID)
+
+	if err := ctx.checkThrottles(ipThrottleKey("login", r), accountKey); err != nil {
+		return err
+	}
+
+	ok, err := ctx.checkTwoFactorCode(user, s.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := ctx.loginFailed(r, user, accountKey); err != nil {
+			return err
+		}
+		return errInvalidTwoFactorCode
+	}
+
+	if err := ctx.datamapper.clearThrottle(accountKey); err != nil {
+		return err
+	}
+	if err := ctx.startSession(w, r, user.ID); err != nil {
+		return err
+	}
+
+	user.IsAuthenticated = true
+
+	sendMessage(&socketMessage{user.Name, "", 0, "login"})
+	return renderJSON(w, newSessionInfo(user), http.StatusCreated)
+}
+
+// lets an admin turn off 2FA for a user who has lost their device and backup codes
+func resetTwoFactor(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := ctx.datamapper.getActiveUser(ctx.params.getInt("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.resetTwoFactor(user.ID); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Two-factor authentication reset")
+}
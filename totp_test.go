@@ -0,0 +1,45 @@
+package photoshare
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vector for SHA-1, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	code, err := totpCode(secret, totpStep(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Error("Unexpected code:", code)
+	}
+
+	now := time.Unix(1111111109, 0)
+	code, _ = totpCode(secret, totpStep(now))
+	step, ok := checkTOTP(secret, code, now.Add(time.Second*totpPeriod), 0)
+	if !ok || step != totpStep(now) {
+		t.Error("Code from the previous step should be accepted")
+	}
+	if _, ok := checkTOTP(secret, code, now, step); ok {
+		t.Error("Used code should be rejected")
+	}
+	if _, ok := checkTOTP(secret, code, now.Add(time.Minute*5), 0); ok {
+		t.Error("Old code should be rejected")
+	}
+}
+
+func TestBackupCodes(t *testing.T) {
+	codes, hashes, err := generateBackupCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != numBackupCodes || len(hashes) != numBackupCodes {
+		t.Fatal("Wrong number of codes")
+	}
+	if hashBackupCode(strings.ToUpper(strings.Replace(codes[0], "-", "", 1))) != hashes[0] {
+		t.Error("Codes should match regardless of case and dash")
+	}
+}
@@ -0,0 +1,72 @@
+package photoshare
+
+import (
+	"net/http"
+)
+
+// returns the current user's deleted photos with the date each will be purged
+func getTrash(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	trash, err := ctx.datamapper.getTrash(getPage(r), ctx.user.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range trash.Items {
+		trash.Items[i].PurgeAt = trash.Items[i].DeletedAt.AddDate(0, 0, ctx.cfg.TrashRetention)
+	}
+	return renderJSON(w, trash, http.StatusOK)
+}
+
+func getTrashedPhotoToEdit(ctx *context) (*photo, error) {
+
+	photo, err := ctx.datamapper.getTrashedPhoto(ctx.params.getInt("id"))
+	if err != nil {
+		return photo, err
+	}
+
+	if !photo.canDelete(ctx.user) {
+		return photo, httpError{http.StatusForbidden, "You're not allowed to change this photo"}
+	}
+	return photo, nil
+}
+
+func restorePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getTrashedPhotoToEdit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.restorePhoto(photo); err != nil {
+		return err
+	}
+
+	if err := ctx.cache.clear(); err != nil {
+		logError(err)
+	}
+
+	sendMessage(&socketMessage{ctx.user.Name, "", photo.ID, "photo_restored"})
+	return renderJSON(w, photo, http.StatusOK)
+}
+
+// deletes a photo in the trash for good, without waiting for the purge
+func purgePhoto(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	photo, err := getTrashedPhotoToEdit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.datamapper.removePhoto(photo); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := ctx.filestore.clean(photo.Filename); err != nil {
+			logError(err)
+		}
+	}()
+
+	return renderString(w, http.StatusOK, "Photo deleted")
+}
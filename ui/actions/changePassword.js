@@ -37,7 +37,7 @@ export function resetForm() {
   return { type: CHANGE_PASSWORD_RESET };
 }
 
-export function submitForm(password, passwordConfirm, code, loggedIn) {
+export function submitForm(password, passwordConfirm, code, loggedIn, currentPassword) {
 
   const errors = validate(password, passwordConfirm);
 
@@ -55,7 +55,7 @@ export function submitForm(password, passwordConfirm, code, loggedIn) {
       CHANGE_PASSWORD_FAILURE
     ],
     payload: {
-      promise: api.changePassword(password, code),
+      promise: api.changePassword(password, code, currentPassword),
     },
     meta: {
       loggedIn: loggedIn
@@ -3,22 +3,59 @@ import fetch from 'isomorphic-fetch';
 
 const API_URI = '/api';
 const AUTH_TOKEN = 'X-Auth-Token';
+const REFRESH_TOKEN = 'X-Refresh-Token';
 
 function getToken() {
   return window.localStorage.getItem(AUTH_TOKEN);
 }
 
-function setToken(token) {
-  if (token) {
-    window.localStorage.setItem(AUTH_TOKEN, token);
-  }
-}
-
 function deleteToken() {
   window.localStorage.removeItem(AUTH_TOKEN);
+  window.localStorage.removeItem(REFRESH_TOKEN);
 }
 
-function callAPI(endpoint, method, data) {
+function saveTokens(response) {
+  [AUTH_TOKEN, REFRESH_TOKEN].forEach(name => {
+    const token = response.headers.get(name);
+    if (token) {
+      window.localStorage.setItem(name, token);
+    }
+  });
+}
+
+// the refresh in progress, if any. Refresh tokens are rotated on use, so calls
+// that fail together must share one refresh: a second request with the same
+// token would be rejected and log the user out.
+let pendingRefresh = null;
+
+// exchanges the refresh token for a new access token, returning true if successful
+function refreshToken() {
+  const token = window.localStorage.getItem(REFRESH_TOKEN);
+  if (!token) {
+    return Promise.resolve(false);
+  }
+  if (pendingRefresh) {
+    return pendingRefresh;
+  }
+  pendingRefresh = fetch(API_URI + '/auth/refresh', {
+    method: 'POST',
+    headers: { [REFRESH_TOKEN]: token }
+  }).then(response => {
+    pendingRefresh = null;
+    if (!response.ok) {
+      deleteToken();
+      return false;
+    }
+    saveTokens(response);
+    return true;
+  }, err => {
+    pendingRefresh = null;
+    throw err;
+  });
+  return pendingRefresh;
+}
+
+function callAPI(endpoint, method, data, retried) {
 
   method = method || "GET";
 
@@ -51,16 +88,21 @@ function callAPI(endpoint, method, data) {
   return fetch(API_URI + endpoint, args)
     .then(response => {
 
+      // the access token has expired: refresh it and try once more
+      if (response.status === 401 && token && !retried) {
+        return refreshToken().then(ok => {
+          if (ok) {
+            return callAPI(endpoint, method, data, true);
+          }
+          throw new Error(response.statusText);
+        });
+      }
+
       if(!response.ok) {
         throw new Error(response.statusText);
       }
 
-      if (response.headers.has(AUTH_TOKEN)) {
-        const token = response.headers.get(AUTH_TOKEN);
-        if (token) {
-          setToken(token);
-        }
-      }
+      saveTokens(response);
       if (response.headers.get('Content-Type').match('application/json')) {
         return response.json();
       }
@@ -102,7 +144,13 @@ export function deletePhoto(id)  {
 }
 
 export function getUser() {
-  return callAPI('/auth/');
+  // an expired access token just looks logged out here, so try refreshing it
+  return callAPI('/auth/').then(user => {
+    if (user.loggedIn || !getToken()) {
+      return user;
+    }
+    return refreshToken().then(ok => ok ? callAPI('/auth/') : user);
+  });
 }
 
 export function logout() {
@@ -130,13 +178,36 @@ export function recoverPassword(email) {
   });
 }
 
-export function changePassword(password, code) {
+export function changePassword(password, code, currentPassword) {
   return callAPI('/auth/changepass', 'PUT', {
     password: password,
+    currentPassword: currentPassword || '',
     code: code || ''
   });
 }
 
+export function verifyEmail(token) {
+  return callAPI('/auth/verify', 'POST', {
+    token: token
+  });
+}
+
+export function confirmEmailChange(token) {
+  return callAPI('/auth/email/confirm', 'POST', {
+    token: token
+  });
+}
+
+export function cancelEmailChange(token) {
+  return callAPI('/auth/email/cancel', 'POST', {
+    token: token
+  });
+}
+
+export function resendVerification() {
+  return callAPI('/auth/verify/resend', 'POST');
+}
+
 export function emailExists(email) {
   return callAPI(`/auth/emailExists?email=${email}`);
 }
@@ -55,12 +55,13 @@ export default class ChangePassword extends React.Component {
     const passwordConfirm = this.refs.passwordConfirm.getValue().trim();
 
     const code = this.getRecoveryCode();
+    const currentPassword = code ? null : this.refs.currentPassword.getValue();
 
     this.refs.password.getInputDOMNode().value = "";
     this.refs.passwordConfirm.getInputDOMNode().value = "";
 
     if (password && passwordConfirm) {
-        this.actions.submitForm(password, passwordConfirm, code, this.props.loggedIn);
+        this.actions.submitForm(password, passwordConfirm, code, this.props.loggedIn, currentPassword);
     }
   }
 
@@ -98,6 +99,11 @@ export default class ChangePassword extends React.Component {
     return (
       <div className="col-md-6 col-md-offset-3">
           <form role="form" method="POST" onSubmit={this.handleSubmit}>
+            {code ? null :
+            <Input type="password"
+              ref="currentPassword"
+              placeholder="Current password" />}
+
             <Input type="password"
               ref="password"
               placeholder="Password"
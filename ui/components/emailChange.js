@@ -0,0 +1,69 @@
+import React, { PropTypes } from 'react';
+import { Link } from 'react-router';
+import { Alert, Well } from 'react-bootstrap';
+
+import { Loader } from './widgets';
+
+import * as api from '../api';
+
+// the pages linked to from the email sent to the current address when it's
+// being changed, to confirm or cancel the change
+export default class EmailChange extends React.Component {
+
+  static propTypes = {
+    location: PropTypes.object,
+    params: PropTypes.object
+  }
+
+  constructor(props) {
+    super(props);
+    this.state = { isWaiting: true, isSuccess: false };
+  }
+
+  isCancel() {
+    return this.props.params.action === 'cancel';
+  }
+
+  componentDidMount() {
+    const token = this.props.location.query ? this.props.location.query.token : null;
+    if (!token) {
+      this.setState({ isWaiting: false });
+      return;
+    }
+    const request = this.isCancel() ? api.cancelEmailChange(token) : api.confirmEmailChange(token);
+    request
+      .then(() => this.setState({ isWaiting: false, isSuccess: true }))
+      .catch(() => this.setState({ isWaiting: false }));
+  }
+
+  render() {
+
+    if (this.state.isWaiting) {
+      return <Loader />;
+    }
+
+    if (this.state.isSuccess && this.isCancel()) {
+      return (
+        <Alert bsStyle="success" className="col-md-6 col-md-offset-3">
+          The email change has been cancelled.
+          If you didn't request it, please <Link to="/recoverpass/">reset your password</Link>.
+        </Alert>
+      );
+    }
+
+    if (this.state.isSuccess) {
+      return (
+        <Alert bsStyle="success" className="col-md-6 col-md-offset-3">
+          Thanks, please follow the link sent to your new address to verify it. <Link to="/">Continue</Link>
+        </Alert>
+      );
+    }
+
+    return (
+      <Well className="col-md-6 col-md-offset-3">
+        This link is invalid or has expired.
+      </Well>
+    );
+  }
+
+}
@@ -7,6 +7,8 @@ import App from './app';
 import TagList from './tags';
 import RecoverPassword from './recoverPassword';
 import ChangePassword from './changePassword';
+import VerifyEmail from './verifyEmail';
+import EmailChange from './emailChange';
 
 export default {
   Popular,
@@ -20,4 +22,6 @@ export default {
   Upload,
   RecoverPassword,
   ChangePassword,
+  VerifyEmail,
+  EmailChange,
   TagList };
@@ -0,0 +1,53 @@
+import React, { PropTypes } from 'react';
+import { Link } from 'react-router';
+import { Alert, Well } from 'react-bootstrap';
+
+import { Loader } from './widgets';
+
+import * as api from '../api';
+
+// the page linked to from the verification email
+export default class VerifyEmail extends React.Component {
+
+  static propTypes = {
+    location: PropTypes.object
+  }
+
+  constructor(props) {
+    super(props);
+    this.state = { isWaiting: true, isSuccess: false };
+  }
+
+  componentDidMount() {
+    const token = this.props.location.query ? this.props.location.query.token : null;
+    if (!token) {
+      this.setState({ isWaiting: false });
+      return;
+    }
+    api.verifyEmail(token)
+      .then(() => this.setState({ isWaiting: false, isSuccess: true }))
+      .catch(() => this.setState({ isWaiting: false }));
+  }
+
+  render() {
+
+    if (this.state.isWaiting) {
+      return <Loader />;
+    }
+
+    if (this.state.isSuccess) {
+      return (
+        <Alert bsStyle="success" className="col-md-6 col-md-offset-3">
+          Thanks, your email address has been verified. <Link to="/">Continue</Link>
+        </Alert>
+      );
+    }
+
+    return (
+      <Well className="col-md-6 col-md-offset-3">
+        This verification link is invalid or has expired. Please sign in to get a new one.
+      </Well>
+    );
+  }
+
+}
@@ -12,6 +12,8 @@ import {
   Signup,
   RecoverPassword,
   ChangePassword,
+  VerifyEmail,
+  EmailChange,
   Upload,
   TagList
 } from './components';
@@ -35,6 +37,8 @@ export default function(store, history) {
         <Route path="/signup/" component={Signup} />
         <Route path="/recoverpass/" component={RecoverPassword} />
         <Route path="/changepass/" component={ChangePassword} />
+        <Route path="/verify/" component={VerifyEmail} />
+        <Route path="/email/:action/" component={EmailChange} />
         <Route path="/detail/:id" component={PhotoDetail} />
         <Route path="/user/:userID/:username" component={User} />
       </Route>
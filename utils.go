@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/juju/errgo"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -40,6 +41,38 @@ func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", getScheme(r), r.Host)
 }
 
+// the client address
+func getRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sets the remote address to the client's, if the request came through our
+// proxies. Only the entries our proxies added to X-Forwarded-For can be
+// believed, so we take the last one that isn't a proxy: anything before it was
+// sent by the client and may be made up.
+func useForwardedFor(r *http.Request, isTrustedProxy func(string) bool) {
+	addr := getRemoteIP(r)
+	if !isTrustedProxy(addr) {
+		return
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		addr = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	r.RemoteAddr = net.JoinHostPort(addr, "0")
+}
+
 func decodeJSON(r *http.Request, value interface{}) error {
 	return errgo.Mask(json.NewDecoder(r.Body).Decode(value))
 }
@@ -67,10 +100,27 @@ func intSliceToPgArr(items []int64) string {
 	return "{" + strings.Join(s, ",") + "}"
 }
 
+// Converts a string slice to a Pg Array string
+func stringSliceToPgArr(items []string) string {
+	var s []string
+	for _, value := range items {
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		s = append(s, `"`+value+`"`)
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
 func getPage(r *http.Request) *page {
 	pageNum, err := strconv.ParseInt(r.FormValue("page"), 10, 64)
 	if err != nil {
 		pageNum = 1
 	}
-	return newPage(pageNum)
+	page := newPage(pageNum)
+	if size, err := strconv.ParseInt(r.FormValue("size"), 10, 64); err == nil {
+		page.setSize(size)
+	}
+	page.cursor = r.FormValue("cursor")
+	page.skipCount = r.FormValue("count") == "false"
+	return page
 }
@@ -1,6 +1,7 @@
 package photoshare
 
 import (
+	"net/http"
 	"testing"
 )
 
@@ -19,3 +20,45 @@ func TestIntSliceToPgArr(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestStringSliceToPgArr(t *testing.T) {
+	s := []string{"new york", `say "cheese"`, `back\slash`}
+	result := stringSliceToPgArr(s)
+	if result != `{"new york","say \"cheese\"","back\\slash"}` {
+		t.Error(result)
+	}
+}
+
+func TestGetRemoteIP(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.168.1.10:51234"
+	if ip := getRemoteIP(r); ip != "192.168.1.10" {
+		t.Error("Should use the remote address:", ip)
+	}
+}
+
+func TestUseForwardedFor(t *testing.T) {
+	cfg := &config{TrustedProxies: "10.0.0.0/8, 192.168.1.10"}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.7:51234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	useForwardedFor(r, cfg.isTrustedProxy)
+	if ip := getRemoteIP(r); ip != "198.51.100.7" {
+		t.Error("Should ignore X-Forwarded-For from a client:", ip)
+	}
+
+	r.RemoteAddr = "192.168.1.10:51234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.5, 10.0.0.1")
+	useForwardedFor(r, cfg.isTrustedProxy)
+	if ip := getRemoteIP(r); ip != "203.0.113.5" {
+		t.Error("Should use the address our proxies forwarded:", ip)
+	}
+
+	r.RemoteAddr = "192.168.1.10:51234"
+	r.Header.Del("X-Forwarded-For")
+	useForwardedFor(r, cfg.isTrustedProxy)
+	if ip := getRemoteIP(r); ip != "192.168.1.10" {
+		t.Error("Should use the proxy address if nothing was forwarded:", ip)
+	}
+}
@@ -0,0 +1,246 @@
+package photoshare
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Users verify their email address with a link emailed on signup. Until then
+// they can log in, but can't take the actions listed in UNVERIFIED_RESTRICTIONS.
+// A new address is kept as pending until it has been verified the same way;
+// if the current address is verified, the change must first be confirmed
+// from it, so someone holding a session can't take the account over.
+
+const (
+	verificationExpiry  = 48 // hours
+	verifyFreeAttempts  = 3  // verification emails before resending is throttled
+	restrictUpload      = "upload"
+	restrictComment     = "comment"
+	restrictVote        = "vote"
+	verificationMessage = "Please verify your email address first"
+)
+
+// sets a new verification token for the address to verify, returning it to be emailed
+func (user *user) generateVerifyToken() (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	user.VerifyToken = sql.NullString{String: hashToken(token), Valid: true}
+	user.VerifySentAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return token, nil
+}
+
+// starts an email change to be confirmed from the current address, returning
+// the token to be emailed there; the new address gets no verification token
+// until the change is confirmed
+func (user *user) generateChangeToken() (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	user.ChangeToken = sql.NullString{String: hashToken(token), Valid: true}
+	user.VerifyToken = sql.NullString{}
+	user.VerifySentAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return token, nil
+}
+
+// drops a pending email change along with its tokens
+func (user *user) cancelEmailChange() {
+	user.PendingEmail = sql.NullString{}
+	user.ChangeToken = sql.NullString{}
+	if user.EmailVerified {
+		user.VerifyToken = sql.NullString{}
+		user.VerifySentAt = sql.NullTime{}
+	}
+}
+
+// the expiry of both verification and email change tokens
+func (user *user) verifyTokenExpired(now time.Time) bool {
+	return !user.VerifySentAt.Valid || now.After(user.VerifySentAt.Time.Add(time.Hour*verificationExpiry))
+}
+
+// the pending address if the user is changing their email, or else their current one
+func (user *user) addressToVerify() string {
+	if user.PendingEmail.Valid {
+		return user.PendingEmail.String
+	}
+	return user.Email
+}
+
+func (user *user) needsVerification() bool {
+	return !user.EmailVerified || user.PendingEmail.Valid
+}
+
+// marks the address to verify as verified, making it the user's address
+func (user *user) markVerified() {
+	user.Email = user.addressToVerify()
+	user.EmailVerified = true
+	user.PendingEmail = sql.NullString{}
+	user.ChangeToken = sql.NullString{}
+	user.VerifyToken = sql.NullString{}
+	user.VerifySentAt = sql.NullTime{}
+}
+
+// returns an error if the current user needs a verified address for the action
+func (ctx *context) checkVerified(action string) error {
+	if ctx.user.EmailVerified || !ctx.cfg.restrictsUnverified(action) {
+		return nil
+	}
+	return httpError{http.StatusForbidden, verificationMessage}
+}
+
+func (ctx *context) sendVerificationMail(user *user, token string, r *http.Request) {
+	go func() {
+		if err := ctx.mailer.sendVerificationMail(user, token, r); err != nil {
+			logError(err)
+		}
+	}()
+}
+
+// confirms the address with the token from the verification email
+func verifyEmail(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	s := &struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return err
+	}
+
+	invalidToken := httpError{http.StatusBadRequest, "Invalid or expired verification link"}
+
+	if s.Token == "" {
+		return invalidToken
+	}
+
+	user, err := ctx.datamapper.getUserByVerifyToken(hashToken(s.Token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return invalidToken
+		}
+		return err
+	}
+	// the change hasn't been confirmed from the current address yet
+	if user.verifyTokenExpired(time.Now()) || user.ChangeToken.Valid {
+		return invalidToken
+	}
+
+	user.markVerified()
+
+	// the address may have been taken since the change was requested
+	ok, err := ctx.datamapper.isUserEmailAvailable(user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return httpError{http.StatusConflict, "This email address is already taken"}
+	}
+
+	if err := ctx.datamapper.updateUser(user); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Email address verified")
+}
+
+// sends a new verification email to the current user
+func resendVerification(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	if !ctx.user.needsVerification() {
+		return httpError{http.StatusBadRequest, "Your email address is already verified"}
+	}
+	if ctx.user.ChangeToken.Valid {
+		return httpError{http.StatusBadRequest, "Please confirm the change from your current email address first"}
+	}
+
+	key := fmt.Sprintf("verify:%d", ctx.user.ID)
+
+	if err := ctx.checkThrottles(key); err != nil {
+		return err
+	}
+	if _, err := ctx.recordFailure(key, verifyFreeAttempts); err != nil {
+		return err
+	}
+
+	token, err := ctx.user.generateVerifyToken()
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.updateUser(ctx.user); err != nil {
+		return err
+	}
+
+	ctx.sendVerificationMail(ctx.user, token, r)
+	return renderString(w, http.StatusOK, "Verification email sent")
+}
+
+// looks up the user of the token from the email sent to the current address
+// when their address is being changed
+func getEmailChangeUser(ctx *context, r *http.Request) (*user, error) {
+
+	s := &struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := decodeJSON(r, s); err != nil {
+		return nil, err
+	}
+
+	invalidToken := httpError{http.StatusBadRequest, "Invalid or expired link"}
+
+	if s.Token == "" {
+		return nil, invalidToken
+	}
+
+	user, err := ctx.datamapper.getUserByEmailChangeToken(hashToken(s.Token))
+	if err != nil {
+		if isErrSqlNoRows(err) {
+			return nil, invalidToken
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// confirms an email change from the current address, sending the
+// verification link to the new one
+func confirmEmailChange(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getEmailChangeUser(ctx, r)
+	if err != nil {
+		return err
+	}
+	if user.verifyTokenExpired(time.Now()) {
+		return httpError{http.StatusBadRequest, "Invalid or expired link"}
+	}
+
+	user.ChangeToken = sql.NullString{}
+	token, err := user.generateVerifyToken()
+	if err != nil {
+		return err
+	}
+	if err := ctx.datamapper.updateUser(user); err != nil {
+		return err
+	}
+
+	ctx.sendVerificationMail(user, token, r)
+	return renderString(w, http.StatusOK, "Email change confirmed")
+}
+
+// cancels an email change from the current address
+func cancelEmailChange(ctx *context, w http.ResponseWriter, r *http.Request) error {
+
+	user, err := getEmailChangeUser(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	user.cancelEmailChange()
+	if err := ctx.datamapper.updateUser(user); err != nil {
+		return err
+	}
+	return renderString(w, http.StatusOK, "Email change cancelled")
+}
@@ -0,0 +1,95 @@
+package photoshare
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a user changing their verified address to new@example.com
+type emailChangeStore struct {
+	mockDataMapper
+	user    *user
+	updated *user
+}
+
+func newEmailChangeStore(confirmed bool) *emailChangeStore {
+	user := &user{
+		ID:            1,
+		Email:         "old@example.com",
+		EmailVerified: true,
+		PendingEmail:  sql.NullString{String: "new@example.com", Valid: true},
+		VerifyToken:   sql.NullString{String: hashToken("verify"), Valid: true},
+		VerifySentAt:  sql.NullTime{Time: time.Now(), Valid: true},
+	}
+	if !confirmed {
+		user.ChangeToken = sql.NullString{String: hashToken("change"), Valid: true}
+	}
+	return &emailChangeStore{user: user}
+}
+
+func (m *emailChangeStore) getUserByVerifyToken(tokenHash string) (*user, error) {
+	return m.user, nil
+}
+
+func (m *emailChangeStore) getUserByEmailChangeToken(tokenHash string) (*user, error) {
+	return m.user, nil
+}
+
+func (m *emailChangeStore) updateUser(user *user) error {
+	m.updated = user
+	return nil
+}
+
+func postToken(handler handlerFunc, store dataMapper, token string) error {
+	req, _ := http.NewRequest("POST", "http://localhost/api/auth/", strings.NewReader(`{"token": "`+token+`"}`))
+	c := &context{
+		app:    &app{datamapper: store, cache: &mockCache{}},
+		params: &params{make(map[string]string)},
+	}
+	return handler(c, httptest.NewRecorder(), req)
+}
+
+func TestVerifyEmailChange(t *testing.T) {
+	store := newEmailChangeStore(false)
+	if err := postToken(verifyEmail, store, "verify"); err == nil {
+		t.Error("New address should not be verified before the change is confirmed")
+	}
+	if store.updated != nil || store.user.Email != "old@example.com" {
+		t.Error("Address should not be changed")
+	}
+
+	store = newEmailChangeStore(true)
+	if err := postToken(verifyEmail, store, "verify"); err != nil {
+		t.Fatal(err)
+	}
+	if store.updated == nil || store.updated.Email != "new@example.com" {
+		t.Error("Address should be changed once confirmed and verified")
+	}
+}
+
+func TestCancelEmailChange(t *testing.T) {
+	store := newEmailChangeStore(false)
+	if err := postToken(cancelEmailChange, store, "change"); err != nil {
+		t.Fatal(err)
+	}
+	if store.updated == nil || store.updated.PendingEmail.Valid || store.updated.ChangeToken.Valid || store.updated.VerifyToken.Valid {
+		t.Error("Pending change should be dropped")
+	}
+	if store.updated.Email != "old@example.com" || !store.updated.EmailVerified {
+		t.Error("Current address should be kept")
+	}
+}
+
+func TestRestrictsUnverified(t *testing.T) {
+	cfg := &config{UnverifiedRestrictions: "upload, vote"}
+	if !cfg.restrictsUnverified(restrictUpload) || !cfg.restrictsUnverified(restrictVote) {
+		t.Error("Listed actions should be restricted")
+	}
+	if cfg.restrictsUnverified(restrictComment) {
+		t.Error("Other actions should be allowed")
+	}
+}